@@ -0,0 +1,626 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+)
+
+// duplicateSemantics is how a backend resolves a key that appears more than
+// once in its input.
+type duplicateSemantics int
+
+const (
+	// duplicatesLastWins means lookups return the last value written.
+	duplicatesLastWins duplicateSemantics = iota
+	// duplicatesFirstWins means lookups return the first value written.
+	duplicatesFirstWins
+	// duplicatesAnyWins means lookups return one of the values written,
+	// but which one isn't specified (e.g. because the builder sorts its
+	// input with an unstable sort).
+	duplicatesAnyWins
+	// duplicatesError means building the table fails.
+	duplicatesError
+	// duplicatesHang means the builder never finishes: perfect-hash
+	// constructions search forever for a seed that sends repeated keys to
+	// distinct slots.  Input must be deduplicated before it gets there.
+	duplicatesHang
+)
+
+func (s duplicateSemantics) String() string {
+	switch s {
+	case duplicatesLastWins:
+		return "last-writer-wins"
+	case duplicatesFirstWins:
+		return "first-writer-wins"
+	case duplicatesAnyWins:
+		return "unspecified"
+	case duplicatesError:
+		return "error"
+	case duplicatesHang:
+		return "build never finishes"
+	}
+	return "unknown"
+}
+
+// lookupFunc looks up key in a table, returning its value and whether it
+// was found.  The value must not be modified, and is only valid until the
+// next lookup with the same function: like the Get benchmarks, lookups
+// hand back a table's own memory rather than a copy wherever they can.
+type lookupFunc func(key string) ([]byte, bool)
+
+// bytesLookupFunc is a lookupFunc taking the key as a []byte.
+type bytesLookupFunc func(key []byte) ([]byte, bool)
+
+// batchLookupFunc looks up keys in a table, calling found with the index
+// and value of each one that's there, in no particular order.  The value
+// must not be modified, and is only valid until found returns.
+type batchLookupFunc func(keys []string, found func(i int, value []byte))
+
+// writeFunc stores value under key in a table, inserting it or replacing
+// the value already there.  Neither slice is retained after it returns.
+type writeFunc func(key, value []byte) error
+
+// stringLookup adapts a table whose lookups return strings.
+func stringLookup(get func(key string) (string, bool)) lookupFunc {
+	return func(key string) ([]byte, bool) {
+		value, ok := get(key)
+		return zerocopy.Bytes(value), ok
+	}
+}
+
+// A backend is a table implementation, described in the uniform shape the
+// tests that run against every backend need.  Each backend's file registers
+// it from an init function, so build-tagged backends are only tested when
+// they're built.
+type backend struct {
+	name string
+	// open builds a table from the testdata at path.  Like the
+	// create*Table functions it wraps, it panics if the build fails.
+	open func(path string) backendTable
+	// duplicates documents how the table handles repeated keys.
+	duplicates duplicateSemantics
+	// lookupAllocs is how many allocations a lookup that finds its key
+	// makes, pinned by TestLookupAllocs so that a dependency update
+	// changing it shows up as a failure rather than as noise in ns/op.
+	// allocsUnmeasured leaves it unchecked.
+	lookupAllocs int
+	// unavailable is why the backend can't be run in this build, for the
+	// stand-ins registered in place of backends left out by build tags.
+	unavailable string
+	// probe, if set, checks once flags are parsed whether the backend
+	// can run on this machine, returning why not (which probeBackends
+	// records in unavailable) or "".
+	probe func() string
+	// openMutable is open for backends that take writes once built,
+	// returning a table with a newWriter; open's tables are often
+	// reopened read-only, which the Get benchmarks want.  It's nil for
+	// build-only backends, which have to be rebuilt to change (their
+	// Create benchmarks time that).
+	openMutable func(path string) backendTable
+	// tunables are settings of the backend's, and openTuned is open
+	// with params holding a value for each of them by name, like
+	// {"cache": "64M"}; BenchmarkSweepGet runs every combination of
+	// their values.
+	tunables  []tunable
+	openTuned func(path string, params map[string]string) backendTable
+	// benchTable returns the table the backend's Get benchmarks look
+	// up in, loading it (from -tabledir, where it's cached) the first
+	// time, which -verify checks rather than a table of open's (as it
+	// does for backends that leave it nil).  The table is shared, so its
+	// close mustn't be called.
+	benchTable func() backendTable
+}
+
+// skipIfUnavailable skips tb if b isn't in this build, or has hung.
+func (b backend) skipIfUnavailable(tb testing.TB) {
+	tb.Helper()
+	if b.unavailable != "" {
+		tb.Skipf("%s: %s", b.name, b.unavailable)
+	}
+	if reason := hungBackends[b.name]; reason != "" {
+		tb.Skipf("%s: %s", b.name, reason)
+	}
+}
+
+const allocsUnmeasured = -1
+
+// backendTable is a table built by a backend's open function.
+type backendTable struct {
+	// newReader returns a lookupFunc for the use of a single goroutine,
+	// set up the way the backend's Get benchmark sets up each
+	// RunParallel goroutine, and a function releasing it.
+	// newBytesReader is the same for []byte keys.  A backend sets
+	// whichever of the two its lookups natively take, or both where its
+	// API has both; see reader and bytesReader for how the other is made.
+	newReader      func() (lookupFunc, func())
+	newBytesReader func() (bytesLookupFunc, func())
+	// newBatchReader is the same for batches of keys, for backends with a
+	// native multi-get.  It is nil for the rest, which look batches up
+	// a key at a time.
+	newBatchReader func() (batchLookupFunc, func())
+	// newWriter is the same for writes, for tables from openMutable.
+	// Writers are safe to use concurrently with each other and with
+	// readers.
+	newWriter func() (writeFunc, func())
+	close     func()
+}
+
+// reader returns a lookupFunc for the use of a single goroutine, and a
+// function releasing it.  For tables taking []byte keys, keys are converted
+// without copying, the same as in the Get benchmarks.
+func (t backendTable) reader() (lookupFunc, func()) {
+	if t.newReader != nil {
+		return t.newReader()
+	}
+	get, release := t.newBytesReader()
+	return func(key string) ([]byte, bool) {
+		return get(zerocopy.Bytes(key))
+	}, release
+}
+
+// bytesReader is reader for []byte keys.  For tables taking string keys,
+// each key is copied into a new string, which is what a caller holding a
+// []byte would have to do.
+func (t backendTable) bytesReader() (bytesLookupFunc, func()) {
+	if t.newBytesReader != nil {
+		return t.newBytesReader()
+	}
+	get, release := t.newReader()
+	return func(key []byte) ([]byte, bool) {
+		return get(string(key))
+	}, release
+}
+
+// batchReader returns a batchLookupFunc for the use of a single goroutine,
+// and a function releasing it.
+func (t backendTable) batchReader() (batchLookupFunc, func()) {
+	if t.newBatchReader != nil {
+		return t.newBatchReader()
+	}
+	get, release := t.reader()
+	return func(keys []string, found func(i int, value []byte)) {
+		for i, key := range keys {
+			if value, ok := get(key); ok {
+				found(i, value)
+			}
+		}
+	}, release
+}
+
+// sharedReader is the newReader function for tables whose lookups need no
+// per-goroutine state.
+func sharedReader(get lookupFunc) func() (lookupFunc, func()) {
+	return func() (lookupFunc, func()) {
+		return get, noClose
+	}
+}
+
+// sharedBytesReader is sharedReader for newBytesReader.
+func sharedBytesReader(get bytesLookupFunc) func() (bytesLookupFunc, func()) {
+	return func() (bytesLookupFunc, func()) {
+		return get, noClose
+	}
+}
+
+// sharedWriter is sharedReader for newWriter.
+func sharedWriter(put writeFunc) func() (writeFunc, func()) {
+	return func() (writeFunc, func()) {
+		return put, noClose
+	}
+}
+
+var backends = make(map[string]backend)
+
+func registerBackend(b backend) {
+	if _, ok := backends[b.name]; ok {
+		panic("backend " + b.name + " registered twice")
+	}
+	backends[b.name] = b
+}
+
+// The environment variables naming the backend TestDuplicatesHangChild
+// builds, and the testdata it builds it from.
+const (
+	duplicatesHangBackendEnv = "BIT_BENCHMARK_CHILD_HANG_BACKEND"
+	duplicatesHangPathEnv    = "BIT_BENCHMARK_CHILD_HANG_TESTDATA"
+)
+
+// duplicatesHangTimeout is the -phase-timeout a build expected to hang is
+// given to show it.
+const duplicatesHangTimeout = 2 * time.Second
+
+// expectBuildHangs checks that building the named backend's table from the
+// testdata at path runs past a short -phase-timeout.  There's no way to
+// stop a build once it's hung, and one left spinning would slow every test
+// after it, so it's built in a child process that exits once it times out.
+func expectBuildHangs(t *testing.T, name, path string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDuplicatesHangChild$", "-phase-timeout="+duplicatesHangTimeout.String())
+	cmd.Env = append(os.Environ(), duplicatesHangBackendEnv+"="+name, duplicatesHangPathEnv+"="+path)
+	out, err := cmd.CombinedOutput()
+	if err == nil || !bytes.Contains(out, []byte("hung for over")) {
+		t.Fatalf("expected the build to run past -phase-timeout %v, got %v:\n%s", duplicatesHangTimeout, err, out)
+	}
+}
+
+// TestDuplicatesHangChild builds a table for expectBuildHangs.
+func TestDuplicatesHangChild(t *testing.T) {
+	name := os.Getenv(duplicatesHangBackendEnv)
+	if name == "" {
+		t.Skip("only run by expectBuildHangs")
+	}
+	table := buildTable(t, name, backends[name].open, os.Getenv(duplicatesHangPathEnv))
+	table.close()
+}
+
+// registerUnavailableBackend registers a stand-in for a backend this build
+// can't include -- its build tag wasn't set, its module isn't in go.mod
+// yet, or it doesn't build on this platform -- so that tests and
+// benchmarks over every backend report it as skipped, with reason, rather
+// than leaving it out without a word.  Every backend is registered, one way
+// or the other, in every build.
+func registerUnavailableBackend(name, reason string) {
+	registerBackend(backend{name: name, unavailable: reason})
+}
+
+// probeBackends marks the backends whose probe fails as unavailable.
+func probeBackends() {
+	for name, b := range backends {
+		if b.probe == nil || b.unavailable != "" {
+			continue
+		}
+		if reason := b.probe(); reason != "" {
+			b.unavailable = reason
+			backends[name] = b
+		}
+	}
+}
+
+// selectedBackends restricts the tests and benchmarks over every backend to
+// some of them.
+var selectedBackends = flag.String("backends", "", "comma-separated `backends` for the tests and benchmarks over every backend (default all)")
+
+// sortedBackends returns the registered backends ordered by name, leaving
+// out any not in -backends.
+func sortedBackends() []backend {
+	var selected map[string]bool
+	if *selectedBackends != "" {
+		selected = make(map[string]bool)
+		for _, name := range strings.Split(*selectedBackends, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := backends[name]; !ok {
+				panic(fmt.Sprintf("-backends: unknown backend %q", name))
+			}
+			selected[name] = true
+		}
+	}
+	result := make([]backend, 0, len(backends))
+	for _, b := range backends {
+		if selected != nil && !selected[b.name] {
+			continue
+		}
+		result = append(result, b)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name < result[j].name
+	})
+	return result
+}
+
+// noClose is the close function for tables with nothing to release.
+func noClose() {}
+
+func TestDuplicateKeySemantics(t *testing.T) {
+	path := writeGeneratedTestData(t, 2000, 0.1)
+
+	first := make(map[string]string)
+	last := make(map[string]string)
+	written := make(map[string]map[string]bool)
+	streamTestFile(path, func(k, v []byte) {
+		key, value := string(k), string(v)
+		if _, ok := first[key]; !ok {
+			first[key] = value
+			written[key] = make(map[string]bool)
+		}
+		last[key] = value
+		written[key][value] = true
+	})
+	if len(first) == 2000 {
+		t.Fatal("generated testdata has no repeated keys")
+	}
+
+	for _, b := range sortedBackends() {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			b.skipIfUnavailable(t)
+			if b.duplicates == duplicatesHang {
+				expectBuildHangs(t, b.name, path)
+				return
+			}
+			var table backendTable
+			err := func() (err any) {
+				defer func() {
+					err = recover()
+				}()
+				table = b.open(path)
+				return nil
+			}()
+			if b.duplicates == duplicatesError {
+				if err == nil {
+					table.close()
+					t.Fatalf("expected build to fail with %s semantics", b.duplicates)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("build failed: %v", err)
+			}
+			defer table.close()
+			get, release := table.reader()
+			defer release()
+
+			for key := range first {
+				v, ok := get(key)
+				if !ok {
+					t.Fatalf("%s: not found", key)
+				}
+				value := string(v)
+				switch b.duplicates {
+				case duplicatesLastWins:
+					ok = value == last[key]
+				case duplicatesFirstWins:
+					ok = value == first[key]
+				case duplicatesAnyWins:
+					ok = written[key][value]
+				}
+				if !ok {
+					t.Fatalf("%s: got %q, which isn't %s", key, value, b.duplicates)
+				}
+			}
+		})
+	}
+}
+
+// writeGeneratedTestData writes a generated fixture of n entries to a file
+// in t's temporary directory and returns its path.
+func writeGeneratedTestData(t *testing.T, n int, duplicates float64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "testdata.generated")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := generateTestData(f, n, duplicates, 1, hexKeys, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeShapedTestData writes a generated fixture of n distinct keys of the
+// given shape, that bit can index, to a temporary file, returning its
+// path.
+func writeShapedTestData(t *testing.T, n int, shape keyShape) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "testdata.generated")
+	if err := generateTestDataFile(path, n, shape, false); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestBackendsAgree checks every backend finds what's in the testdata,
+// and nothing else, for each shape of key: hash functions and comparisons
+// that only ever see hex keys can get NULs, high bytes and multi-byte
+// UTF-8 wrong.
+func TestBackendsAgree(t *testing.T) {
+	const entries = 10000
+	for _, shape := range keyShapes {
+		t.Run(shape.name, func(t *testing.T) {
+			path := writeShapedTestData(t, entries, shape)
+
+			want := make(map[string]string)
+			streamTestFile(path, func(k, v []byte) {
+				want[string(k)] = string(v)
+			})
+
+			// keys near the real ones are the likeliest to be wrongly found: a
+			// prefix or extension of a key, or one differing only in its last
+			// byte, as well as keys that were never close.
+			var absent []string
+			for key := range want {
+				absent = append(absent,
+					key[:len(key)-1],
+					key+"0",
+					key[:len(key)-1]+string(key[len(key)-1]^1),
+				)
+				if len(absent) >= 300 {
+					break
+				}
+			}
+			for i := 0; i < 100; i++ {
+				absent = append(absent, fmt.Sprintf("absent-%d", i))
+			}
+			for _, key := range absent {
+				if _, ok := want[key]; ok {
+					t.Fatalf("%q is in the testdata", key)
+				}
+			}
+
+			for _, b := range sortedBackends() {
+				b := b
+				t.Run(b.name, func(t *testing.T) {
+					b.skipIfUnavailable(t)
+					table := buildTable(t, b.name, b.open, path)
+					defer table.close()
+					get, release := table.reader()
+					defer release()
+
+					for key, value := range want {
+						if got, ok := get(key); !ok || string(got) != value {
+							t.Fatalf("get(%q) = %q, %v; want %q", key, got, ok, value)
+						}
+					}
+					for _, key := range absent {
+						if got, ok := get(key); ok {
+							t.Fatalf("get(%q) = %q; want a miss", key, got)
+						}
+					}
+
+					getBytes, releaseBytes := table.bytesReader()
+					defer releaseBytes()
+					for key, value := range want {
+						if got, ok := getBytes([]byte(key)); !ok || string(got) != value {
+							t.Fatalf("getBytes(%q) = %q, %v; want %q", key, got, ok, value)
+						}
+					}
+					for _, key := range absent {
+						if got, ok := getBytes([]byte(key)); ok {
+							t.Fatalf("getBytes(%q) = %q; want a miss", key, got)
+						}
+					}
+
+					// batches mixing hits and misses, the last one short.
+					var keys []string
+					for key := range want {
+						keys = append(keys, key)
+						if len(keys)%3 == 0 {
+							keys = append(keys, absent[len(keys)%len(absent)])
+						}
+					}
+					batch, releaseBatch := table.batchReader()
+					defer releaseBatch()
+					for len(keys) > 0 {
+						n := min(len(keys), 100)
+						seen := make([]bool, n)
+						batch(keys[:n], func(i int, value []byte) {
+							if seen[i] {
+								t.Fatalf("batch found %q twice", keys[i])
+							}
+							seen[i] = true
+							if v, ok := want[keys[i]]; !ok || string(value) != v {
+								t.Fatalf("batch get(%q) = %q; want %q, %v", keys[i], value, v, ok)
+							}
+						})
+						for i, key := range keys[:n] {
+							if _, ok := want[key]; ok && !seen[i] {
+								t.Fatalf("batch get(%q) missed", key)
+							}
+						}
+						keys = keys[n:]
+					}
+				})
+			}
+
+		})
+	}
+}
+
+// TestConcurrentReaders hammers each backend's read path from many
+// goroutines at once, each with its own reader set up the way the Get
+// benchmarks set up theirs.  It's most useful under -race.
+func TestConcurrentReaders(t *testing.T) {
+	const (
+		entries = 2000
+		lookups = 5000
+	)
+	path := writeGeneratedTestData(t, entries, 0)
+	var want []benchEntry
+	streamTestFile(path, func(k, v []byte) {
+		want = append(want, benchEntry{Key: string(k), Value: string(v)})
+	})
+	readers := 4 * runtime.GOMAXPROCS(0)
+	if readers < 8 {
+		readers = 8
+	}
+
+	for _, b := range sortedBackends() {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			b.skipIfUnavailable(t)
+			table := buildTable(t, b.name, b.open, path)
+			defer table.close()
+
+			var wg sync.WaitGroup
+			errs := make(chan string, readers)
+			for r := 0; r < readers; r++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					get, release := table.reader()
+					defer release()
+					rng := rand.New(rand.NewSource(seed))
+					for i := 0; i < lookups; i++ {
+						entry := want[rng.Intn(len(want))]
+						if value, ok := get(entry.Key); !ok || string(value) != entry.Value {
+							errs <- fmt.Sprintf("get(%q) = %q, %v; want %q", entry.Key, value, ok, entry.Value)
+							return
+						}
+					}
+				}(int64(r))
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLookupAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector adds allocations of its own")
+	}
+	path := writeGeneratedTestData(t, 10000, 0)
+	var keys []string
+	streamTestFile(path, func(k, v []byte) {
+		keys = append(keys, string(k))
+	})
+
+	for _, b := range sortedBackends() {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			b.skipIfUnavailable(t)
+			if b.lookupAllocs == allocsUnmeasured {
+				t.Skipf("allocations per lookup not pinned for %s", b.name)
+			}
+			table := buildTable(t, b.name, b.open, path)
+			defer table.close()
+			get, release := table.reader()
+			defer release()
+
+			// a different key each run, so no backend is just
+			// answering the same lookup out of a cache.
+			i := 0
+			allocs := testing.AllocsPerRun(1000, func() {
+				if _, ok := get(keys[i%len(keys)]); !ok {
+					panic("bad data or lookup")
+				}
+				i++
+			})
+			if int(allocs) != b.lookupAllocs {
+				t.Errorf("%v allocations per lookup; want %d", allocs, b.lookupAllocs)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
+)
+
+var (
+	benchTableBadgerOnce sync.Once
+	benchTableBadger     *badger.DB
+)
+
+func init() {
+	registerBackend(backend{
+		name: "badger",
+		open: func(path string) backendTable {
+			return newBadgerBackendTable(createBadgerTable(path, badgerBlockSize))
+		},
+		duplicates:   duplicatesLastWins,
+		lookupAllocs: 13,
+		openMutable: func(path string) backendTable {
+			db, closeTable := createMutableBadgerTable(path)
+			return backendTable{
+				newBytesReader: func() (bytesLookupFunc, func()) {
+					var buf []byte
+					return func(key []byte) ([]byte, bool) {
+						// a transaction reads a snapshot, so
+						// each lookup gets its own to see
+						// concurrent writes.
+						txn := db.NewTransaction(false)
+						defer txn.Discard()
+						item, err := txn.Get(key)
+						if err != nil {
+							return nil, false
+						}
+						buf, err = item.ValueCopy(buf[:0])
+						return buf, err == nil
+					}, noClose
+				},
+				newWriter: sharedWriter(func(key, value []byte) error {
+					return db.Update(func(txn *badger.Txn) error {
+						return txn.Set(key, value)
+					})
+				}),
+				close: closeTable,
+			}
+		},
+		tunables: []tunable{
+			{name: "block", values: []string{"4K", "16K", "64K"}},
+		},
+		openTuned: func(path string, params map[string]string) backendTable {
+			return newBadgerBackendTable(createBadgerTable(path, int(parseTunableSize(params["block"]))))
+		},
+		benchTable: func() backendTable {
+			benchTableBadgerOnce.Do(loadBadgerBenchTable)
+			return newBadgerBackendTable(benchTableBadger)
+		},
+	})
+}
+
+// newBadgerBackendTable returns the backendTable reading the read-only db.
+func newBadgerBackendTable(db *badger.DB) backendTable {
+	return backendTable{
+		newBytesReader: func() (bytesLookupFunc, func()) {
+			txn := db.NewTransaction(false)
+			var buf []byte
+			return func(key []byte) ([]byte, bool) {
+				item, err := txn.Get(key)
+				if err != nil {
+					return nil, false
+				}
+				buf, err = item.ValueCopy(buf[:0])
+				return buf, err == nil
+			}, txn.Discard
+		},
+		close: func() { _ = db.Close() },
+	}
+}
+
+func loadBadgerBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableBadger = createBadgerTable(testData, badgerBlockSize)
+}
+
+// badgerBlockSize is the size of the blocks Badger's tables are divided
+// into, its default; BenchmarkSweepGet tries others.
+const badgerBlockSize = 4 << 10
+
+func newBadgerOptions(dir string) badger.Options {
+	// the other stores are uncompressed, and with compression (and
+	// encryption) off Badger reads blocks straight out of its mmapped
+	// tables, so the block cache would only add overhead.
+	return badger.DefaultOptions(dir).
+		WithCompression(options.None).
+		WithBlockCacheSize(0).
+		WithMetricsEnabled(false).
+		WithLogger(nil)
+}
+
+// createBadgerTable builds a table of blockSize-byte blocks and opens it
+// read-only.
+func createBadgerTable(testDataPath string, blockSize int) *badger.DB {
+	dir, err := newTableDir("bit-test.*.badger")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	buildBadgerTable(testDataPath, dir, blockSize)
+	table, err := badger.Open(newBadgerOptions(dir).
+		WithReadOnly(true).
+		WithNumCompactors(0).
+		WithDetectConflicts(false))
+	if err != nil {
+		panic(err)
+	}
+
+	return table
+}
+
+// createMutableBadgerTable builds a table and opens it for writing too,
+// returning it and a function closing it and removing its directory.
+func createMutableBadgerTable(testDataPath string) (*badger.DB, func()) {
+	dir, err := newTableDir("bit-test.*.badger")
+	if err != nil {
+		panic(err)
+	}
+	buildBadgerTable(testDataPath, dir, badgerBlockSize)
+	db, err := badger.Open(newBadgerOptions(dir))
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		panic(err)
+	}
+	return db, func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func buildBadgerTable(testDataPath, dir string, blockSize int) {
+	db, err := badger.Open(newBadgerOptions(dir).WithBlockSize(blockSize))
+	if err != nil {
+		panic(err)
+	}
+
+	wb := db.NewWriteBatch()
+	streamTestFile(testDataPath, func(k, v []byte) {
+		// the write batch holds on to the slices until it is flushed,
+		// and streamTestFile reuses its buffers.
+		if err := wb.Set([]byte(string(k)), []byte(string(v))); err != nil {
+			panic(err)
+		}
+	})
+	if err := wb.Flush(); err != nil {
+		panic(err)
+	}
+
+	// compact everything down to a single level so lookups don't have to
+	// consult a pile of L0 tables, as they wouldn't in a long-lived store.
+	if err := db.Flatten(runtime.GOMAXPROCS(0)); err != nil {
+		panic(err)
+	}
+	if err := db.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func BenchmarkBadgerGet(b *testing.B) {
+	loadTable(b, "badger", &benchTableBadgerOnce, loadBadgerBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "badger", func(b *testing.PB) {
+		defer pinWorker()()
+		txn := benchTableBadger.NewTransaction(false)
+		defer txn.Discard()
+
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			item, err := txn.Get(zerocopy.Bytes(entry.Key))
+			if (err == nil) == entry.Absent {
+				panic("bad data or lookup")
+			}
+			if err == nil {
+				err = item.Value(func(value []byte) error {
+					if !entry.matches(value, true) {
+						panic("bad data or lookup")
+					}
+					return nil
+				})
+				if err != nil {
+					panic("bad data or lookup")
+				}
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableBadgerCreate *badger.DB
+
+func BenchmarkBadgerCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		if benchTableBadgerCreate != nil {
+			_ = benchTableBadgerCreate.Close()
+		}
+		benchTableBadgerCreate = buildTable(b, "badger", func(path string) *badger.DB {
+			return createBadgerTable(path, badgerBlockSize)
+		}, testData)
+		if benchTableBadgerCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
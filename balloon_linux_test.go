@@ -0,0 +1,19 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build linux
+
+package bitbenchmark
+
+import "golang.org/x/sys/unix"
+
+// allocBalloon maps size bytes of anonymous memory: outside the Go heap, so
+// it neither counts towards the GC's goal nor gets scanned.
+func allocBalloon(size int) ([]byte, error) {
+	return unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+}
+
+func freeBalloon(mem []byte) error {
+	return unix.Munmap(mem)
+}
@@ -0,0 +1,19 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !linux
+
+package bitbenchmark
+
+import "errors"
+
+var errBalloonUnsupported = errors.New("memory balloons are only supported on Linux")
+
+func allocBalloon(size int) ([]byte, error) {
+	return nil, errBalloonUnsupported
+}
+
+func freeBalloon(mem []byte) error {
+	return errBalloonUnsupported
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"flag"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// On a shared machine the page cache is whatever co-tenant services leave
+// of RAM, and a backend whose table no longer fits pays for it in faults
+// and tail latency.  BenchmarkBalloonGet looks up in each backend's table
+// with no competition for memory and then while a "balloon" of each
+// -balloon size of anonymous memory is held, and kept recently used so
+// that the kernel evicts the page cache rather than it:
+//
+//	go test -run XXX -bench BalloonGet -balloon 4G,12G -backends bit,pebble
+//
+// A balloon bigger than the free RAM (and swap) there is gets the process
+// OOM-killed, so size them from what's free after the tables are built.
+var balloonSizes = flag.String("balloon", "", "comma-separated `sizes` of anonymous memory, like 4G, for BenchmarkBalloonGet to hold")
+
+// balloonTouchInterval is how often a balloon's every page is touched.
+// That's often enough to keep them ahead of the page cache in the kernel's
+// LRU lists, without the touching taking much CPU from the lookups.
+const balloonTouchInterval = 100 * time.Millisecond
+
+// balloon is memory held, and kept resident by touching it, until stopped.
+type balloon struct {
+	mem  []byte
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startBalloon allocates a balloon of size bytes, returning once all of it
+// is resident.
+func startBalloon(size int64) (*balloon, error) {
+	mem, err := allocBalloon(int(size))
+	if err != nil {
+		return nil, err
+	}
+	bl := &balloon{mem: mem, stop: make(chan struct{}), done: make(chan struct{})}
+	bl.touch()
+	go bl.keepTouching()
+	return bl, nil
+}
+
+// touch writes to every page of the balloon.
+func (bl *balloon) touch() {
+	pageSize := os.Getpagesize()
+	for i := 0; i < len(bl.mem); i += pageSize {
+		bl.mem[i]++
+	}
+}
+
+func (bl *balloon) keepTouching() {
+	defer close(bl.done)
+	ticker := time.NewTicker(balloonTouchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bl.stop:
+			return
+		case <-ticker.C:
+			bl.touch()
+		}
+	}
+}
+
+// Close stops touching the balloon and frees it.
+func (bl *balloon) Close() error {
+	close(bl.stop)
+	<-bl.done
+	return freeBalloon(bl.mem)
+}
+
+func BenchmarkBalloonGet(b *testing.B) {
+	if *balloonSizes == "" {
+		b.Skip("no balloons to hold without -balloon")
+	}
+	sizes := strings.Split(*balloonSizes, ",")
+	for i := range sizes {
+		sizes[i] = strings.TrimSpace(sizes[i])
+		parseTunableSize(sizes[i])
+	}
+	loadBenchTables(b)
+
+	for _, be := range sortedBackends() {
+		b.Run(be.name, func(b *testing.B) {
+			be.skipIfUnavailable(b)
+			table := buildTable(b, be.name, be.open, testData)
+			defer table.close()
+			prewarmTable(b, table)
+
+			b.Run("balloon=0", func(b *testing.B) {
+				benchmarkBalloon(b, be.name, table)
+			})
+			for _, size := range sizes {
+				// the balloon is inflated here rather than in
+				// the sub-benchmark, which runs once per b.N
+				// tried.
+				bl, err := startBalloon(parseTunableSize(size))
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.Run("balloon="+size, func(b *testing.B) {
+					benchmarkBalloon(b, be.name, table)
+				})
+				if err := bl.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkBalloon(b *testing.B, name string, table backendTable) {
+	var mu sync.Mutex
+	var latencies []time.Duration
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, name, func(b *testing.PB) {
+		defer pinWorker()()
+		get, release := table.reader()
+		defer release()
+		var local []time.Duration
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			start := time.Now()
+			value, ok := get(entry.Key)
+			local = append(local, time.Since(start))
+			if !entry.matches(value, ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+	reportGetThroughput(b)
+	faults.report(b)
+	p := latencyPercentiles(latencies, 50, 99, 99.9)
+	b.ReportMetric(float64(p[0].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(p[1].Nanoseconds()), "p99-ns")
+	b.ReportMetric(float64(p[2].Nanoseconds()), "p999-ns")
+}
+
+func TestBalloon(t *testing.T) {
+	bl, err := startBalloon(8 << 20)
+	if err != nil {
+		t.Skip(err)
+	}
+	if first, last := bl.mem[0], bl.mem[len(bl.mem)-os.Getpagesize()]; first == 0 || last == 0 {
+		t.Errorf("pages touched %d and %d times; want them touched", first, last)
+	}
+	if err := bl.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
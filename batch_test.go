@@ -0,0 +1,95 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Services that fan a request out into many lookups care about how long a
+// whole batch takes rather than any one get.  BenchmarkBatchGet times
+// batches of keys against every registered backend, using its native
+// multi-get where it has one (see backendTable.newBatchReader):
+//
+//	go test -run XXX -bench BatchGet/bit -batch 16,128,1024
+var batchSizes = flag.String("batch", "16,128,1024", "comma-separated `sizes` of the batches BenchmarkBatchGet looks up")
+
+func parseBatchSizes() ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(*batchSizes, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("bad batch size %q", field)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+func BenchmarkBatchGet(b *testing.B) {
+	sizes, err := parseBatchSizes()
+	if err != nil {
+		b.Fatal(err)
+	}
+	loadBenchTables(b)
+
+	for _, be := range sortedBackends() {
+		b.Run(be.name, func(b *testing.B) {
+			be.skipIfUnavailable(b)
+			table := buildTable(b, be.name, be.open, testData)
+			defer table.close()
+			prewarmTable(b, table)
+
+			for _, k := range sizes {
+				b.Run(fmt.Sprintf("k=%d", k), func(b *testing.B) {
+					b.ReportAllocs()
+					b.ResetTimer()
+					faults := startPageFaults()
+					runParallel(b, be.name, func(b *testing.PB) {
+						defer pinWorker()()
+						batch, release := table.batchReader()
+						defer release()
+						entryCount := len(benchEntries)
+						i := rand.Int() % entryCount
+						entries := make([]benchEntry, k)
+						keys := make([]string, k)
+						var found, present int
+						check := func(j int, value []byte) {
+							if !entries[j].matches(value, true) {
+								panic("bad data or lookup")
+							}
+							found++
+						}
+						for b.Next() {
+							present = 0
+							for j := range keys {
+								entries[j] = benchEntries[i]
+								keys[j] = entries[j].Key
+								if !entries[j].Absent {
+									present++
+								}
+								i = (i + 1) % entryCount
+							}
+							found = 0
+							batch(keys, check)
+							if found != present {
+								panic("bad data or lookup")
+							}
+						}
+					})
+					b.StopTimer()
+					b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*k), "ns/key")
+					reportThroughput(b, b.N, float64(b.N*k)*meanValueSize())
+					faults.report(b)
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bboltBatchSize is the number of entries inserted per write transaction
+// while loading the table.
+const bboltBatchSize = 64 * 1024
+
+var bboltBucket = []byte("bench")
+
+var (
+	benchTableBboltOnce sync.Once
+	benchTableBbolt     *bolt.DB
+)
+
+func init() {
+	registerBackend(backend{
+		name: "bbolt",
+		open: func(path string) backendTable {
+			return newBboltBackendTable(createBboltTable(path))
+		},
+		// Put overwrites, but the builder sorts its input with an
+		// unstable sort first.
+		duplicates:   duplicatesAnyWins,
+		lookupAllocs: 3,
+		openMutable: func(path string) backendTable {
+			db, closeTable := createMutableBboltTable(path)
+			return backendTable{
+				newBytesReader: func() (bytesLookupFunc, func()) {
+					// a transaction reads a snapshot, and holding
+					// one open blocks writers growing the file,
+					// so each lookup gets its own.  Values are only
+					// valid inside it, so copy them out.
+					var buf []byte
+					return func(key []byte) ([]byte, bool) {
+						var ok bool
+						_ = db.View(func(tx *bolt.Tx) error {
+							value := tx.Bucket(bboltBucket).Get(key)
+							buf = append(buf[:0], value...)
+							ok = value != nil
+							return nil
+						})
+						return buf, ok
+					}, noClose
+				},
+				newWriter: sharedWriter(func(key, value []byte) error {
+					return db.Update(func(tx *bolt.Tx) error {
+						return tx.Bucket(bboltBucket).Put(key, value)
+					})
+				}),
+				close: closeTable,
+			}
+		},
+		benchTable: func() backendTable {
+			benchTableBboltOnce.Do(loadBboltBenchTable)
+			return newBboltBackendTable(benchTableBbolt)
+		},
+	})
+}
+
+// newBboltBackendTable returns the backendTable reading db.
+func newBboltBackendTable(db *bolt.DB) backendTable {
+	return backendTable{
+		newBytesReader: func() (bytesLookupFunc, func()) {
+			tx, err := db.Begin(false)
+			if err != nil {
+				panic(err)
+			}
+			bucket := tx.Bucket(bboltBucket)
+			return func(key []byte) ([]byte, bool) {
+				value := bucket.Get(key)
+				return value, value != nil
+			}, func() { _ = tx.Rollback() }
+		},
+		close: func() { _ = db.Close() },
+	}
+}
+
+func loadBboltBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableBbolt = createBboltTable(testData)
+}
+
+func createBboltTable(testDataPath string) *bolt.DB {
+	tableFile, err := newTableFile("bit-test.*.data")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.Remove(tableFile.Name())
+	}()
+	if err = tableFile.Close(); err != nil {
+		panic(err)
+	}
+
+	buildBboltTable(testDataPath, tableFile.Name())
+	table, err := bolt.Open(tableFile.Name(), 0444, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		panic(err)
+	}
+
+	return table
+}
+
+// createMutableBboltTable builds a table and opens it for writing too,
+// returning it and a function closing it and removing its file.
+func createMutableBboltTable(testDataPath string) (*bolt.DB, func()) {
+	tableFile, err := newTableFile("bit-test.*.data")
+	if err != nil {
+		panic(err)
+	}
+	if err = tableFile.Close(); err != nil {
+		panic(err)
+	}
+	buildBboltTable(testDataPath, tableFile.Name())
+	db, err := bolt.Open(tableFile.Name(), 0644, &bolt.Options{NoSync: true, NoFreelistSync: true})
+	if err != nil {
+		_ = os.Remove(tableFile.Name())
+		panic(err)
+	}
+	return db, func() {
+		_ = db.Close()
+		_ = os.Remove(tableFile.Name())
+	}
+}
+
+// buildBboltTable replaces the file at path with a database of the
+// testdata.
+func buildBboltTable(testDataPath, path string) {
+	if err := os.Remove(path); err != nil {
+		panic(err)
+	}
+
+	// inserting in key order with a 100% fill percent packs leaf pages
+	// completely rather than leaving them half-empty after splits.
+	var entries []benchEntry
+	streamTestFile(testDataPath, func(k, v []byte) {
+		entries = append(entries, benchEntry{Key: string(k), Value: string(v)})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{NoSync: true, NoFreelistSync: true})
+	if err != nil {
+		panic(err)
+	}
+	for off := 0; off < len(entries); off += bboltBatchSize {
+		batch := entries[off:]
+		if len(batch) > bboltBatchSize {
+			batch = batch[:bboltBatchSize]
+		}
+		err := db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(bboltBucket)
+			if err != nil {
+				return err
+			}
+			bucket.FillPercent = 1.0
+			for _, entry := range batch {
+				if err := bucket.Put(zerocopy.Bytes(entry.Key), zerocopy.Bytes(entry.Value)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		panic(err)
+	}
+	if err := db.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func BenchmarkBboltGet(b *testing.B) {
+	loadTable(b, "bbolt", &benchTableBboltOnce, loadBboltBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "bbolt", func(b *testing.PB) {
+		defer pinWorker()()
+		tx, err := benchTableBbolt.Begin(false)
+		if err != nil {
+			panic(err)
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+		bucket := tx.Bucket(bboltBucket)
+
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value := bucket.Get(zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, value != nil) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableBboltCreate *bolt.DB
+
+func BenchmarkBboltCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		if benchTableBboltCreate != nil {
+			_ = benchTableBboltCreate.Close()
+		}
+		benchTableBboltCreate = buildTable(b, "bbolt", createBboltTable, testData)
+		if benchTableBboltCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
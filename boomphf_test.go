@@ -0,0 +1,136 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/dgryski/go-boomphf"
+	"github.com/dgryski/go-farm"
+)
+
+var (
+	benchTableBoomphfOnce sync.Once
+	benchTableBoomphf     *boomphfTable
+)
+
+// boomphfTable pairs a BBHash perfect hash over the keys' 64-bit hashes with
+// flat key and value arrays ordered by the hash's slot assignment.
+type boomphfTable struct {
+	h      *boomphf.H
+	keys   []string
+	values []string
+}
+
+func boomphfHash(key string) uint64 {
+	return farm.Hash64(zerocopy.Bytes(key))
+}
+
+func (t *boomphfTable) GetString(key string) (string, bool) {
+	// Query returns 0 for keys it can rule out and slot+1 otherwise, but
+	// keys outside the build set can still land on an occupied slot.
+	i := t.h.Query(boomphfHash(key))
+	if i == 0 || t.keys[i-1] != key {
+		return "", false
+	}
+	return t.values[i-1], true
+}
+
+func init() {
+	registerBackend(backend{
+		name: "boomphf",
+		open: func(path string) backendTable {
+			return backendTable{
+				newReader: sharedReader(stringLookup(createBoomphfTable(path).GetString)),
+				close:     noClose,
+			}
+		},
+		duplicates: duplicatesHang,
+		benchTable: func() backendTable {
+			benchTableBoomphfOnce.Do(loadBoomphfBenchTable)
+			return backendTable{
+				newReader: sharedReader(stringLookup(benchTableBoomphf.GetString)),
+				close:     noClose,
+			}
+		},
+	})
+}
+
+func loadBoomphfBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableBoomphf = createBoomphfTable(testData)
+}
+
+func createBoomphfTable(testDataPath string) *boomphfTable {
+	var keys, values []string
+	streamTestFile(testDataPath, func(k, v []byte) {
+		keys = append(keys, string(k))
+		values = append(values, string(v))
+	})
+
+	hashes := make([]uint64, len(keys))
+	for i, key := range keys {
+		hashes[i] = boomphfHash(key)
+	}
+	// boomphf.New reuses the slice it is passed as scratch space.
+	h := boomphf.New(boomphf.Gamma, append([]uint64(nil), hashes...))
+
+	t := &boomphfTable{
+		h:      h,
+		keys:   make([]string, len(keys)),
+		values: make([]string, len(keys)),
+	}
+	for i, hash := range hashes {
+		slot := h.Query(hash) - 1
+		t.keys[slot] = keys[i]
+		t.values[slot] = values[i]
+	}
+
+	return t
+}
+
+func BenchmarkBoomphfGet(b *testing.B) {
+	loadTable(b, "boomphf", &benchTableBoomphfOnce, loadBoomphfBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "boomphf", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := benchTableBoomphf.GetString(entry.Key)
+			if !entry.matches(zerocopy.Bytes(value), ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableBoomphfCreate *boomphfTable
+
+func BenchmarkBoomphfCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		benchTableBoomphfCreate = buildTable(b, "boomphf", createBoomphfTable, testData)
+		if benchTableBoomphfCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"runtime/metrics"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// buildMemorySampleInterval is how often a buildMemory samples the heap and
+// RSS.  Reading runtime/metrics doesn't stop the world, so this can be
+// frequent enough to catch short spikes without slowing the build down.
+const buildMemorySampleInterval = 5 * time.Millisecond
+
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// buildMemory records the peak Go heap and RSS while tables are built, as
+// growth over what they were when it started, so tables held by earlier
+// benchmarks in the same process aren't counted.  The heap figure only
+// covers Go allocations; the RSS one also includes cgo builders (sparkey,
+// RocksDB, LMDB) and mmapped files.
+type buildMemory struct {
+	baseHeap, baseRSS int64
+	peakHeap, peakRSS atomic.Int64
+	// hwm is whether the kernel's RSS high-water mark was reset, so
+	// that it can stand in for samples that missed a brief peak.
+	hwm  bool
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startBuildMemory() *buildMemory {
+	m := &buildMemory{
+		baseHeap: heapObjectBytes(),
+		baseRSS:  currentRSS(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	// writing 5 to clear_refs resets VmHWM to the current RSS.
+	m.hwm = os.WriteFile("/proc/self/clear_refs", []byte("5"), 0) == nil
+	go m.sample()
+	return m
+}
+
+func (m *buildMemory) sample() {
+	defer close(m.done)
+	ticker := time.NewTicker(buildMemorySampleInterval)
+	defer ticker.Stop()
+	for {
+		if heap := heapObjectBytes(); heap > m.peakHeap.Load() {
+			m.peakHeap.Store(heap)
+		}
+		if rss := currentRSS(); rss > m.peakRSS.Load() {
+			m.peakRSS.Store(rss)
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// report stops sampling and reports the peaks as benchmark metrics.
+func (m *buildMemory) report(b *testing.B) {
+	close(m.stop)
+	<-m.done
+	peakRSS := m.peakRSS.Load()
+	if m.hwm {
+		if hwm := highWaterRSS(); hwm > peakRSS {
+			peakRSS = hwm
+		}
+	}
+	b.ReportMetric(float64(max(m.peakHeap.Load()-m.baseHeap, 0)), "peak-heap-bytes")
+	b.ReportMetric(float64(max(peakRSS-m.baseRSS, 0)), "peak-rss-bytes")
+}
+
+func heapObjectBytes() int64 {
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return int64(sample[0].Value.Uint64())
+}
+
+// highWaterRSS returns the peak resident set size of this process, or 0
+// where that can't be read.
+func highWaterRSS() int64 {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	s := bufio.NewScanner(bytes.NewReader(status))
+	for s.Scan() {
+		line := s.Bytes()
+		if !bytes.HasPrefix(line, []byte("VmHWM:")) {
+			continue
+		}
+		// e.g. "VmHWM:	    1424 kB"
+		fields := bytes.Fields(line[len("VmHWM:"):])
+		if len(fields) != 2 || string(fields[1]) != "kB" {
+			return 0
+		}
+		kb, err := strconv.ParseInt(string(fields[0]), 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb << 10
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+)
+
+// A service that can't trust its store checksums what it puts in and
+// verifies each value it gets back.  Fixtures generated with -checksums
+// end every value in a CRC-32C of the rest of it, and BenchmarkChecksumGet
+// looks up in each backend's table both without and with verifying that,
+// so the difference is the cost of the defensive check:
+//
+//	go test -run XXX -bench ChecksumGet -entries 1000000 -checksums
+//
+// Run for long enough, it's also a check that nothing between the fixture
+// and a lookup -- a builder, the page cache, the disk -- corrupts values.
+
+// valueChecksumLen is the length of the checksum ending a value: 8 hex
+// digits, so that checksummed values stay printable for the text testdata
+// format.
+const valueChecksumLen = 8
+
+var valueChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+const lowerHexDigits = "0123456789abcdef"
+
+// appendValueChecksum returns value ended in its checksum.
+func appendValueChecksum(value []byte) []byte {
+	sum := crc32.Checksum(value, valueChecksumTable)
+	for shift := 28; shift >= 0; shift -= 4 {
+		value = append(value, lowerHexDigits[sum>>shift&0xf])
+	}
+	return value
+}
+
+// validValueChecksum reports whether value ends in the checksum of the rest
+// of it.  It doesn't allocate, so the benchmark measures only the check.
+func validValueChecksum(value []byte) bool {
+	n := len(value) - valueChecksumLen
+	if n < 0 {
+		return false
+	}
+	var want uint32
+	for _, c := range value[n:] {
+		d := strings.IndexByte(lowerHexDigits, c)
+		if d < 0 {
+			return false
+		}
+		want = want<<4 | uint32(d)
+	}
+	return crc32.Checksum(value[:n], valueChecksumTable) == want
+}
+
+// valuesChecksummed reports whether every value in the benchmark table
+// ends in its checksum, as those in fixtures generated with -checksums do.
+var valuesChecksummed = sync.OnceValue(func() bool {
+	benchTableOnce.Do(loadBenchTable)
+	for _, entry := range presentEntries(benchEntries) {
+		if !validValueChecksum(zerocopy.Bytes(entry.Value)) {
+			return false
+		}
+	}
+	return true
+})
+
+func BenchmarkChecksumGet(b *testing.B) {
+	if !valuesChecksummed() {
+		b.Skip("testdata values carry no checksums; generate it with -checksums")
+	}
+
+	for _, be := range sortedBackends() {
+		b.Run(be.name, func(b *testing.B) {
+			be.skipIfUnavailable(b)
+			table := buildTable(b, be.name, be.open, testData)
+			defer table.close()
+			prewarmTable(b, table)
+
+			b.Run("unchecked", func(b *testing.B) {
+				benchmarkChecksum(b, be.name, table, false)
+			})
+			b.Run("crc32c", func(b *testing.B) {
+				benchmarkChecksum(b, be.name, table, true)
+			})
+		})
+	}
+}
+
+// benchmarkChecksum looks up in table, verifying each value found's
+// checksum if verify is set.
+func benchmarkChecksum(b *testing.B, name string, table backendTable, verify bool) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, name, func(b *testing.PB) {
+		defer pinWorker()()
+		get, release := table.reader()
+		defer release()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := get(entry.Key)
+			if verify && ok && !validValueChecksum(value) {
+				panic("corrupt value: bad checksum")
+			}
+			if !entry.matches(value, ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+func TestValueChecksum(t *testing.T) {
+	for _, value := range []string{"", "pref_0123456789abcdef", "\x00\xff"} {
+		summed := appendValueChecksum([]byte(value))
+		if len(summed) != len(value)+valueChecksumLen {
+			t.Errorf("appendValueChecksum(%q) = %q; want %d checksum bytes added", value, summed, valueChecksumLen)
+		}
+		if !validValueChecksum(summed) {
+			t.Errorf("validValueChecksum(%q) = false; want true", summed)
+		}
+		for i := range summed {
+			corrupt := append([]byte(nil), summed...)
+			corrupt[i] ^= 1
+			if validValueChecksum(corrupt) {
+				t.Errorf("validValueChecksum(%q) = true with byte %d flipped; want false", corrupt, i)
+			}
+		}
+	}
+	if validValueChecksum([]byte("short")) {
+		t.Error("validValueChecksum of a value shorter than a checksum = true; want false")
+	}
+}
@@ -0,0 +1,552 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+// Command bit-benchmark drives the benchmark suite, which is all go test
+// benchmarks over a package of _test.go files, without hand-writing -bench
+// regexps:
+//
+//	bit-benchmark gen -entries 10000000 -o testdata.10m
+//	bit-benchmark gen -fetch enwiki-titles -fetch-dump 20211101
+//	bit-benchmark run -backends bit,cdb -workloads get,create -count 10 -o new.txt
+//	bit-benchmark report old.txt new.txt
+//	bit-benchmark history -versions v0.1.0,v0.2.0,master -backends bit
+//
+// It runs go test in the current directory, which must be in the
+// bit-benchmark module; flags after -- in run and history are passed to the
+// test binary as they are (like -testdata or -tabledir).
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/mod/semver"
+	"golang.org/x/perf/benchfmt"
+	"golang.org/x/perf/benchmath"
+)
+
+const pkg = "github.com/bpowers/bit-benchmark"
+
+var commands = map[string]func(args []string) error{
+	"gen":     gen,
+	"run":     run,
+	"report":  report,
+	"history": history,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: bit-benchmark gen|run|report|history [flags]\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := cmd(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "bit-benchmark %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// goTest runs go test over the suite with args, writing its output to
+// stdout.
+func goTest(tags string, args []string, stdout io.Writer) error {
+	return goTestModfile("", tags, args, stdout)
+}
+
+// goTestModfile is goTest building with the go.mod at modfile, if it's
+// set, instead of the module's own.
+func goTestModfile(modfile, tags string, args []string, stdout io.Writer) error {
+	goArgs := []string{"test"}
+	if modfile != "" {
+		goArgs = append(goArgs, "-modfile", modfile)
+	}
+	if tags != "" {
+		goArgs = append(goArgs, "-tags", tags)
+	}
+	goArgs = append(goArgs, pkg)
+	goArgs = append(goArgs, args...)
+	cmd := exec.Command("go", goArgs...)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func gen(args []string) error {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	entries := fs.Int("entries", 1000000, "generate a fixture of this many `entries`")
+	keys := fs.String("keys", "hex", "generate keys of this `shape`: hex, binary, unicode or url")
+	checksums := fs.Bool("checksums", false, "end each generated value in a checksum, for the checksum workload")
+	out := fs.String("o", "testdata.generated", "write the generated fixture to `path`")
+	fetch := fs.String("fetch", "", "instead fetch these comma-separated `datasets` from a Wikipedia dump, writing testdata.<name>")
+	dump := fs.String("fetch-dump", "", "`date` of the Wikipedia dump to fetch from")
+	limit := fs.Int("fetch-limit", 0, "maximum number of entries to keep per fetched dataset (0 for all)")
+	tags := fs.String("tags", "", "build `tags` for the test binary")
+	_ = fs.Parse(args)
+
+	if *fetch != "" {
+		if *dump == "" {
+			return fmt.Errorf("-fetch needs -fetch-dump")
+		}
+		return goTest(*tags, []string{"-run", "^TestFetch$", "-timeout", "0", "-v",
+			"-fetch", *fetch, "-fetch-dump", *dump, "-fetch-limit", fmt.Sprint(*limit)}, os.Stdout)
+	}
+	return goTest(*tags, []string{"-run", "^TestGenerate$", "-timeout", "0",
+		"-generate", *out, "-entries", fmt.Sprint(*entries), "-keys", *keys, "-checksums=" + fmt.Sprint(*checksums)}, os.Stdout)
+}
+
+// registryWorkloads are the benchmarks run over every registered backend,
+// which take -backends themselves.
+var registryWorkloads = map[string]string{
+	"balloon":  "BenchmarkBalloonGet",
+	"batch":    "BenchmarkBatchGet",
+	"checksum": "BenchmarkChecksumGet",
+	"decode":   "BenchmarkDecodeGet",
+	"write":    "BenchmarkWrite",
+	"http":     "BenchmarkHTTPGet",
+	"keytype":  "BenchmarkKeyTypeGet",
+	"madvise":  "BenchmarkMadviseGet",
+	"mixed":    "BenchmarkMixed",
+	"sweep":    "BenchmarkSweepGet",
+	"order":    "BenchmarkProbeOrderGet",
+	"ycsb":     "BenchmarkYCSB",
+}
+
+// listBenchmarks returns the names of the suite's benchmarks.
+func listBenchmarks(tags string) ([]string, error) {
+	var out strings.Builder
+	if err := goTest(tags, []string{"-list", "^Benchmark"}, &out); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "Benchmark") {
+			names = append(names, line)
+		}
+	}
+	return names, nil
+}
+
+// benchmarkVariants are, by backend, the variants its get and create
+// benchmarks come in, for the backends with more than one of each.
+var benchmarkVariants = map[string]string{
+	"sparkey": "Uncompressed|Snappy",
+}
+
+// selectBenchmarks returns the benchmarks of all that run workloads over
+// backends, or over every backend if there are none.  The get and create
+// workloads are a Benchmark<Backend>Get and Benchmark<Backend>Create per
+// backend (or per variant of it: see benchmarkVariants), so they're matched
+// on the backend's name, minus any dashes.  The whole name, so that
+// sparkey's don't take in sparkeygo's.
+func selectBenchmarks(all, backends, workloads []string) ([]string, error) {
+	get, create := `.+?Get`, `.+?Create\w*`
+	if len(backends) > 0 {
+		gets := make([]string, len(backends))
+		creates := make([]string, len(backends))
+		for i, b := range backends {
+			name := regexp.QuoteMeta(strings.ReplaceAll(b, "-", ""))
+			variant := ""
+			if v, ok := benchmarkVariants[b]; ok {
+				variant = "(?:" + v + ")?"
+			}
+			gets[i] = name + variant + "Get"
+			creates[i] = name + "Create" + variant
+		}
+		get = "(?:" + strings.Join(gets, "|") + ")"
+		create = "(?:" + strings.Join(creates, "|") + ")"
+	}
+	families := make(map[string]bool)
+	for _, name := range registryWorkloads {
+		families[name] = true
+	}
+	var selected []string
+	for _, w := range workloads {
+		var re *regexp.Regexp
+		switch w {
+		case "get":
+			re = regexp.MustCompile(`(?i)^Benchmark` + get + `$`)
+		case "create":
+			re = regexp.MustCompile(`(?i)^Benchmark` + create + `$`)
+		default:
+			name, ok := registryWorkloads[w]
+			if !ok {
+				return nil, fmt.Errorf("unknown workload %q", w)
+			}
+			selected = append(selected, name)
+			continue
+		}
+		for _, name := range all {
+			if re.MatchString(name) && !families[name] {
+				selected = append(selected, name)
+			}
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no benchmarks run %s over %s", strings.Join(workloads, ","), strings.Join(backends, ","))
+	}
+	return selected, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	backends := fs.String("backends", "", "comma-separated `backends` to benchmark (default all)")
+	workloads := fs.String("workloads", "get", "comma-separated `workloads` to run: get, create, balloon, batch, checksum, decode, http, keytype, madvise, mixed, order, sweep, write, ycsb")
+	tags := fs.String("tags", "", "build `tags` for the test binary, like sparkey")
+	count := fs.Int("count", 1, "run each benchmark `n` times")
+	benchtime := fs.String("benchtime", "", "go test -benchtime")
+	cpu := fs.String("cpu", "", "go test -cpu")
+	out := fs.String("o", "", "also write the benchmark output to `file`, for report")
+	_ = fs.Parse(args)
+
+	backendList := splitList(*backends)
+	all, err := listBenchmarks(*tags)
+	if err != nil {
+		return err
+	}
+	selected, err := selectBenchmarks(all, backendList, splitList(*workloads))
+	if err != nil {
+		return err
+	}
+	testArgs := benchArgs(selected, backendList, *count, *benchtime, *cpu, fs.Args())
+
+	var stdout io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stdout = io.MultiWriter(os.Stdout, f)
+	}
+	return goTest(*tags, testArgs, stdout)
+}
+
+// benchArgs returns the go test arguments running the selected
+// benchmarks, passing -backends and then extra through to the test binary.
+func benchArgs(selected, backends []string, count int, benchtime, cpu string, extra []string) []string {
+	re := "^(?:" + strings.Join(selected, "|") + ")$"
+	args := []string{"-run", "^$", "-bench", re, "-timeout", "0", "-count", fmt.Sprint(count)}
+	if benchtime != "" {
+		args = append(args, "-benchtime", benchtime)
+	}
+	if cpu != "" {
+		args = append(args, "-cpu", cpu)
+	}
+	if len(backends) > 0 {
+		args = append(args, "-args", "-backends", strings.Join(backends, ","))
+	} else if len(extra) > 0 {
+		args = append(args, "-args")
+	}
+	return append(args, extra...)
+}
+
+// bitModule is the module history benchmarks versions of.
+const bitModule = "github.com/bpowers/bit"
+
+// history benchmarks each of a list of versions of bit in turn, keeping
+// the results of each in its own file in a directory, and then reports on
+// every version there, oldest first.  A version is anything go get takes:
+// a tag, a commit or a branch.  They're pinned in a copy of the module's
+// go.mod, so the module itself is left as it is.
+func history(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	versions := fs.String("versions", "", "comma-separated bit `versions` to benchmark (default none, only report)")
+	dir := fs.String("dir", "history", "keep each version's results in `dir`/<version>.txt")
+	backends := fs.String("backends", "bit", "comma-separated `backends` to benchmark")
+	workloads := fs.String("workloads", "get", "comma-separated `workloads` to run, as for run")
+	tags := fs.String("tags", "", "build `tags` for the test binary")
+	// a handful of samples per version is the least report can tell a
+	// real change from noise with.
+	count := fs.Int("count", 5, "run each benchmark `n` times")
+	benchtime := fs.String("benchtime", "", "go test -benchtime")
+	cpu := fs.String("cpu", "", "go test -cpu")
+	units := fs.String("unit", "ns/op,ops/s,value-bytes/s", "comma-separated `units` to report")
+	alpha := fs.Float64("alpha", 0.05, "significance level for the deltas")
+	_ = fs.Parse(args)
+
+	var errs []error
+	if versionList := splitList(*versions); len(versionList) > 0 {
+		backendList := splitList(*backends)
+		all, err := listBenchmarks(*tags)
+		if err != nil {
+			return err
+		}
+		selected, err := selectBenchmarks(all, backendList, splitList(*workloads))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(*dir, 0o755); err != nil {
+			return err
+		}
+		testArgs := benchArgs(selected, backendList, *count, *benchtime, *cpu, fs.Args())
+		// one version failing to build or run, say because it predates
+		// an API the suite uses, shouldn't lose the others.
+		for _, version := range versionList {
+			if err := benchmarkVersion(*dir, version, *tags, testArgs); err != nil {
+				errs = append(errs, fmt.Errorf("bit@%s: %w", version, err))
+			}
+		}
+	}
+
+	paths, err := historyResults(*dir)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	if len(paths) == 0 {
+		return errors.Join(append(errs, fmt.Errorf("no results in %s", *dir))...)
+	}
+	if err := writeReport(os.Stdout, paths, splitList(*units), *alpha); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// benchmarkVersion runs go test with testArgs against version of bit,
+// writing the results to dir/<version>.txt, named for the version go get
+// resolves it to.
+func benchmarkVersion(dir, version, tags string, testArgs []string) error {
+	tmp, err := os.MkdirTemp("", "bit-benchmark-history.*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	modfile, resolved, err := pinBit(tmp, version)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, resolved+".txt")
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	// benchfmt keeps "key: value" lines as configuration, so the
+	// results say which version they're of wherever they end up.
+	if _, err := fmt.Fprintf(f, "bit-version: %s\n", resolved); err != nil {
+		return err
+	}
+	if err := goTestModfile(modfile, tags, testArgs, io.MultiWriter(os.Stdout, f)); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// pinBit writes a copy of the module's go.mod and go.sum to dir, with bit
+// at version, returning the copy's path and the version go get resolved.
+func pinBit(dir, version string) (modfile, resolved string, err error) {
+	out, err := exec.Command("go", "env", "GOMOD").Output()
+	if err != nil {
+		return "", "", err
+	}
+	gomod := strings.TrimSpace(string(out))
+	if gomod == "" || gomod == os.DevNull {
+		return "", "", fmt.Errorf("not in the bit-benchmark module")
+	}
+	modfile = filepath.Join(dir, "go.mod")
+	for src, dst := range map[string]string{gomod: modfile, strings.TrimSuffix(gomod, ".mod") + ".sum": filepath.Join(dir, "go.sum")} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return "", "", err
+		}
+		if err := os.WriteFile(dst, data, 0o644); err != nil {
+			return "", "", err
+		}
+	}
+
+	get := exec.Command("go", "get", "-modfile", modfile, bitModule+"@"+version)
+	get.Stderr = os.Stderr
+	if err := get.Run(); err != nil {
+		return "", "", fmt.Errorf("go get: %w", err)
+	}
+	out, err = exec.Command("go", "list", "-modfile", modfile, "-m", "-f", "{{.Version}}", bitModule).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("go list: %w", err)
+	}
+	return modfile, strings.TrimSpace(string(out)), nil
+}
+
+// historyResults returns the results files in dir, oldest version first.
+func historyResults(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return compareVersions(versionOf(paths[i]), versionOf(paths[j])) < 0
+	})
+	return paths, nil
+}
+
+// versionOf returns the version of bit the results file at path is of.
+func versionOf(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".txt")
+}
+
+// compareVersions orders module versions by semver, which puts
+// pseudo-versions in commit order, and anything else after them by name.
+func compareVersions(a, b string) int {
+	switch va, vb := semver.IsValid(a), semver.IsValid(b); {
+	case va && vb:
+		return semver.Compare(a, b)
+	case va != vb:
+		if va {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// readSamples returns the unit measurements of each benchmark in the
+// results file path, by full name.
+func readSamples(path, unit string, thresholds *benchmath.Thresholds) (map[string]*benchmath.Sample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string][]float64)
+	r := benchfmt.NewReader(f, path)
+	for r.Scan() {
+		res, ok := r.Result().(*benchfmt.Result)
+		if !ok {
+			continue
+		}
+		// the reader normalizes units, so ns/op comes back as sec/op.
+		name := string(res.Name.Full())
+		for _, v := range res.Values {
+			if v.OrigUnit == unit {
+				values[name] = append(values[name], v.OrigValue)
+			} else if v.Unit == unit {
+				values[name] = append(values[name], v.Value)
+			}
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	samples := make(map[string]*benchmath.Sample, len(values))
+	for name, vs := range values {
+		samples[name] = benchmath.NewSample(vs, thresholds)
+	}
+	return samples, nil
+}
+
+func report(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	units := fs.String("unit", "ns/op,ops/s,value-bytes/s", "comma-separated `units` to compare, like B/op or peak-rss-bytes")
+	alpha := fs.Float64("alpha", 0.05, "significance level for the deltas")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no results files")
+	}
+	return writeReport(os.Stdout, fs.Args(), splitList(*units), *alpha)
+}
+
+// writeReport writes a table for each of units that the files have
+// results in, of each benchmark's unit in each file, with the change from
+// the first file.
+func writeReport(w io.Writer, paths []string, units []string, alpha float64) error {
+	sep := ""
+	for _, unit := range units {
+		var table strings.Builder
+		wrote, err := writeUnitReport(&table, paths, unit, alpha)
+		if err != nil {
+			return err
+		}
+		if wrote {
+			fmt.Fprint(w, sep, table.String())
+			sep = "\n"
+		}
+	}
+	return nil
+}
+
+func writeUnitReport(w io.Writer, paths []string, unit string, alpha float64) (bool, error) {
+	thresholds := benchmath.DefaultThresholds
+	thresholds.CompareAlpha = alpha
+	files := make([]map[string]*benchmath.Sample, len(paths))
+	seen := make(map[string]bool)
+	var names []string
+	for i, path := range paths {
+		var err error
+		if files[i], err = readSamples(path, unit, &thresholds); err != nil {
+			return false, err
+		}
+		for name := range files[i] {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return false, nil
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	header := []string{unit, paths[0]}
+	for _, path := range paths[1:] {
+		header = append(header, path, "delta")
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t")+"\t")
+	for _, name := range names {
+		row := []string{name}
+		base := files[0][name]
+		row = append(row, summary(base))
+		for _, file := range files[1:] {
+			s := file[name]
+			row = append(row, summary(s))
+			if base == nil || s == nil {
+				row = append(row, "")
+				continue
+			}
+			row = append(row, benchmath.AssumeNothing.Compare(base, s).FormatDelta(
+				benchmath.AssumeNothing.Summary(base, 0.95).Center,
+				benchmath.AssumeNothing.Summary(s, 0.95).Center))
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t")+"\t")
+	}
+	return true, tw.Flush()
+}
+
+func summary(s *benchmath.Sample) string {
+	if s == nil {
+		return "-"
+	}
+	sum := benchmath.AssumeNothing.Summary(s, 0.95)
+	return fmt.Sprintf("%.4g %s", sum.Center, sum.PctRangeString())
+}
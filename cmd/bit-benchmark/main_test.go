@@ -0,0 +1,155 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSelectBenchmarks(t *testing.T) {
+	all := []string{
+		"BenchmarkBatchGet", "BenchmarkBitCreate", "BenchmarkBitGet", "BenchmarkCdbGet",
+		"BenchmarkMapGet", "BenchmarkMapGetSerial", "BenchmarkPreadDirectGet",
+		"BenchmarkSparkeyCreateSnappy", "BenchmarkSparkeyGoGet", "BenchmarkSparkeySnappyGet",
+		"BenchmarkSparkeyUncompressedGet",
+	}
+	for _, tt := range []struct {
+		backends, workloads string
+		want                []string
+	}{
+		{"", "get", []string{"BenchmarkBitGet", "BenchmarkCdbGet", "BenchmarkMapGet", "BenchmarkPreadDirectGet", "BenchmarkSparkeyGoGet", "BenchmarkSparkeySnappyGet", "BenchmarkSparkeyUncompressedGet"}},
+		{"bit,pread-direct", "get,create", []string{"BenchmarkBitGet", "BenchmarkPreadDirectGet", "BenchmarkBitCreate"}},
+		{"sparkey", "create,batch", []string{"BenchmarkSparkeyCreateSnappy", "BenchmarkBatchGet"}},
+		{"sparkey", "get", []string{"BenchmarkSparkeySnappyGet", "BenchmarkSparkeyUncompressedGet"}},
+		{"sparkeygo", "get", []string{"BenchmarkSparkeyGoGet"}},
+		{"map", "get", []string{"BenchmarkMapGet"}},
+	} {
+		got, err := selectBenchmarks(all, splitList(tt.backends), splitList(tt.workloads))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-backends %q -workloads %q: got %q; want %q", tt.backends, tt.workloads, got, tt.want)
+		}
+	}
+	if _, err := selectBenchmarks(all, nil, []string{"scan"}); err == nil {
+		t.Error("expected an error for an unknown workload")
+	}
+	if _, err := selectBenchmarks(all, []string{"lmdb"}, []string{"get"}); err == nil {
+		t.Error("expected an error selecting no benchmarks")
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "old.txt")
+	new := filepath.Join(dir, "new.txt")
+	var oldText, newText strings.Builder
+	oldText.WriteString("goos: linux\n")
+	for i := 0; i < 6; i++ {
+		oldText.WriteString("BenchmarkBitGet-8   1000000   100 ns/op   10000000 ops/s\n")
+		newText.WriteString("BenchmarkBitGet-8   1000000   50 ns/op   20000000 ops/s\n")
+	}
+	if err := os.WriteFile(old, []byte(oldText.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(new, []byte(newText.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	// there are no B/op results, so no table for them.
+	if err := writeReport(&out, []string{old, new}, []string{"ns/op", "B/op", "ops/s"}, 0.05); err != nil {
+		t.Fatal(err)
+	}
+	tables := strings.Split(strings.TrimSpace(out.String()), "\n\n")
+	if len(tables) != 2 {
+		t.Fatalf("got %d tables; want ns/op and ops/s:\n%s", len(tables), out.String())
+	}
+	for i, want := range []string{"-50.00%", "+100.00%"} {
+		lines := strings.Split(tables[i], "\n")
+		if len(lines) != 2 {
+			t.Fatalf("got %d lines; want a header and one row:\n%s", len(lines), tables[i])
+		}
+		if fields := strings.Fields(lines[1]); fields[0] != "BitGet-8" || fields[len(fields)-1] != want {
+			t.Errorf("got row %q; want BitGet-8 ... %s", lines[1], want)
+		}
+	}
+}
+
+func TestHistoryResults(t *testing.T) {
+	dir := t.TempDir()
+	// in the order they should come back: releases and pseudo-versions by
+	// semver, then whatever else by name.
+	want := []string{
+		"v0.0.0-20211108065132-2fd689ee9671",
+		"v0.1.0",
+		"v0.1.1-0.20220101000000-abcdefabcdef",
+		"v0.2.0",
+		"v0.10.0",
+		"local",
+	}
+	for _, i := range []int{3, 0, 5, 1, 4, 2} {
+		if err := os.WriteFile(filepath.Join(dir, want[i]+".txt"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a run still in progress isn't a result yet.
+	if err := os.WriteFile(filepath.Join(dir, "v0.3.0.txt.tmp"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := historyResults(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, path := range paths {
+		got = append(got, versionOf(path))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestPinBit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go get")
+	}
+	gomod, err := os.ReadFile("../../go.mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the version the module already requires is in the module cache, so
+	// pinning it doesn't need the network.
+	m := regexp.MustCompile(`(?m)^\s*` + regexp.QuoteMeta(bitModule) + ` (\S+)$`).FindSubmatch(gomod)
+	if m == nil {
+		t.Fatalf("go.mod doesn't require %s", bitModule)
+	}
+	version := string(m[1])
+
+	modfile, resolved, err := pinBit(t.TempDir(), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved != version {
+		t.Errorf("resolved %s; want %s", resolved, version)
+	}
+	if pinned, err := os.ReadFile(modfile); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(string(pinned), bitModule+" "+version) {
+		t.Errorf("pinned go.mod doesn't require %s %s:\n%s", bitModule, version, pinned)
+	}
+	if after, err := os.ReadFile("../../go.mod"); err != nil {
+		t.Fatal(err)
+	} else if string(after) != string(gomod) {
+		t.Error("pinning changed the module's own go.mod")
+	}
+}
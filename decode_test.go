@@ -0,0 +1,368 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/dgryski/go-farm"
+	flatbuffers "github.com/google/flatbuffers/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Applications rarely store raw strings: values are serialized records,
+// and every lookup is followed by decoding one.  BenchmarkDecodeGet stores
+// each testdata entry as a record, serialized as a protobuf message or a
+// flatbuffer, in every registered backend, and times a lookup plus a
+// decode:
+//
+//   - proto decodes into a struct whose fields are copies, as generated
+//     protobuf code does;
+//   - proto-alias decodes into one whose fields alias the looked-up value,
+//     which is only safe when the backend hands back memory that outlives
+//     the lookup, like a mmapped table's;
+//   - flatbuffers reads the fields in place, with no decode at all.
+//
+// Backends that copy values out pay for it in each, so the gap between
+// them and the zero-copy backends shows what serving records really costs.
+//
+//	go test -run XXX -bench DecodeGet -backends bit,cdb,pebble
+
+// record is what BenchmarkDecodeGet stores under each key: the testdata
+// entry's value as the payload, and some fixed-size fields around it.
+type record struct {
+	ID      uint64
+	Version uint32
+	Key     []byte
+	Payload []byte
+}
+
+func newRecord(key, value []byte) record {
+	return record{ID: farm.Hash64(key), Version: uint32(len(value)), Key: key, Payload: value}
+}
+
+// Records are encoded as protobuf messages of type:
+//
+//	message Record {
+//	  uint64 id = 1;
+//	  uint32 version = 2;
+//	  bytes key = 3;
+//	  bytes payload = 4;
+//	}
+const (
+	recordIDField protowire.Number = iota + 1
+	recordVersionField
+	recordKeyField
+	recordPayloadField
+)
+
+func appendRecordProto(b []byte, r record) []byte {
+	b = protowire.AppendTag(b, recordIDField, protowire.VarintType)
+	b = protowire.AppendVarint(b, r.ID)
+	b = protowire.AppendTag(b, recordVersionField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(r.Version))
+	b = protowire.AppendTag(b, recordKeyField, protowire.BytesType)
+	b = protowire.AppendBytes(b, r.Key)
+	b = protowire.AppendTag(b, recordPayloadField, protowire.BytesType)
+	b = protowire.AppendBytes(b, r.Payload)
+	return b
+}
+
+var errBadRecord = errors.New("malformed record")
+
+// decodeRecordProto decodes a Record message into r.  If alias is set, r's
+// byte fields point into b rather than being copies.
+func decodeRecordProto(b []byte, r *record, alias bool) error {
+	*r = record{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errBadRecord
+		}
+		b = b[n:]
+		switch {
+		case num == recordIDField && typ == protowire.VarintType:
+			r.ID, n = protowire.ConsumeVarint(b)
+		case num == recordVersionField && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			r.Version = uint32(v)
+		case (num == recordKeyField || num == recordPayloadField) && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if !alias {
+				v = append([]byte(nil), v...)
+			}
+			if num == recordKeyField {
+				r.Key = v
+			} else {
+				r.Payload = v
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errBadRecord
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// recordFlatbuffer is a record encoded as a flatbuffer of the table
+//
+//	table Record {
+//	  id: ulong;
+//	  version: uint;
+//	  key: [ubyte];
+//	  payload: [ubyte];
+//	}
+//
+// with the accessors flatc would generate for it.
+type recordFlatbuffer struct {
+	tab flatbuffers.Table
+}
+
+func buildRecordFlatbuffer(b *flatbuffers.Builder, r record) []byte {
+	b.Reset()
+	key := b.CreateByteVector(r.Key)
+	payload := b.CreateByteVector(r.Payload)
+	b.StartObject(4)
+	b.PrependUint64Slot(0, r.ID, 0)
+	b.PrependUint32Slot(1, r.Version, 0)
+	b.PrependUOffsetTSlot(2, key, 0)
+	b.PrependUOffsetTSlot(3, payload, 0)
+	b.Finish(b.EndObject())
+	return b.FinishedBytes()
+}
+
+func getRootAsRecordFlatbuffer(buf []byte) (recordFlatbuffer, error) {
+	if len(buf) < flatbuffers.SizeUOffsetT {
+		return recordFlatbuffer{}, errBadRecord
+	}
+	n := flatbuffers.GetUOffsetT(buf)
+	if int(n) >= len(buf) {
+		return recordFlatbuffer{}, errBadRecord
+	}
+	return recordFlatbuffer{tab: flatbuffers.Table{Bytes: buf, Pos: n}}, nil
+}
+
+func (r recordFlatbuffer) field(slot int) flatbuffers.UOffsetT {
+	return flatbuffers.UOffsetT(r.tab.Offset(flatbuffers.VOffsetT(4 + 2*slot)))
+}
+
+func (r recordFlatbuffer) ID() uint64 {
+	if o := r.field(0); o != 0 {
+		return r.tab.GetUint64(o + r.tab.Pos)
+	}
+	return 0
+}
+
+func (r recordFlatbuffer) Version() uint32 {
+	if o := r.field(1); o != 0 {
+		return r.tab.GetUint32(o + r.tab.Pos)
+	}
+	return 0
+}
+
+func (r recordFlatbuffer) Key() []byte {
+	if o := r.field(2); o != 0 {
+		return r.tab.ByteVector(o + r.tab.Pos)
+	}
+	return nil
+}
+
+func (r recordFlatbuffer) Payload() []byte {
+	if o := r.field(3); o != 0 {
+		return r.tab.ByteVector(o + r.tab.Pos)
+	}
+	return nil
+}
+
+// recordFormat is a serialization BenchmarkDecodeGet stores records in,
+// and the ways of decoding it that it compares.
+type recordFormat struct {
+	name     string
+	encode   func(r record) []byte
+	decoders []recordDecoder
+}
+
+// recordDecoder is a way of decoding a recordFormat.  newCheck returns a
+// function, for the use of a single goroutine, decoding the record in value
+// and reporting whether it's what newRecord returns for entry.
+type recordDecoder struct {
+	name     string
+	newCheck func() func(value []byte, entry benchEntry) bool
+}
+
+func checkRecord(id uint64, version uint32, key, payload []byte, entry benchEntry) bool {
+	return id == farm.Hash64(zerocopy.Bytes(entry.Key)) && version == uint32(len(entry.Value)) &&
+		string(key) == entry.Key && string(payload) == entry.Value
+}
+
+func checkProto(alias bool) func() func(value []byte, entry benchEntry) bool {
+	return func() func(value []byte, entry benchEntry) bool {
+		var r record
+		return func(value []byte, entry benchEntry) bool {
+			if err := decodeRecordProto(value, &r, alias); err != nil {
+				return false
+			}
+			return checkRecord(r.ID, r.Version, r.Key, r.Payload, entry)
+		}
+	}
+}
+
+func checkFlatbuffer() func(value []byte, entry benchEntry) bool {
+	return func(value []byte, entry benchEntry) bool {
+		r, err := getRootAsRecordFlatbuffer(value)
+		if err != nil {
+			return false
+		}
+		return checkRecord(r.ID(), r.Version(), r.Key(), r.Payload(), entry)
+	}
+}
+
+var recordFormats = []recordFormat{
+	{
+		name:   "proto",
+		encode: func(r record) []byte { return appendRecordProto(nil, r) },
+		decoders: []recordDecoder{
+			{name: "proto", newCheck: checkProto(false)},
+			{name: "proto-alias", newCheck: checkProto(true)},
+		},
+	},
+	{
+		name: "flatbuffers",
+		encode: func(r record) []byte {
+			b := flatbuffers.NewBuilder(len(r.Key) + len(r.Payload) + 64)
+			return buildRecordFlatbuffer(b, r)
+		},
+		decoders: []recordDecoder{
+			{name: "flatbuffers", newCheck: checkFlatbuffer},
+		},
+	},
+}
+
+// writeRecordTestData writes the entries of the testdata at path to a
+// binary-format testdata file in tableDir, each value replaced by its
+// record in format, and returns the new file's path.
+func writeRecordTestData(path string, format recordFormat) (string, error) {
+	f, err := os.CreateTemp(tableDir, "bit-test.*."+format.name+".testdata")
+	if err != nil {
+		return "", err
+	}
+	_ = f.Close()
+	w, err := newBinaryTestDataWriter(f.Name())
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	streamTestFile(path, func(k, v []byte) {
+		if err == nil {
+			err = w.Put(k, format.encode(newRecord(k, v)))
+		}
+	})
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func BenchmarkDecodeGet(b *testing.B) {
+	loadBenchTables(b)
+
+	paths := make(map[string]string)
+	for _, format := range recordFormats {
+		path, err := writeRecordTestData(testData, format)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer func() {
+			_ = os.Remove(path)
+		}()
+		paths[format.name] = path
+	}
+
+	for _, be := range sortedBackends() {
+		b.Run(be.name, func(b *testing.B) {
+			be.skipIfUnavailable(b)
+			for _, format := range recordFormats {
+				table := buildTable(b, be.name, be.open, paths[format.name])
+				prewarmTable(b, table)
+				for _, d := range format.decoders {
+					b.Run(d.name, func(b *testing.B) {
+						b.ReportAllocs()
+						b.ResetTimer()
+						faults := startPageFaults()
+						runParallel(b, be.name, func(b *testing.PB) {
+							defer pinWorker()()
+							get, release := table.reader()
+							defer release()
+							check := d.newCheck()
+
+							entryCount := len(benchEntries)
+							i := rand.Int() % entryCount
+							for b.Next() {
+								entry := benchEntries[i]
+								value, ok := get(entry.Key)
+								if ok == entry.Absent || (ok && !check(value, entry)) {
+									panic("bad data or lookup")
+								}
+								i = (i + 1) % entryCount
+							}
+						})
+						// counting the payloads, the values
+						// the application is after.
+						reportGetThroughput(b)
+						faults.report(b)
+					})
+				}
+				table.close()
+			}
+		})
+	}
+}
+
+func TestRecordFormats(t *testing.T) {
+	entry := benchEntry{Key: "\x00key:\n", Value: "a value"}
+	r := newRecord([]byte(entry.Key), []byte(entry.Value))
+	for _, format := range recordFormats {
+		value := format.encode(r)
+		for _, d := range format.decoders {
+			if !d.newCheck()(value, entry) {
+				t.Errorf("%s: %s doesn't decode its own encoding of %+v", format.name, d.name, r)
+			}
+		}
+	}
+
+	value := recordFormats[0].encode(r)
+	if err := decodeRecordProto(value[:len(value)-1], new(record), false); err == nil {
+		t.Error("decoded a truncated proto record")
+	}
+	// the payload is the last field, so changing the record's last byte
+	// changes an aliasing decode's payload but not a copying one's.
+	var copied, aliased record
+	if err := decodeRecordProto(value, &copied, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := decodeRecordProto(value, &aliased, true); err != nil {
+		t.Fatal(err)
+	}
+	value[len(value)-1] ^= 0xff
+	if string(copied.Payload) != entry.Value {
+		t.Error("proto payload aliases the encoded record")
+	}
+	if string(aliased.Payload) == entry.Value {
+		t.Error("proto-alias payload doesn't alias the encoded record")
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dgryski/go-farm"
+)
+
+// Uniformly random synthetic keys flatter hash functions and give prefix-
+// compressing structures nothing to work with, so TestFetch can build
+// fixtures from real keys taken from an English Wikipedia database dump:
+//
+//	go test -run TestFetch -timeout 0 -fetch enwiki-titles,enwiki-urls -fetch-dump 20211101
+//
+// Each dataset is written to testdata.<name> in the binary testdata format
+// (real keys contain ':'), alongside a testdata.<name>.sha256 so copies on
+// different machines can be compared.  Downloads are verified against the
+// SHA-1 sums Wikimedia publishes with each dump.
+var (
+	fetchDatasetNames = flag.String("fetch", "", "comma-separated `datasets` for TestFetch to download (enwiki-titles, enwiki-urls)")
+	fetchDump         = flag.String("fetch-dump", "", "`date` of the Wikipedia dump to fetch from, as listed at https://dumps.wikimedia.org/enwiki/")
+	fetchMirror       = flag.String("fetch-mirror", "https://dumps.wikimedia.org/enwiki/", "base `URL` of the Wikipedia dump mirror to fetch from")
+	fetchLimit        = flag.Int("fetch-limit", 0, "maximum number of entries to keep per dataset (0 for all)")
+)
+
+// fetchDataset describes how to turn the rows of one table in a MediaWiki
+// SQL dump into key/value pairs.
+type fetchDataset struct {
+	file  string // dump file, minus the "enwiki-<date>-" prefix
+	table string
+	entry func(row []string) (key, value string, ok bool)
+}
+
+var fetchDatasets = map[string]fetchDataset{
+	// article titles to page IDs.
+	"enwiki-titles": {
+		file:  "page.sql.gz",
+		table: "page",
+		entry: func(row []string) (string, string, bool) {
+			// page_id, page_namespace, page_title, ...
+			if len(row) < 3 || row[1] != "0" {
+				return "", "", false
+			}
+			return row[2], row[0], true
+		},
+	},
+	// external link URLs to the ID of (the first) page linking to them.
+	"enwiki-urls": {
+		file:  "externallinks.sql.gz",
+		table: "externallinks",
+		entry: func(row []string) (string, string, bool) {
+			switch len(row) {
+			case 4:
+				// el_id, el_from, el_to_domain_index, el_to_path
+				url, ok := unreverseDomainIndex(row[2])
+				if !ok {
+					return "", "", false
+				}
+				return url + row[3], row[1], true
+			case 5:
+				// el_id, el_from, el_to, el_index, el_index_60
+				return row[2], row[1], true
+			}
+			return "", "", false
+		},
+	},
+}
+
+// unreverseDomainIndex turns a MediaWiki 1.41+ el_to_domain_index, like
+// "https://org.wikipedia.en.", back into the URL prefix it was derived from
+// ("https://en.wikipedia.org").
+func unreverseDomainIndex(index string) (string, bool) {
+	scheme, host, ok := strings.Cut(index, "://")
+	if !ok {
+		return "", false
+	}
+	host, port, _ := strings.Cut(host, ":")
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	url := scheme + "://" + strings.Join(labels, ".")
+	if port != "" {
+		url += ":" + strings.TrimSuffix(port, ".")
+	}
+	return url, true
+}
+
+func TestFetch(t *testing.T) {
+	if *fetchDatasetNames == "" {
+		t.Skip("no datasets requested with -fetch")
+	}
+	if *fetchDump == "" {
+		t.Fatal("-fetch-dump must be set to a dump date, e.g. 20211101")
+	}
+	base := strings.TrimSuffix(*fetchMirror, "/") + "/" + *fetchDump + "/"
+	prefix := "enwiki-" + *fetchDump + "-"
+
+	sums, err := fetchSHA1Sums(base + prefix + "sha1sums.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range strings.Split(*fetchDatasetNames, ",") {
+		dataset, ok := fetchDatasets[name]
+		if !ok {
+			t.Fatalf("unknown dataset %q", name)
+		}
+		sum, ok := sums[prefix+dataset.file]
+		if !ok {
+			t.Fatalf("no published checksum for %s", prefix+dataset.file)
+		}
+		path := "testdata." + name
+		n, err := fetchDatasetTo(path, base+prefix+dataset.file, sum, dataset)
+		if err != nil {
+			_ = os.Remove(path)
+			t.Fatalf("%s: %v", name, err)
+		}
+		outSum, err := writeSHA256File(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		t.Logf("wrote %d entries to %s (sha256 %s)", n, path, outSum)
+	}
+}
+
+// fetchSHA1Sums downloads a sha1sum(1)-style checksum list.
+func fetchSHA1Sums(url string) (map[string]string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	sums := make(map[string]string)
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 {
+			sums[fields[1]] = fields[0]
+		}
+	}
+	return sums, s.Err()
+}
+
+// fetchDatasetTo streams the dump at url through dataset's row mapping into
+// a binary testdata file at path, verifying the download against sha1sum.
+// Keys are deduplicated (on a 64-bit hash, so a colliding key is very
+// occasionally dropped too) since the table builders reject duplicates.
+func fetchDatasetTo(path, url, sha1sum string, dataset fetchDataset) (int, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	h := sha1.New()
+	body := io.TeeReader(resp.Body, h)
+	zr, err := gzip.NewReader(bufio.NewReaderSize(body, 64*1024))
+	if err != nil {
+		return 0, err
+	}
+
+	w, err := newBinaryTestDataWriter(path)
+	if err != nil {
+		return 0, err
+	}
+	seen := make(map[uint64]struct{})
+	n := 0
+	errLimit := errors.New("limit reached")
+	err = parseSQLInserts(bufio.NewReaderSize(zr, 64*1024), dataset.table, func(row []string) error {
+		key, value, ok := dataset.entry(row)
+		if !ok || key == "" {
+			return nil
+		}
+		kh := farm.Hash64([]byte(key))
+		if _, dup := seen[kh]; dup {
+			return nil
+		}
+		seen[kh] = struct{}{}
+		if err := w.Put([]byte(key), []byte(value)); err != nil {
+			return err
+		}
+		n++
+		if *fetchLimit > 0 && n >= *fetchLimit {
+			return errLimit
+		}
+		return nil
+	})
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil || errors.Is(err, errLimit) {
+		// finish the download (we may have stopped early) to check
+		// its sum.
+		_, err = io.Copy(io.Discard, body)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sha1sum {
+		return 0, fmt.Errorf("%s: sha1 %s, want %s", url, got, sha1sum)
+	}
+	return n, nil
+}
+
+// writeSHA256File writes path's SHA-256 to path.sha256, in the format
+// sha256sum(1) -c reads.
+func writeSHA256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	return sum, os.WriteFile(path+".sha256", []byte(sum+"  "+path+"\n"), 0o644)
+}
+
+// parseSQLInserts calls row with the fields of each tuple in the mysqldump
+// "INSERT INTO `table` VALUES (...),(...);" statements for table in r.
+// Strings are unescaped and NULL is returned as the empty string.
+func parseSQLInserts(r *bufio.Reader, table string, row func([]string) error) error {
+	stmt := []byte("INSERT INTO `" + table + "` VALUES ")
+	for {
+		// at the start of a line.
+		if prefix, _ := r.Peek(len(stmt)); bytes.Equal(prefix, stmt) {
+			if _, err := r.Discard(len(stmt)); err != nil {
+				return err
+			}
+			// statements are usually far longer than r's buffer, so
+			// the tuples are parsed a byte at a time.
+			if err := parseSQLTuples(r, row); err != nil {
+				return err
+			}
+		}
+		// skip to the start of the next line.
+		for {
+			_, err := r.ReadSlice('\n')
+			if err == nil {
+				break
+			} else if errors.Is(err, io.EOF) {
+				return nil
+			} else if !errors.Is(err, bufio.ErrBufferFull) {
+				return err
+			}
+		}
+	}
+}
+
+// parseSQLTuples parses "(...),(...);" from r, stopping after the ';'.
+func parseSQLTuples(r *bufio.Reader, row func([]string) error) error {
+	var fields []string
+	var field []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case '(':
+			fields = fields[:0]
+		case ',', '\n':
+			// between tuples
+		case ';':
+			return nil
+		default:
+			return fmt.Errorf("unexpected %q between tuples", c)
+		}
+		if c != '(' {
+			continue
+		}
+
+		for {
+			field = field[:0]
+			c, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if c == '\'' {
+				if field, err = readSQLString(r, field); err != nil {
+					return err
+				}
+				if c, err = r.ReadByte(); err != nil {
+					return err
+				}
+			} else {
+				for c != ',' && c != ')' {
+					field = append(field, c)
+					if c, err = r.ReadByte(); err != nil {
+						return err
+					}
+				}
+				if string(field) == "NULL" {
+					field = field[:0]
+				}
+			}
+			fields = append(fields, string(field))
+			if c == ')' {
+				break
+			} else if c != ',' {
+				return fmt.Errorf("unexpected %q after field", c)
+			}
+		}
+		if err := row(fields); err != nil {
+			return err
+		}
+	}
+}
+
+// readSQLString appends the unescaped contents of a single-quoted MySQL
+// string to buf, having already consumed the opening quote.
+func readSQLString(r *bufio.Reader, buf []byte) ([]byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return buf, err
+		}
+		switch c {
+		case '\'':
+			return buf, nil
+		case '\\':
+			if c, err = r.ReadByte(); err != nil {
+				return buf, err
+			}
+			switch c {
+			case '0':
+				c = 0
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'Z':
+				c = 0x1a
+			}
+		}
+		buf = append(buf, c)
+	}
+}
+
+func TestParseSQLInserts(t *testing.T) {
+	const dump = "-- MySQL dump\n" +
+		"/*!40101 SET NAMES binary*/;\n" +
+		"INSERT INTO `other` VALUES (9,'skipped');\n" +
+		"INSERT INTO `page` VALUES (1,0,'Foo:Bar',NULL),(2,0,'It\\'s \\\"quoted\\\"\\\\',1.5);\n" +
+		"INSERT INTO `page` VALUES (3,1,'Line\\nbreak','x,y)');\n" +
+		"/*!40000 ALTER TABLE `page` ENABLE KEYS */;\n"
+	want := [][]string{
+		{"1", "0", "Foo:Bar", ""},
+		{"2", "0", `It's "quoted"\`, "1.5"},
+		{"3", "1", "Line\nbreak", "x,y)"},
+	}
+
+	var got [][]string
+	err := parseSQLInserts(bufio.NewReader(strings.NewReader(dump)), "page", func(row []string) error {
+		got = append(got, append([]string(nil), row...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestUnreverseDomainIndex(t *testing.T) {
+	for index, want := range map[string]string{
+		"https://org.wikipedia.en.":   "https://en.wikipedia.org",
+		"http://com.example.:8080":    "http://example.com:8080",
+		"https://arpa.in-addr.1.2.3.": "https://3.2.1.in-addr.arpa",
+	} {
+		if got, ok := unreverseDomainIndex(index); !ok || got != want {
+			t.Errorf("unreverseDomainIndex(%q) = %q, %v; want %q", index, got, ok, want)
+		}
+	}
+}
+
+func TestFetchDatasetTo(t *testing.T) {
+	const dump = "INSERT INTO `page` VALUES (1,0,'Foo:Bar',0),(2,1,'Talk',0),(3,0,'Foo:Bar',0),(4,0,'Baz',0);\n"
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte(dump))
+	_ = gw.Close()
+	sum := sha1.Sum(gz.Bytes())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(gz.Bytes())
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "testdata.enwiki-titles")
+	n, err := fetchDatasetTo(path, srv.URL, hex.EncodeToString(sum[:]), fetchDatasets["enwiki-titles"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []benchEntry{{Key: "Foo:Bar", Value: "1"}, {Key: "Baz", Value: "4"}}
+	var got []benchEntry
+	streamTestFile(path, func(k, v []byte) {
+		got = append(got, benchEntry{Key: string(k), Value: string(v)})
+	})
+	if n != len(want) || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %d entries %+v, want %+v", n, got, want)
+	}
+
+	if _, err := fetchDatasetTo(path, srv.URL, strings.Repeat("0", 40), fetchDatasets["enwiki-titles"]); err == nil {
+		t.Fatal("expected a checksum mismatch")
+	}
+}
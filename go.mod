@@ -1,15 +1,78 @@
 module github.com/bpowers/bit-benchmark
 
-go 1.18
+go 1.25.0
 
 require (
+	github.com/VictoriaMetrics/fastcache v1.13.3
+	github.com/allegro/bigcache/v3 v3.2.0
 	github.com/bpowers/bit v0.0.0-20211108065132-2fd689ee9671
 	github.com/bsm/go-sparkey v0.0.0-20160321124439-66bee8aff699
+	github.com/cockroachdb/pebble v1.1.5
+	github.com/cockroachdb/swiss v0.0.0-20260820225851-333444432258
 	github.com/colinmarc/cdb v0.0.0-20190223170904-60f317823f70
+	github.com/coocood/freecache v1.2.7
+	github.com/couchbase/vellum v1.0.2
+	github.com/dgraph-io/badger/v4 v4.9.6
+	github.com/dgraph-io/ristretto/v2 v2.2.0
+	github.com/dgryski/go-boomphf v0.0.0-20200306001805-f845e3dbcc25
+	github.com/dgryski/go-farm v0.0.0-20240924180020-3414d57e47da
+	github.com/google/flatbuffers v25.2.10+incompatible
+	github.com/hashicorp/go-immutable-radix v1.3.1
+	github.com/klauspost/compress v1.18.0
+	github.com/linxGnu/grocksdb v1.11.1
+	github.com/syndtr/goleveldb v1.0.0
+	github.com/twmb/murmur3 v1.1.8
+	go.etcd.io/bbolt v1.5.0
+	golang.org/x/mod v0.38.0
+	golang.org/x/perf v0.0.0-20250813145418-2f7363a06fe1
+	golang.org/x/sys v0.47.0
+	google.golang.org/protobuf v1.36.7
+	modernc.org/sqlite v1.59.0
 )
 
 require (
-	github.com/dgryski/go-farm v0.0.0-20200201041132-a6ae2369ad13 // indirect
+	github.com/DataDog/zstd v1.4.5 // indirect
+	github.com/aclements/go-moremath v0.0.0-20210112150236-f10218a38794 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/blevesearch/mmap-go v1.0.2 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/cockroachdb/errors v1.11.3 // indirect
+	github.com/cockroachdb/fifo v0.0.0-20240606204812-0bbfbd93a7ce // indirect
+	github.com/cockroachdb/logtags v0.0.0-20230118201751-21c54148d20b // indirect
+	github.com/cockroachdb/redact v1.1.5 // indirect
+	github.com/cockroachdb/tokenbucket v0.0.0-20230807174530-cc333fc44b06 // indirect
+	github.com/dgryski/go-radixsort v0.0.0-20160202071813-8410589e3f15 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/getsentry/sentry-go v0.27.0 // indirect
+	github.com/go-logr/logr v1.4.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/gogo/protobuf v1.3.2 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/golang/snappy v1.0.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/hashicorp/golang-lru v0.5.0 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/mattn/go-isatty v0.0.24 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/ncruces/go-strftime v1.0.0 // indirect
 	github.com/onsi/ginkgo v1.16.5 // indirect
 	github.com/onsi/gomega v1.17.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/client_golang v1.15.0 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.42.0 // indirect
+	github.com/prometheus/procfs v0.9.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	github.com/rogpeppe/go-internal v1.14.1 // indirect
+	github.com/willf/bitset v1.1.10 // indirect
+	go.opentelemetry.io/auto/sdk v1.2.1 // indirect
+	go.opentelemetry.io/otel v1.41.0 // indirect
+	go.opentelemetry.io/otel/metric v1.41.0 // indirect
+	go.opentelemetry.io/otel/trace v1.41.0 // indirect
+	golang.org/x/exp v0.0.0-20250718183923-645b1fa84792 // indirect
+	golang.org/x/text v0.28.0 // indirect
+	modernc.org/libc v1.75.7 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.12.1 // indirect
 )
@@ -0,0 +1,204 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// goleveldbBatchSize is the number of entries written per leveldb.Batch
+// while loading the table.
+const goleveldbBatchSize = 16 * 1024
+
+var (
+	benchTableGoleveldbOnce sync.Once
+	benchTableGoleveldb     *leveldb.DB
+)
+
+func init() {
+	registerBackend(backend{
+		name: "goleveldb",
+		open: func(path string) backendTable {
+			return newGoleveldbBackendTable(createGoleveldbTable(path))
+		},
+		duplicates:   duplicatesLastWins,
+		lookupAllocs: 14,
+		openMutable: func(path string) backendTable {
+			db, closeTable := createMutableGoleveldbTable(path)
+			return backendTable{
+				newBytesReader: sharedBytesReader(func(key []byte) ([]byte, bool) {
+					value, err := db.Get(key, nil)
+					return value, err == nil
+				}),
+				newWriter: sharedWriter(func(key, value []byte) error {
+					return db.Put(key, value, nil)
+				}),
+				close: closeTable,
+			}
+		},
+		benchTable: func() backendTable {
+			benchTableGoleveldbOnce.Do(loadGoleveldbBenchTable)
+			return newGoleveldbBackendTable(benchTableGoleveldb)
+		},
+	})
+}
+
+// newGoleveldbBackendTable returns the backendTable reading db.
+func newGoleveldbBackendTable(db *leveldb.DB) backendTable {
+	return backendTable{
+		newBytesReader: sharedBytesReader(func(key []byte) ([]byte, bool) {
+			value, err := db.Get(key, nil)
+			return value, err == nil
+		}),
+		close: func() { _ = db.Close() },
+	}
+}
+
+func loadGoleveldbBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableGoleveldb = createGoleveldbTable(testData)
+}
+
+func newGoleveldbOptions() *opt.Options {
+	return &opt.Options{
+		BlockCacheCapacity: 64 * opt.MiB,
+		Compression:        opt.NoCompression,
+		Filter:             filter.NewBloomFilter(10),
+		NoSync:             true,
+	}
+}
+
+func createGoleveldbTable(testDataPath string) *leveldb.DB {
+	dir, err := newTableDir("bit-test.*.leveldb")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	buildGoleveldbTable(testDataPath, dir)
+	opts := newGoleveldbOptions()
+	opts.ReadOnly = true
+	table, err := leveldb.OpenFile(dir, opts)
+	if err != nil {
+		panic(err)
+	}
+
+	// goleveldb opens tables lazily through its open-files cache.  A full
+	// scan gets every file open before we unlink the directory, the same as
+	// we do for the other tables.
+	iter := table.NewIterator(nil, nil)
+	for iter.Next() {
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		panic(err)
+	}
+
+	return table
+}
+
+// createMutableGoleveldbTable builds a table and opens it for writing too,
+// returning it and a function closing it and removing its directory.
+func createMutableGoleveldbTable(testDataPath string) (*leveldb.DB, func()) {
+	dir, err := newTableDir("bit-test.*.leveldb")
+	if err != nil {
+		panic(err)
+	}
+	buildGoleveldbTable(testDataPath, dir)
+	db, err := leveldb.OpenFile(dir, newGoleveldbOptions())
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		panic(err)
+	}
+	return db, func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func buildGoleveldbTable(testDataPath, dir string) {
+	db, err := leveldb.OpenFile(dir, newGoleveldbOptions())
+	if err != nil {
+		panic(err)
+	}
+
+	batch := new(leveldb.Batch)
+	streamTestFile(testDataPath, func(k, v []byte) {
+		batch.Put(k, v)
+		if batch.Len() >= goleveldbBatchSize {
+			if err := db.Write(batch, nil); err != nil {
+				panic(err)
+			}
+			batch.Reset()
+		}
+	})
+	if err := db.Write(batch, nil); err != nil {
+		panic(err)
+	}
+
+	// push everything out of the memtable and L0 so lookups see the
+	// compacted tree a long-lived store would have.
+	if err := db.CompactRange(util.Range{}); err != nil {
+		panic(err)
+	}
+	if err := db.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func BenchmarkGoleveldbGet(b *testing.B) {
+	loadTable(b, "goleveldb", &benchTableGoleveldbOnce, loadGoleveldbBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "goleveldb", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, err := benchTableGoleveldb.Get(zerocopy.Bytes(entry.Key), nil)
+			if !entry.matches(value, err == nil) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableGoleveldbCreate *leveldb.DB
+
+func BenchmarkGoleveldbCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		if benchTableGoleveldbCreate != nil {
+			_ = benchTableGoleveldbCreate.Close()
+		}
+		benchTableGoleveldbCreate = buildTable(b, "goleveldb", createGoleveldbTable, testData)
+		if benchTableGoleveldbCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+)
+
+// Tables are usually served to clients over the network rather than read
+// in-process, and a request's parsing, routing and response writing can
+// take far longer than the lookup it wraps.  BenchmarkHTTPGet serves each
+// registered backend over HTTP on the loopback, with keep-alive
+// connections, and reports the latency distribution alongside ns/op and
+// the requests per second, as ops/s:
+//
+//	go test -run XXX -bench HTTPGet -backends bit,cdb,pebble
+
+// lookupHandler serves GET /get?key=<key> from a table, with the value as
+// the response body or a 404 if the key isn't there.
+type lookupHandler struct {
+	table backendTable
+
+	// readers are per goroutine, and handlers aren't called from a
+	// fixed set of goroutines, so they're pooled here; all is every
+	// reader made, for releasing them in Close.
+	mu   sync.Mutex
+	free []bytesLookupFunc
+	all  []func()
+}
+
+func newLookupHandler(table backendTable) *lookupHandler {
+	return &lookupHandler{table: table}
+}
+
+func (h *lookupHandler) getReader() bytesLookupFunc {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n := len(h.free); n > 0 {
+		get := h.free[n-1]
+		h.free = h.free[:n-1]
+		return get
+	}
+	get, release := h.table.bytesReader()
+	h.all = append(h.all, release)
+	return get
+}
+
+func (h *lookupHandler) putReader(get bytesLookupFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.free = append(h.free, get)
+}
+
+func (h *lookupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/get" {
+		http.NotFound(w, r)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	get := h.getReader()
+	defer h.putReader(get)
+	value, ok := get(zerocopy.Bytes(key))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(len(value)))
+	_, _ = w.Write(value)
+}
+
+// Close releases the handler's readers.  The handler must not be serving.
+func (h *lookupHandler) Close() {
+	for _, release := range h.all {
+		release()
+	}
+	h.all, h.free = nil, nil
+}
+
+// latencyPercentiles returns the given percentiles of latencies, sorting
+// it in place.
+func latencyPercentiles(latencies []time.Duration, percentiles ...float64) []time.Duration {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result := make([]time.Duration, len(percentiles))
+	if len(latencies) == 0 {
+		return result
+	}
+	for i, p := range percentiles {
+		j := int(p / 100 * float64(len(latencies)))
+		result[i] = latencies[min(j, len(latencies)-1)]
+	}
+	return result
+}
+
+func BenchmarkHTTPGet(b *testing.B) {
+	loadBenchTables(b)
+
+	for _, be := range sortedBackends() {
+		b.Run(be.name, func(b *testing.B) {
+			be.skipIfUnavailable(b)
+			table := buildTable(b, be.name, be.open, testData)
+			defer table.close()
+			prewarmTable(b, table)
+			handler := newLookupHandler(table)
+			defer handler.Close()
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+
+			// enough idle connections that every RunParallel
+			// goroutine keeps its own alive.
+			transport := &http.Transport{MaxIdleConnsPerHost: 4 * runtime.GOMAXPROCS(0)}
+			defer transport.CloseIdleConnections()
+			client := &http.Client{Transport: transport}
+			base := srv.URL + "/get?key="
+
+			var mu sync.Mutex
+			var latencies []time.Duration
+			b.ReportAllocs()
+			b.ResetTimer()
+			faults := startPageFaults()
+			runParallel(b, be.name, func(b *testing.PB) {
+				defer pinWorker()()
+				var local []time.Duration
+				var body bytes.Buffer
+				entryCount := len(benchEntries)
+				i := rand.Int() % entryCount
+				for b.Next() {
+					entry := benchEntries[i]
+					start := time.Now()
+					resp, err := client.Get(base + url.QueryEscape(entry.Key))
+					if err != nil {
+						panic(err)
+					}
+					body.Reset()
+					_, err = body.ReadFrom(resp.Body)
+					_ = resp.Body.Close()
+					found := resp.StatusCode == http.StatusOK
+					if err != nil || (!found && resp.StatusCode != http.StatusNotFound) || !entry.matches(body.Bytes(), found) {
+						panic("bad data or lookup")
+					}
+					local = append(local, time.Since(start))
+					i = (i + 1) % entryCount
+				}
+				mu.Lock()
+				latencies = append(latencies, local...)
+				mu.Unlock()
+			})
+			b.StopTimer()
+			reportGetThroughput(b)
+			faults.report(b)
+			p := latencyPercentiles(latencies, 50, 99, 99.9)
+			b.ReportMetric(float64(p[0].Nanoseconds()), "p50-ns")
+			b.ReportMetric(float64(p[1].Nanoseconds()), "p99-ns")
+			b.ReportMetric(float64(p[2].Nanoseconds()), "p999-ns")
+		})
+	}
+}
+
+func TestLookupHandler(t *testing.T) {
+	path := writeGeneratedTestData(t, 1000, 0)
+	want := make(map[string]string)
+	streamTestFile(path, func(k, v []byte) {
+		want[string(k)] = string(v)
+	})
+
+	table := backends["map"].open(path)
+	defer table.close()
+	handler := newLookupHandler(table)
+	defer handler.Close()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	get := func(key string) (int, string) {
+		resp, err := http.Get(srv.URL + "/get?key=" + url.QueryEscape(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	n := 0
+	for k, v := range want {
+		if code, body := get(k); code != http.StatusOK || body != v {
+			t.Fatalf("%s: got %d %q; want 200 %q", k, code, body, v)
+		}
+		if n++; n == 100 {
+			break
+		}
+	}
+	if code, _ := get("not a key"); code != http.StatusNotFound {
+		t.Fatalf("missing key: got %d; want 404", code)
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1000; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i))
+	}
+	got := latencyPercentiles(latencies, 50, 99, 99.9, 100)
+	want := []time.Duration{501, 991, 1000, 1000}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("percentiles: got %v; want %v", got, want)
+			break
+		}
+	}
+}
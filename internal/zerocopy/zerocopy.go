@@ -0,0 +1,28 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+// Package zerocopy converts between strings and byte slices without
+// copying.  Most of the tables benchmarked take []byte keys, while the
+// benchmarks hold their keys as strings; converting with []byte(s) would
+// allocate and copy on every lookup and bill that to the table.
+package zerocopy
+
+import "unsafe"
+
+// Bytes returns a byte slice aliasing the contents of s.
+//
+// SAFETY: the returned byte slice MUST NOT be written to, only read: the
+// runtime assumes strings are immutable, and may share their memory.
+func Bytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
+// String returns a string aliasing the contents of b.
+//
+// SAFETY: b MUST NOT be written to for as long as the returned string is
+// in use, or the string will change under whatever holds it -- a map it's
+// a key in, say.
+func String(b []byte) string {
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package zerocopy
+
+import (
+	"bytes"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestBytes(t *testing.T) {
+	for _, s := range []string{"", "k", "a longer key, past any small-buffer optimization"} {
+		b := Bytes(s)
+		if string(b) != s {
+			t.Errorf("Bytes(%q) = %q", s, b)
+		}
+		if len(b) != cap(b) {
+			t.Errorf("Bytes(%q) has cap %d; want its len, %d", s, cap(b), len(b))
+		}
+		if len(s) > 0 && unsafe.SliceData(b) != unsafe.StringData(s) {
+			t.Errorf("Bytes(%q) copied the string", s)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	for _, b := range [][]byte{nil, {}, []byte("k"), []byte("a longer key, past any small-buffer optimization")} {
+		s := String(b)
+		if s != string(b) {
+			t.Errorf("String(%q) = %q", b, s)
+		}
+		if len(b) > 0 && unsafe.StringData(s) != unsafe.SliceData(b) {
+			t.Errorf("String(%q) copied the slice", b)
+		}
+	}
+}
+
+var (
+	sinkBytes  []byte
+	sinkString string
+)
+
+// TestNoAllocs checks that neither conversion allocates, even when the
+// result escapes.
+func TestNoAllocs(t *testing.T) {
+	s := strings.Repeat("k", 64)
+	b := []byte(s)
+	if n := testing.AllocsPerRun(100, func() { sinkBytes = Bytes(s) }); n != 0 {
+		t.Errorf("Bytes: %v allocs per run; want 0", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { sinkString = String(b) }); n != 0 {
+		t.Errorf("String: %v allocs per run; want 0", n)
+	}
+}
+
+// TestEscapeAnalysis checks with the compiler's own diagnostics that the
+// conversions inline and don't make their arguments escape, so calling
+// them in a lookup loop costs nothing over the unsafe expressions they
+// wrap.
+func TestEscapeAnalysis(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the package with -gcflags=-m")
+	}
+	out, err := exec.Command("go", "build", "-gcflags=-m", ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build -gcflags=-m: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		`can inline Bytes`,
+		`can inline String`,
+		`leaking param: s to result ~r0 level=0`,
+		`leaking param: b to result ~r0 level=0`,
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("compiler diagnostics missing %q:\n%s", want, out)
+		}
+	}
+	if regexp.MustCompile(`escapes to heap|moved to heap`).Match(out) {
+		t.Errorf("conversions allocate:\n%s", out)
+	}
+}
+
+func BenchmarkBytes(b *testing.B) {
+	s := strings.Repeat("k", 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sinkBytes = Bytes(s)
+	}
+}
+
+// BenchmarkBytesCopy is the allocating conversion Bytes replaces.
+func BenchmarkBytesCopy(b *testing.B) {
+	s := strings.Repeat("k", 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sinkBytes = []byte(s)
+	}
+}
+
+func BenchmarkString(b *testing.B) {
+	buf := []byte(strings.Repeat("k", 64))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sinkString = String(buf)
+	}
+}
+
+// BenchmarkStringCopy is the allocating conversion String replaces.
+func BenchmarkStringCopy(b *testing.B) {
+	buf := []byte(strings.Repeat("k", 64))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sinkString = string(buf)
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !linux
+
+package bitbenchmark
+
+import "testing"
+
+// iouringUnavailable is why the io_uring benchmark is skipped off Linux,
+// the only kernel with io_uring; see iouring_test.go.
+const iouringUnavailable = "io_uring is only on linux"
+
+func init() {
+	registerUnavailableBackend("cdb-iouring", iouringUnavailable)
+}
+
+func BenchmarkCdbIOUringGet(b *testing.B) {
+	b.Skip(iouringUnavailable)
+}
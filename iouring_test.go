@@ -0,0 +1,635 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build linux
+
+package bitbenchmark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"golang.org/x/sys/unix"
+)
+
+// iouringDepth is the size of each reader's submission queue, and so the
+// most reads it has in flight at once; larger batches are submitted in
+// chunks of this many keys.
+const iouringDepth = 256
+
+// uring is just enough of io_uring to submit reads and wait for them,
+// rather than a dependency: the Go io_uring libraries either don't build
+// with current toolchains or aren't maintained.  The layouts are those of
+// <linux/io_uring.h>.
+type uring struct {
+	fd   int
+	sq   []byte // the submission ring: head, tail, mask and the index array
+	cq   []byte // the completion ring, which may be the same mapping as sq
+	sqes []byte
+
+	sqHead, sqTail, sqMask *uint32
+	sqArray                []uint32
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []byte
+}
+
+// uringParams is struct io_uring_params.
+type uringParams struct {
+	sqEntries, cqEntries                   uint32
+	flags, sqThreadCPU, sqThreadIdle       uint32
+	features, wqFd                         uint32
+	_                                      [3]uint32
+	sqHead, sqTail, sqRingMask, sqEntries2 uint32
+	sqFlags, sqDropped, sqArray, _         uint32
+	_                                      uint64
+	cqHead, cqTail, cqRingMask, cqEntries2 uint32
+	cqOverflow, cqCqes, cqFlags, _         uint32
+	_                                      uint64
+}
+
+const (
+	uringOffSQRing      = 0
+	uringOffCQRing      = 0x8000000
+	uringOffSQEs        = 0x10000000
+	uringFeatSingleMap  = 1 << 0
+	uringEnterGetEvents = 1 << 0
+	uringOpRead         = 22
+	uringSQESize        = 64
+	uringCQESize        = 16
+)
+
+func newURing(entries uint32) (*uring, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	r := &uring{fd: int(fd)}
+
+	sqSize := int(p.sqArray + p.sqEntries*4)
+	cqSize := int(p.cqCqes + p.cqEntries*uringCQESize)
+	if p.features&uringFeatSingleMap != 0 {
+		sqSize = max(sqSize, cqSize)
+	}
+	var err error
+	if r.sq, err = unix.Mmap(r.fd, uringOffSQRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, err
+	}
+	r.cq = r.sq
+	if p.features&uringFeatSingleMap == 0 {
+		if r.cq, err = unix.Mmap(r.fd, uringOffCQRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+			r.close()
+			return nil, err
+		}
+	}
+	if r.sqes, err = unix.Mmap(r.fd, uringOffSQEs, int(p.sqEntries*uringSQESize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, err
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sq[p.sqHead]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sq[p.sqTail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sq[p.sqRingMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sq[p.sqArray])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cq[p.cqHead]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cq[p.cqTail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cq[p.cqRingMask]))
+	r.cqes = r.cq[p.cqCqes:]
+	return r, nil
+}
+
+func (r *uring) close() {
+	if r.sqes != nil {
+		_ = unix.Munmap(r.sqes)
+	}
+	if r.cq != nil && &r.cq[0] != &r.sq[0] {
+		_ = unix.Munmap(r.cq)
+	}
+	if r.sq != nil {
+		_ = unix.Munmap(r.sq)
+	}
+	_ = unix.Close(r.fd)
+}
+
+// queueRead adds a read to the submission ring, without submitting it.
+// The ring must have room: callers never queue more than its entries.
+func (r *uring) queueRead(fd int, buf uintptr, n uint32, off uint64, userData uint64) {
+	tail := *r.sqTail
+	i := tail & *r.sqMask
+	sqe := r.sqes[i*uringSQESize : (i+1)*uringSQESize]
+	clear(sqe)
+	sqe[0] = uringOpRead
+	*(*int32)(unsafe.Pointer(&sqe[4])) = int32(fd)
+	*(*uint64)(unsafe.Pointer(&sqe[8])) = off
+	*(*uint64)(unsafe.Pointer(&sqe[16])) = uint64(buf)
+	*(*uint32)(unsafe.Pointer(&sqe[24])) = n
+	*(*uint64)(unsafe.Pointer(&sqe[32])) = userData
+	r.sqArray[i] = i
+	// the kernel mustn't see the new tail before the entry.
+	atomic.StoreUint32(r.sqTail, tail+1)
+}
+
+// submitAndWait submits the queued reads and waits until at least n
+// completions are ready.
+func (r *uring) submitAndWait(n uint32) error {
+	for {
+		toSubmit := atomic.LoadUint32(r.sqTail) - atomic.LoadUint32(r.sqHead)
+		ready := atomic.LoadUint32(r.cqTail) - *r.cqHead
+		if toSubmit == 0 && ready >= n {
+			return nil
+		}
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(n-min(ready, n)), uringEnterGetEvents, 0, 0)
+		if errno != 0 && errno != unix.EINTR {
+			return errno
+		}
+	}
+}
+
+// completions calls f with the user data and result of each ready
+// completion, and consumes them.
+func (r *uring) completions(f func(userData uint64, res int32)) uint32 {
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		i := head & *r.cqMask
+		cqe := r.cqes[i*uringCQESize : (i+1)*uringCQESize]
+		f(*(*uint64)(unsafe.Pointer(&cqe[0])), *(*int32)(unsafe.Pointer(&cqe[8])))
+	}
+	n := tail - *r.cqHead
+	atomic.StoreUint32(r.cqHead, head)
+	return n
+}
+
+// cdbIOUringTable is a cdb table (see cdbTable), its files opened with
+// O_DIRECT to be read through io_uring.  Only each shard's index -- the
+// first 2 KB, locating its 256 hash tables -- is read up front; the hash
+// table slots and records it takes to look a key up are read on demand.
+type cdbIOUringTable struct {
+	shards []*cdbIOUringShard
+}
+
+type cdbIOUringShard struct {
+	f     *os.File
+	index [256]cdbHashTable
+}
+
+// cdbHashTable locates one of a cdb file's hash tables: its offset, and
+// how many 8-byte slots -- a hash and a record offset -- it has.
+type cdbHashTable struct {
+	off, slots uint32
+}
+
+// cdbIndexSize is the size of the index starting a cdb file.
+const cdbIndexSize = 256 * 8
+
+// cdbHash is the hash cdb files are built with, which the cdb package
+// doesn't export.
+func cdbHash(key []byte) uint32 {
+	h := uint32(5381)
+	for _, c := range key {
+		h = (h<<5 + h) ^ uint32(c)
+	}
+	return h
+}
+
+// createCdbIOUringTable builds a cdb table for the test data into a
+// temporary directory, and opens it for io_uring.
+func createCdbIOUringTable(testDataPath string) (*cdbIOUringTable, error) {
+	dir, err := newTableDir("bit-test.*")
+	if err != nil {
+		return nil, err
+	}
+	// the open files outlive their names.
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	table, err := buildCdbTable(testDataPath, dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := table.Close(); err != nil {
+		return nil, err
+	}
+	return openCdbIOUringTable(dir)
+}
+
+// openCdbIOUringTable opens the shards buildCdbTable left in dir.
+func openCdbIOUringTable(dir string) (*cdbIOUringTable, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.cdb"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no cdb shards in %s", dir)
+	}
+	// the names are zero-padded, so this is shard order.
+	sort.Strings(paths)
+	t := &cdbIOUringTable{shards: make([]*cdbIOUringShard, 0, len(paths))}
+	for _, path := range paths {
+		shard, err := openCdbIOUringShard(path)
+		if err != nil {
+			_ = t.Close()
+			return nil, err
+		}
+		t.shards = append(t.shards, shard)
+	}
+	return t, nil
+}
+
+func openCdbIOUringShard(path string) (*cdbIOUringShard, error) {
+	// the index is read once, through the page cache: an O_DIRECT read
+	// would need an aligned buffer for it.
+	index, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var buf [cdbIndexSize]byte
+	_, err = index.ReadAt(buf[:], 0)
+	if closeErr := index.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s's index: %w", path, err)
+	}
+
+	shard := &cdbIOUringShard{}
+	for i := range shard.index {
+		shard.index[i] = cdbHashTable{
+			off:   binary.LittleEndian.Uint32(buf[i*8:]),
+			slots: binary.LittleEndian.Uint32(buf[i*8+4:]),
+		}
+	}
+	if shard.f, err = os.OpenFile(path, os.O_RDONLY|unix.O_DIRECT, 0); err != nil {
+		return nil, err
+	}
+	return shard, nil
+}
+
+func (t *cdbIOUringTable) Close() error {
+	var firstErr error
+	for _, shard := range t.shards {
+		if err := shard.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// iouringReader looks keys up in a cdb table through io_uring: each batch
+// of keys goes to the kernel as one submission of O_DIRECT reads per step
+// of the lookup -- the hash table slot, then the record it points to --
+// which the device can then work on all at once, where a table faulting
+// its pages in through an mmap reads one page at a time.  This is the
+// experiment for cold, large-value workloads, so it only makes sense with a
+// native batch; a single Get is a batch of one.
+//
+// Like preadReader, the values it returns alias its buffers, and are only
+// valid until the next lookup.
+type iouringReader struct {
+	table *cdbIOUringTable
+	ring  *uring
+	// bufs are each lookup slot's read buffer: anonymous mappings, so
+	// page aligned for O_DIRECT, that the garbage collector doesn't move
+	// while the kernel writes to them.  They grow to fit the records read.
+	bufs [][]byte
+	// pending are the lookups in the current chunk, by slot.
+	pending []iouringLookup
+	// queued is how many reads are queued or in flight.
+	queued uint32
+}
+
+// iouringLookup is where a lookup is in probing its key's hash table.
+type iouringLookup struct {
+	i     int // the key's index in the batch
+	key   []byte
+	shard *cdbIOUringShard
+	hash  uint32
+	table cdbHashTable
+	// slot is the next slot of the hash table to probe, and probes how
+	// many have been.
+	slot, probes uint32
+	// record is the offset of the record being read, or 0 (inside the
+	// index, so never a record's) while probing.
+	record uint32
+	// start and end are the file offsets of the read in flight: start
+	// is where its buffer begins, and end as far as it must reach.
+	start, end int64
+}
+
+func newIOUringReader(t *cdbIOUringTable) *iouringReader {
+	ring, err := newURing(iouringDepth)
+	if err != nil {
+		panic(err)
+	}
+	r := &iouringReader{
+		table:   t,
+		ring:    ring,
+		bufs:    make([][]byte, iouringDepth),
+		pending: make([]iouringLookup, 0, iouringDepth),
+	}
+	for slot := range r.bufs {
+		r.grow(slot, 2*preadAlign)
+	}
+	return r
+}
+
+// grow replaces slot's buffer with one of at least n bytes.
+func (r *iouringReader) grow(slot, n int) {
+	if r.bufs[slot] != nil {
+		_ = unix.Munmap(r.bufs[slot])
+	}
+	buf, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		panic(err)
+	}
+	r.bufs[slot] = buf
+}
+
+func (r *iouringReader) Close() {
+	r.ring.close()
+	for _, buf := range r.bufs {
+		_ = unix.Munmap(buf)
+	}
+}
+
+func (r *iouringReader) Get(key []byte) (value []byte, ok bool) {
+	r.add(0, key)
+	r.flush(func(_ int, v []byte) {
+		value, ok = v, true
+	})
+	return value, ok
+}
+
+func (r *iouringReader) getBatch(keys []string, found func(i int, value []byte)) {
+	for i, key := range keys {
+		if len(r.pending) == iouringDepth {
+			r.flush(found)
+		}
+		r.add(i, zerocopy.Bytes(key))
+	}
+	r.flush(found)
+}
+
+// add starts looking up the key at index i of the batch, queueing its
+// first read unless its hash table is empty.
+func (r *iouringReader) add(i int, key []byte) {
+	shard := r.table.shards[0]
+	if len(r.table.shards) > 1 {
+		shard = r.table.shards[cdbShard(key, len(r.table.shards))]
+	}
+	hash := cdbHash(key)
+	table := shard.index[hash&0xff]
+	if table.slots == 0 {
+		return
+	}
+	r.pending = append(r.pending, iouringLookup{
+		i:     i,
+		key:   key,
+		shard: shard,
+		hash:  hash,
+		table: table,
+		slot:  (hash >> 8) % table.slots,
+	})
+	slot := len(r.pending) - 1
+	r.read(slot, int64(table.off)+8*int64(r.pending[slot].slot), 8)
+}
+
+// read queues a read of the n bytes at off for the lookup in slot, rounded
+// out to preadAlign at both ends.
+func (r *iouringReader) read(slot int, off int64, n int) {
+	l := &r.pending[slot]
+	l.start = off &^ (preadAlign - 1)
+	l.end = off + int64(n)
+	size := int((l.end+preadAlign-1)&^(preadAlign-1) - l.start)
+	if size > len(r.bufs[slot]) {
+		r.grow(slot, max(size, 2*len(r.bufs[slot])))
+	}
+	r.ring.queueRead(int(l.shard.f.Fd()), uintptr(unsafe.Pointer(&r.bufs[slot][0])), uint32(size), uint64(l.start), uint64(slot))
+	r.queued++
+}
+
+// flush submits the pending lookups' reads, and the reads each one read
+// leads to, until every lookup has found its key or missed, and reports
+// the values found.
+func (r *iouringReader) flush(found func(i int, value []byte)) {
+	for r.queued > 0 {
+		n := r.queued
+		r.queued = 0
+		if err := r.ring.submitAndWait(n); err != nil {
+			panic(err)
+		}
+		for done := uint32(0); done < n; {
+			done += r.ring.completions(func(userData uint64, res int32) {
+				slot := int(userData)
+				l := &r.pending[slot]
+				if res < 0 {
+					panic(fmt.Errorf("io_uring read of %s at %d: %w", l.shard.f.Name(), l.start, unix.Errno(-res)))
+				}
+				// the last block of the file comes back short, but
+				// never short of what was asked for.
+				if l.start+int64(res) < l.end {
+					panic(fmt.Errorf("io_uring read of %s at %d: read %d bytes, want %d: %w", l.shard.f.Name(), l.start, res, l.end-l.start, io.ErrUnexpectedEOF))
+				}
+				r.step(slot, r.bufs[slot][:res], found)
+			})
+		}
+	}
+	r.pending = r.pending[:0]
+}
+
+// step takes the lookup in slot as far as data, the file from its last
+// read's start, goes: probing its hash table's slots and checking the
+// records they point to, until it finds its key, misses, or needs to read
+// more, and queues that read.
+func (r *iouringReader) step(slot int, data []byte, found func(i int, value []byte)) {
+	l := &r.pending[slot]
+	le := binary.LittleEndian
+	for {
+		if l.record == 0 {
+			if l.probes == l.table.slots {
+				return
+			}
+			off := int64(l.table.off) + 8*int64(l.slot)
+			pos := off - l.start
+			if pos < 0 || pos+8 > int64(len(data)) {
+				r.read(slot, off, 8)
+				return
+			}
+			hash, record := le.Uint32(data[pos:]), le.Uint32(data[pos+4:])
+			// an empty slot ends the probe.
+			if record == 0 {
+				return
+			}
+			l.slot = (l.slot + 1) % l.table.slots
+			l.probes++
+			if hash == l.hash {
+				l.record = record
+			}
+			continue
+		}
+
+		pos := int64(l.record) - l.start
+		if pos < 0 || pos+8 > int64(len(data)) {
+			r.read(slot, int64(l.record), 8+len(l.key))
+			return
+		}
+		keyLen, valueLen := int64(le.Uint32(data[pos:])), int64(le.Uint32(data[pos+4:]))
+		if keyLen == int64(len(l.key)) {
+			end := pos + 8 + keyLen + valueLen
+			if end > int64(len(data)) {
+				r.read(slot, int64(l.record), int(8+keyLen+valueLen))
+				return
+			}
+			if bytes.Equal(data[pos+8:pos+8+keyLen], l.key) {
+				found(l.i, data[pos+8+keyLen:end])
+				return
+			}
+		}
+		// another key with the same hash: back to probing.
+		l.record = 0
+	}
+}
+
+var (
+	benchTableIOUringOnce sync.Once
+	benchTableIOUring     *cdbIOUringTable
+)
+
+func init() {
+	registerBackend(backend{
+		name: "cdb-iouring",
+		open: func(path string) backendTable {
+			table, err := createCdbIOUringTable(path)
+			if err != nil {
+				panic(err)
+			}
+			return newIOUringBackendTable(table)
+		},
+		// cdb keeps every record, and the probe finds the first.
+		duplicates: duplicatesFirstWins,
+		probe:      probeIOUring,
+		benchTable: func() backendTable {
+			benchTableIOUringOnce.Do(loadIOUringBenchTable)
+			return newIOUringBackendTable(benchTableIOUring)
+		},
+	})
+}
+
+// newIOUringBackendTable returns the backendTable reading table, with a
+// ring of its own per reader.
+func newIOUringBackendTable(table *cdbIOUringTable) backendTable {
+	return backendTable{
+		newBytesReader: func() (bytesLookupFunc, func()) {
+			r := newIOUringReader(table)
+			return r.Get, r.Close
+		},
+		newBatchReader: func() (batchLookupFunc, func()) {
+			r := newIOUringReader(table)
+			return r.getBatch, r.Close
+		},
+		close: func() { _ = table.Close() },
+	}
+}
+
+// probeIOUring checks that io_uring is enabled (kernel.io_uring_disabled,
+// and seccomp profiles such as Docker's, can turn it off), and that the
+// table's reads can use O_DIRECT.
+func probeIOUring() string {
+	ring, err := newURing(1)
+	if err != nil {
+		return "io_uring unavailable: " + err.Error()
+	}
+	ring.close()
+	return probeDirectIO()
+}
+
+// loadIOUringBenchTable opens the cdb benchmark's table, if -tabledir
+// keeps one, rather than building another.
+func loadIOUringBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	dir, err := cachedTableDir("cdb", buildCachedCdbTable)
+	if err == nil && dir == "" {
+		benchTableIOUring, err = createCdbIOUringTable(testData)
+	} else if err == nil {
+		benchTableIOUring, err = openCdbIOUringTable(dir)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func BenchmarkCdbIOUringGet(b *testing.B) {
+	backends["cdb-iouring"].skipIfUnavailable(b)
+	loadTable(b, "cdb-iouring", &benchTableIOUringOnce, loadIOUringBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "cdb-iouring", func(b *testing.PB) {
+		defer pinWorker()()
+		r := newIOUringReader(benchTableIOUring)
+		defer r.Close()
+
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := r.Get(zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+// TestIOUringLargeValues checks lookups of records longer than the reads
+// they start with, which take a second read into a grown buffer.
+func TestIOUringLargeValues(t *testing.T) {
+	b := backends["cdb-iouring"]
+	b.skipIfUnavailable(t)
+	// the text format's lines can't hold the largest.
+	path := filepath.Join(t.TempDir(), "testdata.bin")
+	values := map[string]string{
+		"small": "v",
+		"page":  strings.Repeat("p", preadAlign),
+		"large": strings.Repeat("l", 100*preadAlign+1),
+	}
+	var entries []benchEntry
+	for k, v := range values {
+		entries = append(entries, benchEntry{Key: k, Value: v})
+	}
+	if err := os.WriteFile(path, encodeBinaryTestData(t, entries), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	table := b.open(path)
+	defer table.close()
+	get, release := table.bytesReader()
+	defer release()
+	for k, want := range values {
+		if got, ok := get([]byte(k)); !ok || string(got) != want {
+			t.Errorf("Get(%q) = %d bytes, %v; want %d bytes", k, len(got), ok, len(want))
+		}
+	}
+	if _, ok := get([]byte("missing")); ok {
+		t.Error(`Get("missing") found a value`)
+	}
+}
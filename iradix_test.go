@@ -0,0 +1,137 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	iradix "github.com/hashicorp/go-immutable-radix"
+)
+
+// Radix trees are the prefix-structured family of index, next to the hash
+// tables and B-trees the other backends are: a lookup walks one node per
+// distinct stretch of key, so keys sharing long prefixes (-keys url) are
+// where one stands out, for better or worse.  go-immutable-radix is
+// persistent -- a write copies the path to the leaf it changes and makes a
+// new root -- which gives readers a snapshot that needs no locking.
+
+var (
+	benchTableRadixOnce sync.Once
+	benchTableRadix     *radixTable
+)
+
+// radixTable is an immutable radix tree swapped for a new one on each
+// write.  Writers serialize on mu; readers only load the current root.
+type radixTable struct {
+	mu   sync.Mutex
+	tree atomic.Pointer[iradix.Tree]
+}
+
+func (t *radixTable) Get(key []byte) ([]byte, bool) {
+	value, ok := t.tree.Load().Root().Get(key)
+	if !ok {
+		return nil, false
+	}
+	return zerocopy.Bytes(value.(string)), true
+}
+
+func (t *radixTable) Put(key, value []byte) {
+	t.mu.Lock()
+	tree, _, _ := t.tree.Load().Insert(bytes.Clone(key), string(value))
+	t.tree.Store(tree)
+	t.mu.Unlock()
+}
+
+func init() {
+	open := func(path string) backendTable {
+		return newRadixBackendTable(createRadixTable(path))
+	}
+	registerBackend(backend{
+		name:        "iradix",
+		open:        open,
+		duplicates:  duplicatesLastWins,
+		openMutable: open,
+		benchTable: func() backendTable {
+			benchTableRadixOnce.Do(loadRadixBenchTable)
+			return newRadixBackendTable(benchTableRadix)
+		},
+	})
+}
+
+// newRadixBackendTable returns the backendTable reading and writing t.
+func newRadixBackendTable(t *radixTable) backendTable {
+	return backendTable{
+		newBytesReader: sharedBytesReader(t.Get),
+		newWriter: sharedWriter(func(key, value []byte) error {
+			t.Put(key, value)
+			return nil
+		}),
+		close: noClose,
+	}
+}
+
+func loadRadixBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableRadix = createRadixTable(testData)
+}
+
+func createRadixTable(testDataPath string) *radixTable {
+	// a single transaction builds the tree in place, rather than copying
+	// a path per insert the way Put has to.
+	txn := iradix.New().Txn()
+	streamTestFile(testDataPath, func(k, v []byte) {
+		txn.Insert(bytes.Clone(k), string(v))
+	})
+
+	t := &radixTable{}
+	t.tree.Store(txn.Commit())
+	return t
+}
+
+func BenchmarkIRadixGet(b *testing.B) {
+	loadTable(b, "iradix", &benchTableRadixOnce, loadRadixBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "iradix", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := benchTableRadix.Get(zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableRadixCreate *radixTable
+
+func BenchmarkIRadixCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		benchTableRadixCreate = buildTable(b, "iradix", createRadixTable, testData)
+		if benchTableRadixCreate.tree.Load().Len() == 0 {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// The Get benchmarks call each backend however is cheapest: GetString for
+// bit, and []byte keys converted from strings without copying for the
+// likes of cdb and sparkey.  BenchmarkKeyTypeGet instead looks keys up in
+// every backend both ways, as a caller holding a string and as one holding
+// a []byte, so each backend pays for whatever conversion its API forces on
+// that caller (see backendTable.reader and bytesReader).
+func BenchmarkKeyTypeGet(b *testing.B) {
+	loadBenchTables(b)
+
+	// separately allocated copies of the keys, as a caller reading them
+	// off the network would have.
+	keys := make([][]byte, len(benchEntries))
+	for i, entry := range benchEntries {
+		keys[i] = []byte(entry.Key)
+	}
+
+	for _, be := range sortedBackends() {
+		b.Run(be.name, func(b *testing.B) {
+			be.skipIfUnavailable(b)
+			table := buildTable(b, be.name, be.open, testData)
+			defer table.close()
+			prewarmTable(b, table)
+
+			b.Run("string", func(b *testing.B) {
+				b.ReportAllocs()
+				b.ResetTimer()
+				faults := startPageFaults()
+				runParallel(b, be.name, func(b *testing.PB) {
+					defer pinWorker()()
+					get, release := table.reader()
+					defer release()
+					entryCount := len(benchEntries)
+					i := rand.Int() % entryCount
+					for b.Next() {
+						entry := benchEntries[i]
+						value, ok := get(entry.Key)
+						if !entry.matches(value, ok) {
+							panic("bad data or lookup")
+						}
+						i = (i + 1) % entryCount
+					}
+				})
+				reportGetThroughput(b)
+				faults.report(b)
+			})
+			b.Run("bytes", func(b *testing.B) {
+				b.ReportAllocs()
+				b.ResetTimer()
+				faults := startPageFaults()
+				runParallel(b, be.name, func(b *testing.PB) {
+					defer pinWorker()()
+					get, release := table.bytesReader()
+					defer release()
+					entryCount := len(benchEntries)
+					i := rand.Int() % entryCount
+					for b.Next() {
+						value, ok := get(keys[i])
+						if !benchEntries[i].matches(value, ok) {
+							panic("bad data or lookup")
+						}
+						i = (i + 1) % entryCount
+					}
+				})
+				reportGetThroughput(b)
+				faults.report(b)
+			})
+		})
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build lmdb
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+)
+
+// The LMDB backend is built on the cgo lmdb-go bindings, so it is only built
+// with `-tags lmdb`.  go.mod doesn't require lmdb-go yet, so add it first:
+//
+//	go get github.com/bmatsuo/lmdb-go@v1.8.0
+//	go test -tags lmdb -bench=Lmdb
+
+// lmdbBatchSize bounds the number of dirty pages a single write transaction
+// accumulates while bulk loading.
+const lmdbBatchSize = 64 * 1024
+
+var (
+	benchTableLmdbOnce sync.Once
+	benchTableLmdb     *lmdbTable
+)
+
+type lmdbTable struct {
+	env *lmdb.Env
+	dbi lmdb.DBI
+}
+
+func init() {
+	registerBackend(backend{
+		name: "lmdb",
+		open: func(path string) backendTable {
+			return newLmdbBackendTable(createLmdbTable(path))
+		},
+		// MDB_APPEND fails with MDB_KEYEXIST on a repeated key.
+		duplicates:   duplicatesError,
+		lookupAllocs: allocsUnmeasured,
+		openMutable: func(path string) backendTable {
+			t, closeTable := createMutableLmdbTable(path)
+			return backendTable{
+				newBytesReader: func() (bytesLookupFunc, func()) {
+					// a transaction reads a snapshot, so each
+					// lookup gets its own to see concurrent
+					// writes, and a copy of the value.
+					return func(key []byte) (value []byte, ok bool) {
+						_ = t.env.View(func(txn *lmdb.Txn) (err error) {
+							value, err = txn.Get(t.dbi, key)
+							ok = err == nil
+							return nil
+						})
+						return value, ok
+					}, noClose
+				},
+				newWriter: sharedWriter(func(key, value []byte) error {
+					return t.env.Update(func(txn *lmdb.Txn) error {
+						return txn.Put(t.dbi, key, value, 0)
+					})
+				}),
+				close: closeTable,
+			}
+		},
+		benchTable: func() backendTable {
+			benchTableLmdbOnce.Do(loadLmdbBenchTable)
+			return newLmdbBackendTable(benchTableLmdb)
+		},
+	})
+}
+
+// newLmdbBackendTable returns the backendTable reading t.
+func newLmdbBackendTable(t *lmdbTable) backendTable {
+	return backendTable{
+		newBytesReader: func() (bytesLookupFunc, func()) {
+			txn, err := t.env.BeginTxn(nil, lmdb.Readonly)
+			if err != nil {
+				panic(err)
+			}
+			txn.RawRead = true
+			return func(key []byte) ([]byte, bool) {
+				value, err := txn.Get(t.dbi, key)
+				return value, err == nil
+			}, txn.Abort
+		},
+		close: func() { _ = t.env.Close() },
+	}
+}
+
+func loadLmdbBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableLmdb = createLmdbTable(testData)
+}
+
+func openLmdbEnv(path string, mapSize int64, flags uint) *lmdb.Env {
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		panic(err)
+	}
+	if err := env.SetMapSize(mapSize); err != nil {
+		panic(err)
+	}
+	if err := env.Open(path, lmdb.NoSubdir|flags, 0644); err != nil {
+		panic(err)
+	}
+	return env
+}
+
+func createLmdbTable(testDataPath string) *lmdbTable {
+	tableFile, err := newTableFile("bit-test.*.data")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.Remove(tableFile.Name())
+		_ = os.Remove(tableFile.Name() + "-lock")
+	}()
+	if err = tableFile.Close(); err != nil {
+		panic(err)
+	}
+
+	mapSize := buildLmdbTable(testDataPath, tableFile.Name())
+	// NoTLS lets a read-only transaction be used from a goroutine that the
+	// scheduler moves between OS threads.
+	return openLmdbTable(tableFile.Name(), mapSize, lmdb.Readonly|lmdb.NoTLS|lmdb.NoReadahead)
+}
+
+// createMutableLmdbTable builds a table and opens it for writing too,
+// returning it and a function closing it and removing its files.
+func createMutableLmdbTable(testDataPath string) (*lmdbTable, func()) {
+	tableFile, err := newTableFile("bit-test.*.data")
+	if err != nil {
+		panic(err)
+	}
+	if err = tableFile.Close(); err != nil {
+		panic(err)
+	}
+	mapSize := buildLmdbTable(testDataPath, tableFile.Name())
+	// leave room for what's written.
+	t := openLmdbTable(tableFile.Name(), 2*mapSize+1<<30, lmdb.NoSync|lmdb.NoTLS|lmdb.NoReadahead)
+	return t, func() {
+		_ = t.env.Close()
+		_ = os.Remove(tableFile.Name())
+		_ = os.Remove(tableFile.Name() + "-lock")
+	}
+}
+
+func openLmdbTable(path string, mapSize int64, flags uint) *lmdbTable {
+	env := openLmdbEnv(path, mapSize, flags)
+	var dbi lmdb.DBI
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		dbi, err = txn.OpenRoot(0)
+		return err
+	})
+	if err != nil {
+		panic(err)
+	}
+	return &lmdbTable{env: env, dbi: dbi}
+}
+
+// buildLmdbTable replaces the file at path with a database of the
+// testdata, returning the map size it was built with.
+func buildLmdbTable(testDataPath, path string) int64 {
+	if err := os.Remove(path); err != nil {
+		panic(err)
+	}
+
+	// inserting in key order lets us use MDB_APPEND, which fills B+tree pages
+	// completely rather than leaving them half-empty after splits.
+	var entries []benchEntry
+	var dataSize int64
+	streamTestFile(testDataPath, func(k, v []byte) {
+		entries = append(entries, benchEntry{Key: string(k), Value: string(v)})
+		dataSize += int64(len(k) + len(v))
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	// the map size is an upper bound on the file size, not an allocation, so
+	// be generous to account for page and node overhead.
+	mapSize := 4*dataSize + 64<<20
+
+	env := openLmdbEnv(path, mapSize, lmdb.NoSync)
+	var dbi lmdb.DBI
+	for off := 0; off < len(entries); off += lmdbBatchSize {
+		batch := entries[off:]
+		if len(batch) > lmdbBatchSize {
+			batch = batch[:lmdbBatchSize]
+		}
+		err := env.Update(func(txn *lmdb.Txn) (err error) {
+			dbi, err = txn.OpenRoot(0)
+			if err != nil {
+				return err
+			}
+			for _, entry := range batch {
+				if err := txn.Put(dbi, zerocopy.Bytes(entry.Key), zerocopy.Bytes(entry.Value), lmdb.Append); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := env.Sync(true); err != nil {
+		panic(err)
+	}
+	if err := env.Close(); err != nil {
+		panic(err)
+	}
+	return mapSize
+}
+
+func BenchmarkLmdbGet(b *testing.B) {
+	loadTable(b, "lmdb", &benchTableLmdbOnce, loadLmdbBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "lmdb", func(b *testing.PB) {
+		defer pinWorker()()
+		txn, err := benchTableLmdb.env.BeginTxn(nil, lmdb.Readonly)
+		if err != nil {
+			panic(err)
+		}
+		defer txn.Abort()
+		// return slices pointing into the mmapped file rather than copies,
+		// matching what bit, sparkey and cdb hand back.
+		txn.RawRead = true
+
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, err := txn.Get(benchTableLmdb.dbi, zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, err == nil) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableLmdbCreate *lmdbTable
+
+func BenchmarkLmdbCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		if benchTableLmdbCreate != nil {
+			_ = benchTableLmdbCreate.env.Close()
+		}
+		benchTableLmdbCreate = buildTable(b, "lmdb", createLmdbTable, testData)
+		if benchTableLmdbCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
@@ -0,0 +1,295 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build linux
+
+package bitbenchmark
+
+import (
+	"bufio"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// madviseAdvice is the advice BenchmarkMadviseGet applies to each table.
+// MADV_RANDOM turns off readahead, which only drags in neighbouring pages
+// a point lookup won't use; MADV_WILLNEED reads the whole table in ahead of
+// time; and MADV_HUGEPAGE (where the kernel and filesystem support it)
+// maps the table with fewer TLB entries.
+var madviseAdvice = []struct {
+	name   string
+	advice int
+}{
+	{"normal", unix.MADV_NORMAL},
+	{"random", unix.MADV_RANDOM},
+	{"willneed", unix.MADV_WILLNEED},
+	{"hugepage", unix.MADV_HUGEPAGE},
+}
+
+// tableMapping is a read-only mapping of a table file.
+type tableMapping struct {
+	start, end uintptr
+	path       string
+}
+
+// tableMappings returns the read-only mappings of table files (see
+// isTablePath), temporary or cached in -tabledir, listed in
+// /proc/self/maps.  Writable mappings are left out: MADV_DONTNEED would
+// throw away a private mapping's changes.
+func tableMappings() ([]tableMapping, error) {
+	f, err := os.Open("/proc/self/maps")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var mappings []tableMapping
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// start-end perms offset dev inode path
+		fields := strings.Fields(s.Text())
+		if len(fields) < 6 || strings.Contains(fields[1], "w") {
+			continue
+		}
+		// the temporary tables' files are removed once they're open.
+		path := strings.TrimSuffix(strings.Join(fields[5:], " "), " (deleted)")
+		if !isTablePath(path) {
+			continue
+		}
+		start, end, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			continue
+		}
+		startAddr, err := strconv.ParseUint(start, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		endAddr, err := strconv.ParseUint(end, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, tableMapping{start: uintptr(startAddr), end: uintptr(endAddr), path: path})
+	}
+	return mappings, s.Err()
+}
+
+// newTableMappings returns the mappings in after that aren't in before.
+func newTableMappings(before, after []tableMapping) []tableMapping {
+	existing := make(map[tableMapping]bool, len(before))
+	for _, m := range before {
+		existing[m] = true
+	}
+	var mappings []tableMapping
+	for _, m := range after {
+		if !existing[m] {
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings
+}
+
+// liveTableMappings returns those of mappings that are still mapped.  A
+// backend can unmap part of its table after opening it (bit's builder
+// maps the data file, and a finalizer unmaps it once the builder is
+// garbage), and advising a range that has since been reused, say for the
+// heap, would be a disaster: MADV_DONTNEED zeroes anonymous memory.
+func liveTableMappings(mappings []tableMapping) ([]tableMapping, error) {
+	// run any finalizers that are due before looking.
+	runtime.GC()
+	runtime.GC()
+	current, err := tableMappings()
+	if err != nil {
+		return nil, err
+	}
+	gone := newTableMappings(current, mappings)
+	return newTableMappings(gone, mappings), nil
+}
+
+func madvise(mappings []tableMapping, advice int) error {
+	for _, m := range mappings {
+		// the mappings belong to the backends, so there's no []byte
+		// to hand unix.Madvise.
+		if _, _, errno := unix.Syscall(unix.SYS_MADVISE, m.start, m.end-m.start, uintptr(advice)); errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
+
+// BenchmarkMadviseGet runs the Get benchmark against each backend that
+// mmaps its table once for each of madviseAdvice, finding the table's
+// mappings by what opening it added to /proc/self/maps.  Each run starts
+// with the table's pages unmapped (though still in the page cache), so the
+// page faults of one don't carry over to the next.
+func BenchmarkMadviseGet(b *testing.B) {
+	loadBenchTables(b)
+
+	for _, be := range sortedBackends() {
+		b.Run(be.name, func(b *testing.B) {
+			be.skipIfUnavailable(b)
+			before, err := tableMappings()
+			if err != nil {
+				b.Fatal(err)
+			}
+			table := buildTable(b, be.name, be.open, testData)
+			defer table.close()
+			after, err := tableMappings()
+			if err != nil {
+				b.Fatal(err)
+			}
+			mappings := newTableMappings(before, after)
+			if len(mappings) == 0 {
+				b.Skip("table isn't mmapped")
+			}
+
+			for _, a := range madviseAdvice {
+				b.Run(a.name, func(b *testing.B) {
+					mappings, err := liveTableMappings(mappings)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := madvise(mappings, unix.MADV_DONTNEED); err != nil {
+						b.Fatal(err)
+					}
+					if err := madvise(mappings, a.advice); err != nil {
+						b.Skipf("madvise %s: %v", a.name, err)
+					}
+					defer func() {
+						_ = madvise(mappings, unix.MADV_NORMAL)
+					}()
+
+					b.ReportAllocs()
+					b.ResetTimer()
+					faults := startPageFaults()
+					runParallel(b, be.name, func(b *testing.PB) {
+						defer pinWorker()()
+						get, release := table.reader()
+						defer release()
+						entryCount := len(benchEntries)
+						i := rand.Int() % entryCount
+						for b.Next() {
+							entry := benchEntries[i]
+							value, ok := get(entry.Key)
+							if !entry.matches(value, ok) {
+								panic("bad data or lookup")
+							}
+							i = (i + 1) % entryCount
+						}
+					})
+					reportGetThroughput(b)
+					faults.report(b)
+				})
+			}
+		})
+	}
+}
+
+func TestTableMappings(t *testing.T) {
+	defer func(dir string) {
+		tableDir = dir
+	}(tableDir)
+	tableDir = t.TempDir()
+
+	t.Run("temporary", func(t *testing.T) {
+		f, err := newTableFile("bit-test.*.data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		if _, err := f.Write(make([]byte, 2*os.Getpagesize())); err != nil {
+			t.Fatal(err)
+		}
+		testTableMappings(t, f)
+	})
+	t.Run("cached", func(t *testing.T) {
+		// a -tabledir table's file name is the backend's own.
+		dir, err := cachedTableDir("test", func(dir string) error {
+			return os.WriteFile(filepath.Join(dir, "000.cdb"), make([]byte, 2*os.Getpagesize()), 0o644)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(filepath.Join(dir, "000.cdb"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		testTableMappings(t, f)
+	})
+	t.Run("untracked", func(t *testing.T) {
+		f, err := os.CreateTemp(t.TempDir(), "bit-test.*.data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		if _, err := f.Write(make([]byte, os.Getpagesize())); err != nil {
+			t.Fatal(err)
+		}
+		data, err := unix.Mmap(int(f.Fd()), 0, os.Getpagesize(), unix.PROT_READ, unix.MAP_SHARED)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = unix.Munmap(data)
+		}()
+		mappings, err := tableMappings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range mappings {
+			if m.path == f.Name() {
+				t.Fatalf("%s isn't a table's, but got a mapping of it", f.Name())
+			}
+		}
+	})
+}
+
+// testTableMappings checks that mmapping f, a table's two-page file, adds
+// one table mapping, which can be advised and prewarmed.
+func testTableMappings(t *testing.T, f *os.File) {
+	t.Helper()
+	before, err := tableMappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, 2*os.Getpagesize(), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = unix.Munmap(data)
+	}()
+	after, err := tableMappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappings := newTableMappings(before, after)
+	if len(mappings) != 1 || mappings[0].path != f.Name() || mappings[0].end-mappings[0].start != uintptr(len(data)) {
+		t.Fatalf("got mappings %+v; want one of %s", mappings, f.Name())
+	}
+	for _, a := range madviseAdvice[:3] {
+		if err := madvise(mappings, a.advice); err != nil {
+			t.Fatalf("madvise %s: %v", a.name, err)
+		}
+	}
+	if err := prewarmPages(); err != nil {
+		t.Fatalf("prewarmPages: %v", err)
+	}
+}
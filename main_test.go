@@ -7,62 +7,272 @@ package bitbenchmark
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
 	"math/rand"
 	"os"
-	"reflect"
+	"path/filepath"
+	"sort"
 	"sync"
 	"testing"
-	"unsafe"
 
 	"github.com/bpowers/bit"
-	"github.com/bsm/go-sparkey"
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
 	"github.com/colinmarc/cdb"
+	"github.com/dgryski/go-farm"
 )
 
-const testData = "testdata.large"
+// testData is the fixture every benchmark loads.  It can be plain text, the
+// binary format, or either of those compressed with gzip or zstd, and can be
+// read from a file, stdin ("-") or an http(s) URL.  go test doesn't pass
+// its stdin through to the test binary, so reading from stdin needs a
+// binary built with go test -c.  Without a testdata.large, a fixture of
+// -entries entries is generated instead (see generateMissingTestData).
+var testData = "testdata.large"
+
+// hotset is the fraction of the keys the Get benchmarks look up, chosen at
+// random.  Services often touch only a small part of a large table, and a
+// small hot set shows how much each backend gains from that locality: from
+// the CPU caches for in-heap tables, and from the page cache for on-disk
+// ones.
+var hotset = 1.0
+
+func init() {
+	flag.StringVar(&testData, "testdata", testData, "testdata `source`: a file, - for stdin, or an http(s) URL (.gz and .zst are decompressed)")
+	flag.Float64Var(&hotset, "hotset", hotset, "look up only this random `fraction` of the keys in benchmarks")
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if err := applyPinning(); err != nil {
+		fmt.Fprintln(os.Stderr, "pinning:", err)
+		os.Exit(1)
+	}
+	// the children BenchmarkMultiProcessGet starts are handed the tables
+	// they open, so don't make them each generate testdata too.
+	if os.Getenv(multiProcessFormatEnv) == "" {
+		if err := generateMissingTestData(); err != nil {
+			fmt.Fprintln(os.Stderr, "generating testdata:", err)
+			os.Exit(1)
+		}
+		if err := reportTableDir(); err != nil {
+			fmt.Fprintln(os.Stderr, "-tabledir:", err)
+			os.Exit(1)
+		}
+		reportTopology()
+		probeBackends()
+		if *verify {
+			if err := verifyBackends(os.Stderr); err != nil {
+				fmt.Fprintln(os.Stderr, "-verify:", err)
+				os.Exit(1)
+			}
+		}
+	}
+	code := m.Run()
+	removeSpooledTestData()
+	removeMultiProcessTables()
+	os.Exit(code)
+}
 
 var (
-	benchTableOnce                sync.Once
-	benchTableBit                 *bit.Table
-	benchTableSparkeyUncompressed *sparkey.HashReader
-	// benchTableSparkeySnappy       *sparkey.HashReader
-	benchTableCdb *cdb.CDB
-	benchHashmap  map[string]string
-	benchEntries  []benchEntry
+	benchTableOnce   sync.Once
+	benchTableBit    *bit.Table
+	benchTableCdb    *cdbTable
+	benchTableCdbErr error
+	benchHashmap     map[string]string
+	benchEntries     []benchEntry
 )
 
 type benchEntry struct {
 	Key   string
 	Value string
+	// Absent marks a key that's in no table, one of those -missratio
+	// mixes into benchEntries.
+	Absent bool
+}
+
+func init() {
+	registerBackend(backend{
+		name: "bit",
+		open: func(path string) backendTable {
+			return newBitBackendTable(createBitTable(path))
+		},
+		// Finalize retries index seeds forever if a key repeats.
+		duplicates: duplicatesHang,
+		benchTable: func() backendTable {
+			benchTableOnce.Do(loadBenchTable)
+			return newBitBackendTable(benchTableBit)
+		},
+	})
+	registerBackend(backend{
+		name: "map",
+		open: func(path string) backendTable {
+			return newMapBackendTable(createInMemoryTable(path))
+		},
+		duplicates: duplicatesLastWins,
+		// a map can't be read while it's written, so the mutable one
+		// takes a lock around lookups too: the one-lock baseline for
+		// shardedmap's many and syncmap's none.
+		openMutable: func(path string) backendTable {
+			m := createInMemoryTable(path)
+			var mu sync.RWMutex
+			return backendTable{
+				newReader: sharedReader(func(key string) ([]byte, bool) {
+					mu.RLock()
+					value, ok := m[key]
+					mu.RUnlock()
+					return zerocopy.Bytes(value), ok
+				}),
+				newWriter: sharedWriter(func(key, value []byte) error {
+					mu.Lock()
+					m[string(key)] = string(value)
+					mu.Unlock()
+					return nil
+				}),
+				close: noClose,
+			}
+		},
+		benchTable: func() backendTable {
+			benchTableOnce.Do(loadBenchTable)
+			return newMapBackendTable(benchHashmap)
+		},
+	})
+	registerBackend(backend{
+		name: "cdb",
+		open: func(path string) backendTable {
+			table, err := createCdbTable(path)
+			if err != nil {
+				panic(err)
+			}
+			return newCdbBackendTable(table)
+		},
+		// cdb keeps every record, and Get returns the first.
+		duplicates:   duplicatesFirstWins,
+		lookupAllocs: 3,
+		benchTable: func() backendTable {
+			benchTableOnce.Do(loadBenchTable)
+			if benchTableCdbErr != nil {
+				panic(benchTableCdbErr)
+			}
+			return newCdbBackendTable(benchTableCdb)
+		},
+	})
+}
+
+// newBitBackendTable returns the backendTable reading table.
+func newBitBackendTable(table *bit.Table) backendTable {
+	return backendTable{
+		newReader:      sharedReader(table.GetString),
+		newBytesReader: sharedBytesReader(table.Get),
+		close:          noClose,
+	}
+}
+
+// newMapBackendTable returns the backendTable reading m.
+func newMapBackendTable(m map[string]string) backendTable {
+	return backendTable{
+		newReader: sharedReader(func(key string) ([]byte, bool) {
+			value, ok := m[key]
+			return zerocopy.Bytes(value), ok
+		}),
+		// the compiler doesn't copy a key converted in the index
+		// expression itself.
+		newBytesReader: sharedBytesReader(func(key []byte) ([]byte, bool) {
+			value, ok := m[string(key)]
+			return zerocopy.Bytes(value), ok
+		}),
+		close: noClose,
+	}
 }
 
+// newCdbBackendTable returns the backendTable reading table.
+func newCdbBackendTable(table *cdbTable) backendTable {
+	return backendTable{
+		newBytesReader: sharedBytesReader(func(key []byte) ([]byte, bool) {
+			value, err := table.Get(key)
+			return value, err == nil && value != nil
+		}),
+		close: func() { _ = table.Close() },
+	}
+}
+
+// loadBenchTable builds the tables concurrently, each streaming the fixture
+// itself: with a multi-GB fixture, building them one after another spends
+// most of the setup time re-reading it.  The builders' peak memory adds up,
+// though, as they all run at once.
 func loadBenchTable() {
-	benchTableBit = createBitTable(testData)
-	benchTableSparkeyUncompressed = createSparkeyTable(testData, false)
-	// benchTableSparkeySnappy = createSparkeyTable(testData, true)
-	benchTableCdb = createCdbTable(testData)
-	benchHashmap = createInMemoryTable(testData)
-	benchEntries = createEntriesTable(testData)
+	buildConcurrently(func() {
+		benchTableBit = loadBitBenchTable()
+	}, func() {
+		benchTableCdb, benchTableCdbErr = loadCdbBenchTable()
+	}, func() {
+		benchHashmap = createInMemoryTable(testData)
+		benchEntries = withMisses(hotEntries(mapEntries(benchHashmap), hotset), missRatio, inBenchTable)
+	})
+}
+
+// buildConcurrently runs each of builds in a goroutine of its own, waiting
+// for them all.  If any of them panics, so does buildConcurrently, from the
+// caller's goroutine, which a failed build's panic would otherwise take
+// down the whole run from, however the caller meant to handle it.
+func buildConcurrently(builds ...func()) {
+	var wg sync.WaitGroup
+	panicked := make(chan any, len(builds))
+	for _, build := range builds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					panicked <- r
+				}
+			}()
+			build()
+		}()
+	}
+	wg.Wait()
+	select {
+	case r := <-panicked:
+		panic(r)
+	default:
+	}
 }
 
 func streamTestFile(path string, put func(key, value []byte)) {
-	f, err := os.Open(path)
+	f, err := openTestFile(path)
 	if err != nil {
 		panic(err)
 	}
-	defer func() {
-		_ = f.Close()
-	}()
+	err = readTestData(f, put)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		panic(fmt.Errorf("reading %s: %w", path, err))
+	}
+}
+
+// readTestData calls put for each entry of the testdata read from r, in
+// either format, returning an error if it's malformed.  The slices passed
+// to put are only valid until it returns.
+func readTestData(r io.Reader, put func(key, value []byte)) error {
+	br := bufio.NewReaderSize(r, 16*1024)
+	if isBinaryTestData(br) {
+		return readBinaryTestData(br, put)
+	}
 
-	s := bufio.NewScanner(bufio.NewReaderSize(f, 16*1024))
-	for s.Scan() {
-		line := s.Bytes()
-		k, v, ok := bytes.Cut(line, []byte{':'})
+	s := bufio.NewScanner(br)
+	for line := 1; s.Scan(); line++ {
+		k, v, ok := bytes.Cut(s.Bytes(), []byte{':'})
 		if !ok {
-			panic("input file unexpected shape")
+			return fmt.Errorf("line %d: no ':' between key and value", line)
 		}
 		put(k, v)
 	}
+	return s.Err()
 }
 
 func createInMemoryTable(testDataPath string) map[string]string {
@@ -76,13 +286,8 @@ func createInMemoryTable(testDataPath string) map[string]string {
 	return data
 }
 
-func createEntriesTable(testDataPath string) []benchEntry {
-	data := make(map[string]string)
-
-	streamTestFile(testDataPath, func(k, v []byte) {
-		data[string(k)] = string(v)
-	})
-
+// mapEntries returns the entries of data, sharing its strings.
+func mapEntries(data map[string]string) []benchEntry {
 	// we build it this way to ensure the list of entries is randomized and _doesn't_
 	// match the order we wrote entries to the log files for the tables.
 	entries := make([]benchEntry, 0, len(data))
@@ -93,43 +298,48 @@ func createEntriesTable(testDataPath string) []benchEntry {
 	return entries
 }
 
-func createBitTable(testDataPath string) *bit.Table {
-	tableFile, err := os.CreateTemp("", "bit-test.*.data")
-	if err != nil {
-		panic(err)
+// hotEntries returns a random subset of entries holding the given fraction
+// of them (but at least one), reordering entries in the process.
+func hotEntries(entries []benchEntry, fraction float64) []benchEntry {
+	if !(fraction > 0 && fraction <= 1) {
+		panic(fmt.Sprintf("hot set fraction %v not in (0, 1]", fraction))
 	}
-	defer func() {
-		_ = os.Remove(tableFile.Name())
-		_ = os.Remove(tableFile.Name() + ".index")
-	}()
-	if err = tableFile.Close(); err != nil {
-		panic(err)
+	n := int(fraction * float64(len(entries)))
+	if n < 1 {
+		n = 1
 	}
-	if err = os.Remove(tableFile.Name()); err != nil {
-		panic(err)
+	if n >= len(entries) {
+		return entries
 	}
+	rand.Shuffle(len(entries), func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+	return entries[:n:n]
+}
 
-	builder, err := bit.NewBuilder(tableFile.Name())
+// loadBitBenchTable opens the bit table for the testdata from -tabledir,
+// building it there first if need be, or builds a temporary one if
+// -tabledir isn't set.
+func loadBitBenchTable() *bit.Table {
+	dir, err := cachedTableDir("bit", func(dir string) error {
+		buildBitTable(testData, filepath.Join(dir, "table"))
+		return nil
+	})
 	if err != nil {
 		panic(err)
 	}
-
-	streamTestFile(testDataPath, func(k, v []byte) {
-		if err := builder.Put(k, v); err != nil {
-			panic(err)
-		}
-	})
-
-	table, err := builder.Finalize()
+	if dir == "" {
+		return createBitTable(testData)
+	}
+	table, err := bit.New(filepath.Join(dir, "table"))
 	if err != nil {
 		panic(err)
 	}
-
 	return table
 }
 
-func createSparkeyTable(testDataPath string, compressedWithSnappy bool) *sparkey.HashReader {
-	tableFile, err := os.CreateTemp("", "bit-test.*.data")
+func createBitTable(testDataPath string) *bit.Table {
+	tableFile, err := newTableFile("bit-test.*.data")
 	if err != nil {
 		panic(err)
 	}
@@ -144,11 +354,13 @@ func createSparkeyTable(testDataPath string, compressedWithSnappy bool) *sparkey
 		panic(err)
 	}
 
-	var opts *sparkey.Options
-	if compressedWithSnappy {
-		opts.Compression = sparkey.COMPRESSION_SNAPPY
-	}
-	builder, err := sparkey.CreateLogWriter(tableFile.Name(), opts)
+	return buildBitTable(testDataPath, tableFile.Name())
+}
+
+// buildBitTable builds a bit table at tablePath from the test data, leaving
+// the files in place.
+func buildBitTable(testDataPath, tablePath string) *bit.Table {
+	builder, err := bit.NewBuilder(tablePath)
 	if err != nil {
 		panic(err)
 	}
@@ -159,230 +371,321 @@ func createSparkeyTable(testDataPath string, compressedWithSnappy bool) *sparkey
 		}
 	})
 
-	if err := builder.Flush(); err != nil {
+	table, err := builder.Finalize()
+	if err != nil {
 		panic(err)
 	}
-	if err := builder.WriteHashFile(sparkey.HASH_SIZE_AUTO); err != nil {
-		panic(err)
+
+	return table
+}
+
+// cdbMaxShards bounds how many files createCdbTable will split a dataset
+// across before giving up on cdb for it.
+const cdbMaxShards = 256
+
+// cdbTable is one or more cdb files with keys hash-partitioned between them.
+// Each cdb file uses 32-bit offsets and so tops out at 4 GB; larger datasets
+// are sharded rather than failing the build.
+type cdbTable struct {
+	shards []*cdb.CDB
+}
+
+func (t *cdbTable) Get(key []byte) ([]byte, error) {
+	if len(t.shards) == 1 {
+		return t.shards[0].Get(key)
 	}
-	if err := builder.Close(); err != nil {
-		panic(err)
+	return t.shards[cdbShard(key, len(t.shards))].Get(key)
+}
+
+func (t *cdbTable) Close() error {
+	var firstErr error
+	for _, shard := range t.shards {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
+	return firstErr
+}
+
+// cdbShard uses a different hash than cdb does internally, so keys that land
+// in the same shard are still spread evenly across that shard's hash tables.
+func cdbShard(key []byte, n int) int {
+	return int(farm.Hash64(key) % uint64(n))
+}
 
-	table, err := sparkey.Open(tableFile.Name())
+// loadCdbBenchTable is loadBitBenchTable for cdb.
+func loadCdbBenchTable() (*cdbTable, error) {
+	dir, err := cachedTableDir("cdb", buildCachedCdbTable)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if dir == "" {
+		return createCdbTable(testData)
 	}
+	return openCdbTable(dir)
+}
 
-	return table
+// buildCachedCdbTable builds the cdb table -tabledir keeps in dir.
+func buildCachedCdbTable(dir string) error {
+	table, err := buildCdbTable(testData, dir)
+	if err != nil {
+		return err
+	}
+	return table.Close()
 }
 
-func createCdbTable(testDataPath string) *cdb.CDB {
-	tableFile, err := os.CreateTemp("", "bit-test.*.data")
+// openCdbTable opens the shards buildCdbTable left in dir.
+func openCdbTable(dir string) (*cdbTable, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.cdb"))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer func() {
-		_ = os.Remove(tableFile.Name())
-		_ = os.Remove(tableFile.Name() + ".index")
-	}()
-	if err = tableFile.Close(); err != nil {
-		panic(err)
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no cdb shards in %s", dir)
 	}
-	if err = os.Remove(tableFile.Name()); err != nil {
-		panic(err)
+	// the names are zero-padded, so this is shard order.
+	sort.Strings(paths)
+	table := &cdbTable{shards: make([]*cdb.CDB, len(paths))}
+	for i, path := range paths {
+		if table.shards[i], err = cdb.Open(path); err != nil {
+			_ = table.Close()
+			return nil, err
+		}
 	}
+	return table, nil
+}
 
-	builder, err := cdb.Create(tableFile.Name())
-	if err != nil {
-		panic(err)
+// createCdbTable builds a cdb table for the test data, sharding it across as
+// many files as it takes to stay under cdb's size limit.  It returns an error
+// (wrapping cdb.ErrTooMuchData) only if even cdbMaxShards files aren't enough.
+func createCdbTable(testDataPath string) (*cdbTable, error) {
+	return buildCdbTable(testDataPath, "")
+}
+
+// buildCdbTable is createCdbTable, leaving the shards in dir rather than in
+// temporary files if dir isn't empty.
+func buildCdbTable(testDataPath, dir string) (*cdbTable, error) {
+	// cdb stores each entry with more overhead than a line of the text
+	// fixture has, so this is a lower bound on the number of shards needed.
+	shards := int(testDataSize(testDataPath)/math.MaxUint32) + 1
+	for ; shards <= cdbMaxShards; shards *= 2 {
+		table, err := createShardedCdbTable(testDataPath, dir, shards)
+		if errors.Is(err, cdb.ErrTooMuchData) {
+			continue
+		}
+		return table, err
 	}
+	return nil, fmt.Errorf("%s doesn't fit in %d cdb files: %w", testDataPath, cdbMaxShards, cdb.ErrTooMuchData)
+}
 
-	streamTestFile(testDataPath, func(k, v []byte) {
-		if err := builder.Put(k, v); err != nil {
+func createShardedCdbTable(testDataPath, dir string, shards int) (*cdbTable, error) {
+	builders := make([]*cdb.Writer, shards)
+	for i := range builders {
+		if dir != "" {
+			var err error
+			builders[i], err = cdb.Create(filepath.Join(dir, fmt.Sprintf("%03d.cdb", i)))
+			if err != nil {
+				panic(err)
+			}
+			continue
+		}
+		tableFile, err := newTableFile("bit-test.*.data")
+		if err != nil {
+			panic(err)
+		}
+		defer func() {
+			_ = os.Remove(tableFile.Name())
+			_ = os.Remove(tableFile.Name() + ".index")
+		}()
+		if err = tableFile.Close(); err != nil {
+			panic(err)
+		}
+		if err = os.Remove(tableFile.Name()); err != nil {
+			panic(err)
+		}
+
+		builders[i], err = cdb.Create(tableFile.Name())
+		if err != nil {
 			panic(err)
 		}
+	}
+
+	var putErr error
+	streamTestFile(testDataPath, func(k, v []byte) {
+		if putErr != nil {
+			return
+		}
+		i := 0
+		if shards > 1 {
+			i = cdbShard(k, shards)
+		}
+		putErr = builders[i].Put(k, v)
 	})
+	if putErr != nil {
+		if !errors.Is(putErr, cdb.ErrTooMuchData) {
+			panic(putErr)
+		}
+		for _, builder := range builders {
+			_ = builder.Close()
+		}
+		return nil, putErr
+	}
 
-	table, err := builder.Freeze()
-	if err != nil {
-		panic(err)
+	table := &cdbTable{shards: make([]*cdb.CDB, shards)}
+	for i, builder := range builders {
+		shard, err := builder.Freeze()
+		if err != nil {
+			panic(err)
+		}
+		table.shards[i] = shard
 	}
 
-	return table
+	return table, nil
 }
 
 func BenchmarkBitGet(b *testing.B) {
-	benchTableOnce.Do(loadBenchTable)
+	loadBenchTables(b)
+	prewarm(b)
 
 	b.ReportAllocs()
 	b.ResetTimer()
-	b.RunParallel(func(b *testing.PB) {
+	faults := startPageFaults()
+	runParallel(b, "bit", func(b *testing.PB) {
+		defer pinWorker()()
 		entryCount := len(benchEntries)
 		i := rand.Int() % entryCount
 		for b.Next() {
 			entry := benchEntries[i]
 			value, ok := benchTableBit.GetString(entry.Key)
-			if !ok || string(value) != entry.Value {
+			if !entry.matches(value, ok) {
 				panic("bad data or lookup")
 			}
 			i = (i + 1) % entryCount
 		}
 	})
+	reportGetThroughput(b)
+	faults.report(b)
 }
 
 func BenchmarkMapGet(b *testing.B) {
-	benchTableOnce.Do(loadBenchTable)
+	loadBenchTables(b)
+	prewarm(b)
 
 	b.ReportAllocs()
 	b.ResetTimer()
-	b.RunParallel(func(b *testing.PB) {
+	faults := startPageFaults()
+	runParallel(b, "map", func(b *testing.PB) {
+		defer pinWorker()()
 		entryCount := len(benchEntries)
 		i := rand.Int() % entryCount
 		for b.Next() {
 			entry := benchEntries[i]
 			value, ok := benchHashmap[entry.Key]
-			if !ok || value != entry.Value {
+			if !entry.matches(zerocopy.Bytes(value), ok) {
 				panic("bad data or lookup")
 			}
 			i = (i + 1) % entryCount
 		}
 	})
+	reportGetThroughput(b)
+	faults.report(b)
 }
 
-//func BenchmarkSparkeySnappyGet(b *testing.B) {
-//	benchTableOnce.Do(loadBenchTable)
-//
-//	b.ReportAllocs()
-//	b.ResetTimer()
-//	b.RunParallel(func(b *testing.PB) {
-//		iter, err := benchTableSparkeySnappy.Iterator()
-//		if err != nil {
-//			panic(err)
-//		}
-//
-//		entryCount := len(benchEntries)
-//		i := rand.Int() % entryCount
-//		for b.Next() {
-//			entry := benchEntries[i]
-//			value, err := iter.Get(toBytes(entry.Key))
-//			if err != nil || string(value) != entry.Value {
-//				panic("bad data or lookup")
-//			}
-//
-//			i = (i + 1) % entryCount
-//		}
-//	})
-//}
-
-func BenchmarkSparkeyUncompressedGet(b *testing.B) {
-	benchTableOnce.Do(loadBenchTable)
+// BenchmarkMapGetSerial is the single-goroutine counterpart to
+// BenchmarkMapGet, for comparison with BenchmarkSyncMapGetSerial.
+func BenchmarkMapGetSerial(b *testing.B) {
+	loadBenchTables(b)
+	prewarm(b)
 
 	b.ReportAllocs()
 	b.ResetTimer()
-	b.RunParallel(func(b *testing.PB) {
-		iter, err := benchTableSparkeyUncompressed.Iterator()
-		if err != nil {
-			panic(err)
-		}
-
+	faults := startPageFaults()
+	runPhase(b, "map", "benchmark", func() {
 		entryCount := len(benchEntries)
-		i := rand.Int() % entryCount
-		for b.Next() {
-			entry := benchEntries[i]
-			value, err := iter.Get(toBytes(entry.Key))
-			if err != nil || string(value) != entry.Value {
-				panic("bad data or lookup")
+		j := rand.Int() % entryCount
+		for i := 0; i < b.N; i++ {
+			entry := benchEntries[j]
+			value, ok := benchHashmap[entry.Key]
+			if !entry.matches(zerocopy.Bytes(value), ok) {
+				b.Fatal("bad data or lookup")
 			}
-
-			i = (i + 1) % entryCount
+			j = (j + 1) % entryCount
 		}
 	})
+	reportGetThroughput(b)
+	faults.report(b)
 }
 
 func BenchmarkCdbGet(b *testing.B) {
-	benchTableOnce.Do(loadBenchTable)
+	loadBenchTables(b)
+	if benchTableCdbErr != nil {
+		b.Skip(benchTableCdbErr)
+	}
+	prewarm(b)
 
 	b.ReportAllocs()
 	b.ResetTimer()
-	b.RunParallel(func(b *testing.PB) {
+	faults := startPageFaults()
+	runParallel(b, "cdb", func(b *testing.PB) {
+		defer pinWorker()()
 		entryCount := len(benchEntries)
 		i := rand.Int() % entryCount
 		for b.Next() {
 			entry := benchEntries[i]
-			value, err := benchTableCdb.Get(toBytes(entry.Key))
-			if err != nil || string(value) != entry.Value {
+			value, err := benchTableCdb.Get(zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, err == nil && value != nil) {
 				panic("bad data or lookup")
 			}
 			i = (i + 1) % entryCount
 		}
 	})
-}
-
-// toBytes returns a byte slice aliasing to the contents of the input string.
-// Many hash functions are written to take []byte as input -- this lets us
-// provide an API that takes a string and use those hash functions without a
-// temporary allocation (and the garbage and copying string contents an allocation
-// implies).
-//
-// SAFETY: the returned byte slice MUST NOT be written to, only read.
-func toBytes(s string) (b []byte) {
-	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
-	sh := *(*reflect.StringHeader)(unsafe.Pointer(&s))
-	bh.Data = sh.Data
-	bh.Len = sh.Len
-	bh.Cap = sh.Len
-	return b
+	b.ReportMetric(float64(len(benchTableCdb.shards)), "shards")
+	reportGetThroughput(b)
+	faults.report(b)
 }
 
 var (
-	benchTableBitCreate     *bit.Table
-	benchTableSparkeyCreate *sparkey.HashReader
-	benchTableCdbCreate     *cdb.CDB
+	benchTableBitCreate *bit.Table
+	benchTableCdbCreate *cdbTable
 )
 
 func BenchmarkBitCreate(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
 	for i := 0; i < b.N; i++ {
-		benchTableBitCreate = createBitTable(testData)
+		benchTableBitCreate = buildTable(b, "bit", createBitTable, testData)
 		if benchTableBitCreate == nil {
 			b.Fatal("bad data or lookup")
 		}
 	}
+	mem.report(b)
+	faults.report(b)
 }
 
-func BenchmarkSparkeyCreateUncompressed(b *testing.B) {
-	b.ReportAllocs()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		benchTableSparkeyCreate = createSparkeyTable(testData, false)
-		if benchTableSparkeyCreate == nil {
-			b.Fatal("bad data or lookup")
-		}
-	}
-}
-
-//func BenchmarkSparkeyCreateSnappy(b *testing.B) {
-//	b.ReportAllocs()
-//	b.ResetTimer()
-//	for i := 0; i < b.N; i++ {
-//		benchTableSparkeyCreate = createSparkeyTable(testData, true)
-//		if benchTableSparkeyCreate == nil {
-//			b.Fatal("bad data or lookup")
-//		}
-//	}
-//}
-
 func BenchmarkCdbCreate(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
 	for i := 0; i < b.N; i++ {
-		benchTableCdbCreate = createCdbTable(testData)
+		if benchTableCdbCreate != nil {
+			_ = benchTableCdbCreate.Close()
+		}
+		benchTableCdbCreate = buildTable(b, "cdb", func(path string) *cdbTable {
+			table, err := createCdbTable(path)
+			if err != nil {
+				b.Skip(err)
+			}
+			return table
+		}, testData)
 		if benchTableCdbCreate == nil {
 			b.Fatal("bad data or lookup")
 		}
 	}
+	mem.report(b)
+	faults.report(b)
 }
 
 func TestBitTableCreate(t *testing.T) {
@@ -391,3 +694,46 @@ func TestBitTableCreate(t *testing.T) {
 		t.Fatal("expected table to be non-nil")
 	}
 }
+
+func TestCdbShardedTable(t *testing.T) {
+	table, err := createShardedCdbTable(testData, "", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = table.Close()
+	}()
+
+	streamTestFile(testData, func(k, v []byte) {
+		value, err := table.Get(k)
+		if err != nil || !bytes.Equal(value, v) {
+			t.Fatalf("Get(%q) = %q, %v; want %q", k, value, err, v)
+		}
+	})
+}
+
+func TestHotEntries(t *testing.T) {
+	entries := make([]benchEntry, 1000)
+	for i := range entries {
+		entries[i] = benchEntry{Key: fmt.Sprint(i)}
+	}
+
+	hot := hotEntries(append([]benchEntry(nil), entries...), 0.05)
+	if len(hot) != 50 {
+		t.Fatalf("got %d hot entries; want 50", len(hot))
+	}
+	seen := make(map[string]bool)
+	for _, entry := range hot {
+		if seen[entry.Key] {
+			t.Fatalf("%q chosen twice", entry.Key)
+		}
+		seen[entry.Key] = true
+	}
+
+	if hot := hotEntries(entries[:10], 0.01); len(hot) != 1 {
+		t.Fatalf("got %d hot entries; want 1", len(hot))
+	}
+	if hot := hotEntries(entries, 1); len(hot) != len(entries) {
+		t.Fatalf("got %d hot entries; want all %d", len(hot), len(entries))
+	}
+}
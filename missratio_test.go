@@ -0,0 +1,133 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Serving traffic always asks for some keys that aren't there, and a miss
+// can cost a backend more than a hit (an LSM tree checking every level) or
+// far less (a bloom filter, or a perfect hash's fingerprint).  -missratio
+// mixes absent keys into benchEntries, so every lookup benchmark's probes
+// are that blend, as capacity planning needs them to be.  Each absent key
+// is a real one with its last byte changed, so it lands among the real
+// keys rather than off to one side of them.
+var missRatio = 0.0
+
+func init() {
+	flag.Float64Var(&missRatio, "missratio", missRatio, "make this `fraction` of the benchmarks' lookups ones of absent keys")
+}
+
+// matches reports whether a lookup of e's key that found value, if found
+// is set, got the right answer.
+func (e benchEntry) matches(value []byte, found bool) bool {
+	if e.Absent {
+		return !found
+	}
+	return found && string(value) == e.Value
+}
+
+// withMisses returns entries with absent keys interleaved among them, in
+// their order, making up about ratio of the result.  exists reports
+// whether a key is in the tables.
+func withMisses(entries []benchEntry, ratio float64, exists func(key string) bool) []benchEntry {
+	if !(ratio >= 0 && ratio < 1) {
+		panic(fmt.Sprintf("miss ratio %v not in [0, 1)", ratio))
+	}
+	if ratio == 0 {
+		return entries
+	}
+	r := rand.New(rand.NewSource(1))
+	mixed := make([]benchEntry, 0, int(float64(len(entries))/(1-ratio))+1)
+	for _, entry := range entries {
+		// a geometric number of misses before each hit, which on
+		// average makes ratio of the whole misses.
+		for r.Float64() < ratio {
+			mixed = append(mixed, benchEntry{Key: absentKey(entry.Key, len(mixed), exists), Absent: true})
+		}
+		mixed = append(mixed, entry)
+	}
+	return mixed
+}
+
+// absentKey returns key with its last byte changed, or if that's a key too,
+// a key numbered n that no generated or fetched testdata has.
+func absentKey(key string, n int, exists func(key string) bool) string {
+	if key != "" {
+		near := key[:len(key)-1] + string([]byte{key[len(key)-1] ^ 1})
+		if !exists(near) {
+			return near
+		}
+	}
+	return fmt.Sprintf("\x00absent:%d", n)
+}
+
+// inBenchTable reports whether key is in the benchmarks' tables.
+func inBenchTable(key string) bool {
+	_, ok := benchHashmap[key]
+	return ok
+}
+
+// presentEntries returns the entries that aren't Absent, for the
+// benchmarks that need keys that are there, like updates.
+func presentEntries(entries []benchEntry) []benchEntry {
+	if missRatio == 0 {
+		return entries
+	}
+	present := make([]benchEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Absent {
+			present = append(present, entry)
+		}
+	}
+	return present
+}
+
+func TestWithMisses(t *testing.T) {
+	keys := make(map[string]bool)
+	var entries []benchEntry
+	for i := 0; i < 10000; i++ {
+		entry := benchEntry{Key: fmt.Sprintf("key-%d", i), Value: "v"}
+		keys[entry.Key] = true
+		entries = append(entries, entry)
+	}
+	exists := func(key string) bool { return keys[key] }
+
+	mixed := withMisses(entries, 0.2, exists)
+	var present []benchEntry
+	misses := 0
+	for _, entry := range mixed {
+		if !entry.Absent {
+			present = append(present, entry)
+			continue
+		}
+		misses++
+		if exists(entry.Key) {
+			t.Fatalf("absent key %q exists", entry.Key)
+		}
+		if !entry.matches(nil, false) || entry.matches([]byte(""), true) {
+			t.Fatalf("absent entry %q matches wrongly", entry.Key)
+		}
+	}
+	if ratio := float64(misses) / float64(len(mixed)); ratio < 0.18 || ratio > 0.22 {
+		t.Errorf("got a miss ratio of %.3f; want about 0.2", ratio)
+	}
+	for i := range entries {
+		if present[i] != entries[i] {
+			t.Fatalf("entry %d: got %+v; want %+v, in order", i, present[i], entries[i])
+		}
+	}
+	if !entries[0].matches([]byte("v"), true) || entries[0].matches(nil, false) || entries[0].matches([]byte("w"), true) {
+		t.Error("present entry matches wrongly")
+	}
+	// key-1 with its last byte changed is key-0, which exists.
+	if got := absentKey("key-1", 7, exists); got != "\x00absent:7" {
+		t.Errorf("absentKey(key-1) = %q", got)
+	}
+}
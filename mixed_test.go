@@ -0,0 +1,152 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+)
+
+// A store serving reads while it takes writes behaves nothing like one
+// that only serves reads: LSM trees flush and compact, B+trees split and
+// copy pages, and readers contend with writers for locks.  BenchmarkMixed
+// runs a mix of reads and updates from every RunParallel goroutine against
+// each mutable backend (see backend.openMutable), for each -mix read
+// percentage, and reports the reads' latency distribution alongside ns/op.
+// Every read is checked against a shadow copy of what's been written.
+//
+//	go test -run XXX -bench Mixed -backends badger,pebble -mix 99,95,50
+var mixes = flag.String("mix", "95,50", "comma-separated read `percentages` of the mixes BenchmarkMixed runs")
+
+func parseMixes() ([]int, error) {
+	var reads []int
+	for _, field := range strings.Split(*mixes, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 0 || n > 100 {
+			return nil, fmt.Errorf("bad read percentage %q", field)
+		}
+		reads = append(reads, n)
+	}
+	return reads, nil
+}
+
+// mixedShadowStripes is the number of locks guarding the shadow copy.  A
+// read holds its key's lock across the lookup and the check, so that it
+// can't race a write of the same key, but with this many stripes reads and
+// writes of different keys rarely wait on each other.
+const mixedShadowStripes = 1024
+
+// mixedShadow is the value each entry of benchEntries should have, by
+// index, as updated by BenchmarkMixed's writes.
+type mixedShadow struct {
+	stripes [mixedShadowStripes]sync.RWMutex
+	values  []string
+	// present indexes the entries that aren't -missratio's absent keys,
+	// the only ones written so that the miss ratio holds.
+	present []int
+}
+
+func newMixedShadow() *mixedShadow {
+	s := &mixedShadow{values: make([]string, len(benchEntries))}
+	for i, entry := range benchEntries {
+		s.values[i] = entry.Value
+		if !entry.Absent {
+			s.present = append(s.present, i)
+		}
+	}
+	return s
+}
+
+func BenchmarkMixed(b *testing.B) {
+	reads, err := parseMixes()
+	if err != nil {
+		b.Fatal(err)
+	}
+	loadBenchTables(b)
+
+	for _, be := range sortedBackends() {
+		b.Run(be.name, func(b *testing.B) {
+			be.skipIfUnavailable(b)
+			if be.openMutable == nil {
+				b.Skipf("%s is build-only: it's rebuilt to change it, as its Create benchmark times", be.name)
+			}
+			table := buildTable(b, be.name, be.openMutable, testData)
+			defer table.close()
+			prewarmTable(b, table)
+			shadow := newMixedShadow()
+
+			for _, readPct := range reads {
+				b.Run(fmt.Sprintf("reads=%d%%", readPct), func(b *testing.B) {
+					benchmarkMixed(b, be.name, table, shadow, readPct)
+				})
+			}
+		})
+	}
+}
+
+func benchmarkMixed(b *testing.B, name string, table backendTable, shadow *mixedShadow, readPct int) {
+	var mu sync.Mutex
+	var latencies []time.Duration
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, name, func(b *testing.PB) {
+		defer pinWorker()()
+		get, releaseReader := table.reader()
+		defer releaseReader()
+		put, releaseWriter := table.newWriter()
+		defer releaseWriter()
+
+		r := rand.New(rand.NewSource(rand.Int63()))
+		var local []time.Duration
+		entryCount := len(benchEntries)
+		for b.Next() {
+			if r.Intn(100) < readPct {
+				i := r.Intn(entryCount)
+				stripe := &shadow.stripes[i%mixedShadowStripes]
+				stripe.RLock()
+				start := time.Now()
+				value, ok := get(benchEntries[i].Key)
+				local = append(local, time.Since(start))
+				if ok == benchEntries[i].Absent || (ok && string(value) != shadow.values[i]) {
+					panic("bad data or lookup")
+				}
+				stripe.RUnlock()
+				continue
+			}
+			i := shadow.present[r.Intn(len(shadow.present))]
+			stripe := &shadow.stripes[i%mixedShadowStripes]
+			// a value from another entry, so it has a realistic
+			// size but does change.
+			value := benchEntries[shadow.present[r.Intn(len(shadow.present))]].Value
+			stripe.Lock()
+			if err := put(zerocopy.Bytes(benchEntries[i].Key), zerocopy.Bytes(value)); err != nil {
+				panic(err)
+			}
+			shadow.values[i] = value
+			stripe.Unlock()
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+	reportThroughput(b, b.N, float64(b.N)*meanValueSize())
+	faults.report(b)
+	if len(latencies) > 0 {
+		p := latencyPercentiles(latencies, 50, 99, 99.9)
+		b.ReportMetric(float64(p[0].Nanoseconds()), "read-p50-ns")
+		b.ReportMetric(float64(p[1].Nanoseconds()), "read-p99-ns")
+		b.ReportMetric(float64(p[2].Nanoseconds()), "read-p999-ns")
+	}
+}
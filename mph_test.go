@@ -0,0 +1,126 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build mph
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/cespare/mph"
+)
+
+// cespare/mph is pure Go, but it isn't in go.mod yet, so this baseline is
+// opt-in until it is (nomph_test.go stands in for it until then):
+//
+//	go get github.com/cespare/mph@v0.1.0
+//	go test -tags mph -bench=Mph
+
+var (
+	benchTableMphOnce sync.Once
+	benchTableMph     *mphTable
+)
+
+// mphTable is an entirely in-heap minimal perfect hash table.  Like bit's
+// index it maps each key to a dense slot, but the keys and values live in
+// Go slices instead of an mmapped data file.
+type mphTable struct {
+	table  *mph.Table
+	keys   []string
+	values []string
+}
+
+func (t *mphTable) GetString(key string) (string, bool) {
+	i, ok := t.table.Lookup(key)
+	// a minimal perfect hash maps keys that weren't in the build set to
+	// arbitrary slots, so (like bit) we have to check the stored key.
+	if !ok || t.keys[i] != key {
+		return "", false
+	}
+	return t.values[i], true
+}
+
+func init() {
+	registerBackend(backend{
+		name: "mph",
+		open: func(path string) backendTable {
+			return backendTable{
+				newReader: sharedReader(stringLookup(createMphTable(path).GetString)),
+				close:     noClose,
+			}
+		},
+		duplicates: duplicatesHang,
+		benchTable: func() backendTable {
+			benchTableMphOnce.Do(loadMphBenchTable)
+			return backendTable{
+				newReader: sharedReader(stringLookup(benchTableMph.GetString)),
+				close:     noClose,
+			}
+		},
+	})
+}
+
+func loadMphBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableMph = createMphTable(testData)
+}
+
+func createMphTable(testDataPath string) *mphTable {
+	var keys, values []string
+	streamTestFile(testDataPath, func(k, v []byte) {
+		keys = append(keys, string(k))
+		values = append(values, string(v))
+	})
+
+	return &mphTable{
+		table:  mph.Build(keys),
+		keys:   keys,
+		values: values,
+	}
+}
+
+func BenchmarkMphGet(b *testing.B) {
+	loadTable(b, "mph", &benchTableMphOnce, loadMphBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "mph", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := benchTableMph.GetString(entry.Key)
+			if !entry.matches(zerocopy.Bytes(value), ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableMphCreate *mphTable
+
+func BenchmarkMphCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		benchTableMphCreate = buildTable(b, "mph", createMphTable, testData)
+		if benchTableMphCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
@@ -0,0 +1,315 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bpowers/bit"
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/colinmarc/cdb"
+)
+
+// On-disk tables can be opened by any number of processes at once, all
+// sharing one copy of the data in the page cache, where an in-heap map has
+// to be rebuilt (and held) by each.  BenchmarkMultiProcessGet measures the
+// aggregate lookup throughput of several processes reading the same table
+// file: the test binary re-runs itself as children, selected by the
+// environment variables below, which open the table, wait until they are
+// all ready, and then each do their share of b.N lookups.
+const (
+	multiProcessFormatEnv = "BIT_BENCHMARK_CHILD_FORMAT"
+	multiProcessTableEnv  = "BIT_BENCHMARK_CHILD_TABLE"
+	multiProcessProbesEnv = "BIT_BENCHMARK_CHILD_PROBES"
+	multiProcessMissEnv   = "BIT_BENCHMARK_CHILD_MISSRATIO"
+)
+
+// multiProcessCounts are the numbers of processes BenchmarkMultiProcessGet
+// is run with.
+var multiProcessCounts = []int{1, 2, 4, 8}
+
+// multiProcessProbes is how many of the test entries are handed to each
+// child to look up.  Every child loading all of them would put far more
+// in each child's heap than the table itself does.
+const multiProcessProbes = 100000
+
+// sharedFormat is a table format that can be built to a file and then
+// opened independently by other processes.
+type sharedFormat struct {
+	name  string
+	build func(testDataPath, tablePath string) error
+	// open returns a lookup function for the table; like the Get
+	// benchmarks, it hands back values without copying where it can.
+	open func(tablePath string) func(key string) ([]byte, bool)
+}
+
+var sharedFormats = []sharedFormat{
+	{
+		name: "bit",
+		build: func(testDataPath, tablePath string) error {
+			buildBitTable(testDataPath, tablePath)
+			return nil
+		},
+		open: func(tablePath string) func(key string) ([]byte, bool) {
+			table, err := bit.New(tablePath)
+			if err != nil {
+				panic(err)
+			}
+			return table.GetString
+		},
+	},
+	{
+		// a single file, so datasets past cdb's 4 GB limit are skipped
+		// rather than sharded.
+		name: "cdb",
+		build: func(testDataPath, tablePath string) error {
+			builder, err := cdb.Create(tablePath)
+			if err != nil {
+				panic(err)
+			}
+			var putErr error
+			streamTestFile(testDataPath, func(k, v []byte) {
+				if putErr == nil {
+					putErr = builder.Put(k, v)
+				}
+			})
+			if putErr != nil {
+				_ = builder.Close()
+				return putErr
+			}
+			return builder.Close()
+		},
+		open: func(tablePath string) func(key string) ([]byte, bool) {
+			table, err := cdb.Open(tablePath)
+			if err != nil {
+				panic(err)
+			}
+			return func(key string) ([]byte, bool) {
+				value, err := table.Get(zerocopy.Bytes(key))
+				return value, err == nil && value != nil
+			}
+		},
+	},
+}
+
+// multiProcessTables are the files the children of BenchmarkMultiProcessGet
+// open, built the first time it runs and removed when the test binary
+// exits.
+var multiProcessTables struct {
+	once   sync.Once
+	dir    string
+	probes string
+	paths  map[string]string
+	errs   map[string]error
+}
+
+func loadMultiProcessTables() {
+	benchTableOnce.Do(loadBenchTable)
+
+	dir, err := newTableDir("bit-test.*.shared")
+	if err != nil {
+		panic(err)
+	}
+	multiProcessTables.dir = dir
+	multiProcessTables.paths = make(map[string]string)
+	multiProcessTables.errs = make(map[string]error)
+
+	// benchEntries is already in random order.  The children mix their
+	// own misses back in, as a testdata file can't mark keys absent.
+	probes := presentEntries(benchEntries)
+	if len(probes) > multiProcessProbes {
+		probes = probes[:multiProcessProbes]
+	}
+	multiProcessTables.probes = filepath.Join(dir, "probes")
+	w, err := newBinaryTestDataWriter(multiProcessTables.probes)
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range probes {
+		if err := w.Put(zerocopy.Bytes(entry.Key), zerocopy.Bytes(entry.Value)); err != nil {
+			panic(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+
+	for _, format := range sharedFormats {
+		path := filepath.Join(dir, format.name)
+		multiProcessTables.paths[format.name] = path
+		multiProcessTables.errs[format.name] = format.build(testData, path)
+	}
+}
+
+// removeMultiProcessTables removes the files loadMultiProcessTables built.
+func removeMultiProcessTables() {
+	if multiProcessTables.dir != "" {
+		_ = os.RemoveAll(multiProcessTables.dir)
+	}
+}
+
+// multiProcessChild is the parent's handle on one child process.
+type multiProcessChild struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Scanner
+}
+
+func startMultiProcessChild(format string) (*multiProcessChild, error) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMultiProcessChild$")
+	cmd.Env = append(os.Environ(),
+		multiProcessFormatEnv+"="+format,
+		multiProcessTableEnv+"="+multiProcessTables.paths[format],
+		multiProcessProbesEnv+"="+multiProcessTables.probes,
+		multiProcessMissEnv+"="+strconv.FormatFloat(missRatio, 'g', -1, 64),
+	)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &multiProcessChild{cmd: cmd, in: in, out: bufio.NewScanner(out)}, nil
+}
+
+// await waits for the child to print line, which it does once it has
+// finished each step.
+func (c *multiProcessChild) await(line string) error {
+	for c.out.Scan() {
+		if c.out.Text() == line {
+			return nil
+		}
+	}
+	if err := c.out.Err(); err != nil {
+		return err
+	}
+	return errors.New("child exited before printing " + line)
+}
+
+// stop ends the child once tb is done with it.
+func (c *multiProcessChild) stop(tb testing.TB) {
+	_ = c.in.Close()
+	// a child tb failed waiting on, say one that's hung, mightn't exit
+	// on its own.
+	if tb.Failed() {
+		_ = c.cmd.Process.Kill()
+	}
+	_ = c.cmd.Wait()
+}
+
+func BenchmarkMultiProcessGet(b *testing.B) {
+	loadTable(b, "multiprocess", &multiProcessTables.once, loadMultiProcessTables)
+
+	for _, format := range sharedFormats {
+		for _, procs := range multiProcessCounts {
+			b.Run(fmt.Sprintf("%s/procs=%d", format.name, procs), func(b *testing.B) {
+				if err := multiProcessTables.errs[format.name]; err != nil {
+					b.Skip(err)
+				}
+
+				children := make([]*multiProcessChild, procs)
+				for i := range children {
+					child, err := startMultiProcessChild(format.name)
+					if err != nil {
+						b.Fatal(err)
+					}
+					defer child.stop(b)
+					children[i] = child
+				}
+				runPhase(b, format.name, "build", func() {
+					for _, child := range children {
+						if err := child.await("ready"); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+
+				b.ResetTimer()
+				start := time.Now()
+				for i, child := range children {
+					n := b.N / procs
+					if i < b.N%procs {
+						n++
+					}
+					if _, err := fmt.Fprintln(child.in, n); err != nil {
+						b.Fatal(err)
+					}
+				}
+				runPhase(b, format.name, "benchmark", func() {
+					for _, child := range children {
+						if err := child.await("done"); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+				elapsed := time.Since(start)
+				b.StopTimer()
+				b.ReportMetric(float64(b.N)/elapsed.Seconds(), "lookups/s")
+			})
+		}
+	}
+}
+
+// TestMultiProcessChild is the child side of BenchmarkMultiProcessGet.
+func TestMultiProcessChild(t *testing.T) {
+	name := os.Getenv(multiProcessFormatEnv)
+	if name == "" {
+		t.Skip("only run as a child of BenchmarkMultiProcessGet")
+	}
+	var format *sharedFormat
+	for i := range sharedFormats {
+		if sharedFormats[i].name == name {
+			format = &sharedFormats[i]
+		}
+	}
+	if format == nil {
+		t.Fatalf("unknown format %q", name)
+	}
+
+	ratio, err := strconv.ParseFloat(os.Getenv(multiProcessMissEnv), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := format.open(os.Getenv(multiProcessTableEnv))
+	var probes []benchEntry
+	streamTestFile(os.Getenv(multiProcessProbesEnv), func(k, v []byte) {
+		probes = append(probes, benchEntry{Key: string(k), Value: string(v)})
+	})
+	probes = withMisses(probes, ratio, func(key string) bool {
+		_, ok := get(key)
+		return ok
+	})
+	fmt.Println("ready")
+
+	var n int
+	if _, err := fmt.Fscanln(os.Stdin, &n); err != nil {
+		t.Fatal(err)
+	}
+	i := os.Getpid() % len(probes)
+	for ; n > 0; n-- {
+		entry := probes[i]
+		if value, ok := get(entry.Key); !entry.matches(value, ok) {
+			panic("bad data or lookup")
+		}
+		i = (i + 1) % len(probes)
+	}
+	fmt.Println("done")
+}
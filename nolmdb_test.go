@@ -0,0 +1,25 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !lmdb
+
+package bitbenchmark
+
+import "testing"
+
+// lmdbUnavailable is why the lmdb benchmarks are skipped in builds
+// without the lmdb tag; see lmdb_test.go.
+const lmdbUnavailable = "lmdb needs the cgo lmdb-go bindings; go get github.com/bmatsuo/lmdb-go@v1.8.0 and build with -tags lmdb"
+
+func init() {
+	registerUnavailableBackend("lmdb", lmdbUnavailable)
+}
+
+func BenchmarkLmdbGet(b *testing.B) {
+	b.Skip(lmdbUnavailable)
+}
+
+func BenchmarkLmdbCreate(b *testing.B) {
+	b.Skip(lmdbUnavailable)
+}
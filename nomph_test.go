@@ -0,0 +1,25 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !mph
+
+package bitbenchmark
+
+import "testing"
+
+// mphUnavailable is why the mph benchmarks are skipped in builds without
+// the mph tag; see mph_test.go.
+const mphUnavailable = "mph needs github.com/cespare/mph, which go.mod doesn't require yet; go get it and build with -tags mph"
+
+func init() {
+	registerUnavailableBackend("mph", mphUnavailable)
+}
+
+func BenchmarkMphGet(b *testing.B) {
+	b.Skip(mphUnavailable)
+}
+
+func BenchmarkMphCreate(b *testing.B) {
+	b.Skip(mphUnavailable)
+}
@@ -0,0 +1,25 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !pogreb
+
+package bitbenchmark
+
+import "testing"
+
+// pogrebUnavailable is why the pogreb benchmarks are skipped in builds
+// without the pogreb tag; see pogreb_test.go.
+const pogrebUnavailable = "pogreb needs github.com/akrylysov/pogreb, which go.mod doesn't require yet; go get it and build with -tags pogreb"
+
+func init() {
+	registerUnavailableBackend("pogreb", pogrebUnavailable)
+}
+
+func BenchmarkPogrebGet(b *testing.B) {
+	b.Skip(pogrebUnavailable)
+}
+
+func BenchmarkPogrebCreate(b *testing.B) {
+	b.Skip(pogrebUnavailable)
+}
@@ -0,0 +1,11 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !race
+
+package bitbenchmark
+
+// raceEnabled reports whether the tests were built with -race; see
+// race_test.go.
+const raceEnabled = false
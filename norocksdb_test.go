@@ -0,0 +1,25 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !rocksdb
+
+package bitbenchmark
+
+import "testing"
+
+// rocksdbUnavailable is why the rocksdb benchmarks are skipped in builds
+// without the rocksdb tag; see rocksdb_test.go.
+const rocksdbUnavailable = "rocksdb needs librocksdb; build with -tags rocksdb"
+
+func init() {
+	registerUnavailableBackend("rocksdb", rocksdbUnavailable)
+}
+
+func BenchmarkRocksdbGet(b *testing.B) {
+	b.Skip(rocksdbUnavailable)
+}
+
+func BenchmarkRocksdbCreate(b *testing.B) {
+	b.Skip(rocksdbUnavailable)
+}
@@ -0,0 +1,33 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !sparkey
+
+package bitbenchmark
+
+import "testing"
+
+// sparkeyUnavailable is why the sparkey benchmarks are skipped in builds
+// without the sparkey tag; see sparkey_test.go.
+const sparkeyUnavailable = "sparkey needs libsparkey; build with -tags sparkey"
+
+func init() {
+	registerUnavailableBackend("sparkey", sparkeyUnavailable)
+}
+
+func BenchmarkSparkeyUncompressedGet(b *testing.B) {
+	b.Skip(sparkeyUnavailable)
+}
+
+func BenchmarkSparkeySnappyGet(b *testing.B) {
+	b.Skip(sparkeyUnavailable)
+}
+
+func BenchmarkSparkeyCreateUncompressed(b *testing.B) {
+	b.Skip(sparkeyUnavailable)
+}
+
+func BenchmarkSparkeyCreateSnappy(b *testing.B) {
+	b.Skip(sparkeyUnavailable)
+}
@@ -0,0 +1,263 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/allegro/bigcache/v3"
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/coocood/freecache"
+)
+
+// These caches keep entries in a handful of large byte slices (or, for
+// fastcache, mmapped chunks) instead of as individual heap objects, so the
+// GC never has to scan them.  They're all lossy, so we size them at a
+// multiple of the fixture size to be sure nothing is evicted while loading.
+const offHeapCacheSizeFactor = 3
+
+var (
+	benchTableFastcacheOnce sync.Once
+	benchTableFastcache     *fastcache.Cache
+
+	benchTableFreecacheOnce sync.Once
+	benchTableFreecache     *freecache.Cache
+
+	benchTableBigcacheOnce sync.Once
+	benchTableBigcache     *bigcache.BigCache
+)
+
+func init() {
+	registerBackend(backend{
+		name: "fastcache",
+		open: func(path string) backendTable {
+			return newFastcacheBackendTable(createFastcacheTable(path))
+		},
+		duplicates: duplicatesLastWins,
+		benchTable: func() backendTable {
+			benchTableFastcacheOnce.Do(loadFastcacheBenchTable)
+			return newFastcacheBackendTable(benchTableFastcache)
+		},
+	})
+	registerBackend(backend{
+		name: "freecache",
+		open: func(path string) backendTable {
+			return newFreecacheBackendTable(createFreecacheTable(path))
+		},
+		duplicates: duplicatesLastWins,
+		benchTable: func() backendTable {
+			benchTableFreecacheOnce.Do(loadFreecacheBenchTable)
+			return newFreecacheBackendTable(benchTableFreecache)
+		},
+	})
+	registerBackend(backend{
+		name: "bigcache",
+		open: func(path string) backendTable {
+			return newBigcacheBackendTable(createBigcacheTable(path))
+		},
+		duplicates:   duplicatesLastWins,
+		lookupAllocs: 2,
+		benchTable: func() backendTable {
+			benchTableBigcacheOnce.Do(loadBigcacheBenchTable)
+			return newBigcacheBackendTable(benchTableBigcache)
+		},
+	})
+}
+
+// newFastcacheBackendTable returns the backendTable reading cache.
+func newFastcacheBackendTable(cache *fastcache.Cache) backendTable {
+	return backendTable{
+		newBytesReader: func() (bytesLookupFunc, func()) {
+			var buf []byte
+			return func(key []byte) ([]byte, bool) {
+				value, ok := cache.HasGet(buf[:0], key)
+				buf = value
+				return value, ok
+			}, noClose
+		},
+		close: cache.Reset,
+	}
+}
+
+// newFreecacheBackendTable returns the backendTable reading cache.
+func newFreecacheBackendTable(cache *freecache.Cache) backendTable {
+	return backendTable{
+		newBytesReader: func() (bytesLookupFunc, func()) {
+			// GetFn's value is only valid inside the callback.
+			var buf []byte
+			return func(key []byte) ([]byte, bool) {
+				err := cache.GetFn(key, func(value []byte) error {
+					buf = append(buf[:0], value...)
+					return nil
+				})
+				return buf, err == nil
+			}, noClose
+		},
+		close: cache.Clear,
+	}
+}
+
+// newBigcacheBackendTable returns the backendTable reading cache.
+func newBigcacheBackendTable(cache *bigcache.BigCache) backendTable {
+	return backendTable{
+		newReader: sharedReader(func(key string) ([]byte, bool) {
+			value, err := cache.Get(key)
+			return value, err == nil
+		}),
+		close: func() { _ = cache.Close() },
+	}
+}
+
+func offHeapCacheSize(testDataPath string) int {
+	return offHeapCacheSizeFactor * int(testDataSize(testDataPath))
+}
+
+func loadFastcacheBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableFastcache = createFastcacheTable(testData)
+}
+
+func createFastcacheTable(testDataPath string) *fastcache.Cache {
+	cache := fastcache.New(offHeapCacheSize(testDataPath))
+
+	streamTestFile(testDataPath, func(k, v []byte) {
+		cache.Set(k, v)
+	})
+
+	return cache
+}
+
+func loadFreecacheBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableFreecache = createFreecacheTable(testData)
+}
+
+func createFreecacheTable(testDataPath string) *freecache.Cache {
+	cache := freecache.NewCache(offHeapCacheSize(testDataPath))
+
+	streamTestFile(testDataPath, func(k, v []byte) {
+		if err := cache.Set(k, v, 0); err != nil {
+			panic(err)
+		}
+	})
+
+	return cache
+}
+
+func loadBigcacheBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableBigcache = createBigcacheTable(testData)
+}
+
+func createBigcacheTable(testDataPath string) *bigcache.BigCache {
+	// bigcache evicts by age rather than (by default) by size, so give
+	// entries a lifetime longer than any benchmark run and never clean up.
+	// A size limit is split evenly across its 1024 shards, which for small
+	// fixtures leaves shards too small to hold their entries, so leave it
+	// unbounded instead.
+	config := bigcache.DefaultConfig(24 * time.Hour)
+	config.CleanWindow = 0
+	config.Verbose = false
+	cache, err := bigcache.New(context.Background(), config)
+	if err != nil {
+		panic(err)
+	}
+
+	streamTestFile(testDataPath, func(k, v []byte) {
+		if err := cache.Set(string(k), v); err != nil {
+			panic(err)
+		}
+	})
+
+	return cache
+}
+
+func BenchmarkFastcacheGet(b *testing.B) {
+	loadTable(b, "fastcache", &benchTableFastcacheOnce, loadFastcacheBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "fastcache", func(b *testing.PB) {
+		defer pinWorker()()
+		// fastcache copies values out into a caller-provided buffer.
+		var buf []byte
+
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := benchTableFastcache.HasGet(buf[:0], zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, ok) {
+				panic("bad data or lookup")
+			}
+			buf = value
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+func BenchmarkFreecacheGet(b *testing.B) {
+	loadTable(b, "freecache", &benchTableFreecacheOnce, loadFreecacheBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "freecache", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			// GetFn hands us the value in place (under the segment lock)
+			// rather than copying it out like Get does.
+			err := benchTableFreecache.GetFn(zerocopy.Bytes(entry.Key), func(value []byte) error {
+				if !entry.matches(value, true) {
+					panic("bad data or lookup")
+				}
+				return nil
+			})
+			if (err == nil) == entry.Absent {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+func BenchmarkBigcacheGet(b *testing.B) {
+	loadTable(b, "bigcache", &benchTableBigcacheOnce, loadBigcacheBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "bigcache", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, err := benchTableBigcache.Get(entry.Key)
+			if !entry.matches(value, err == nil) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
@@ -0,0 +1,19 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build linux
+
+package bitbenchmark
+
+import "golang.org/x/sys/unix"
+
+// readPageFaults returns the minor and major page faults of every thread
+// of this process so far.
+func readPageFaults() (minor, major int64, ok bool) {
+	var usage unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0, false
+	}
+	return usage.Minflt, usage.Majflt, true
+}
@@ -0,0 +1,35 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import "testing"
+
+// Allocation counts say little about the mmap-backed tables, whose lookups
+// cost what they do because of how many pages they touch and whether those
+// were resident.  pageFaults counts the process's page faults over a
+// benchmark, and reports them per op: minor faults are pages that were in
+// the page cache but not yet mapped, major ones had to be read from disk.
+// They're process-wide, so a GC or a table built in the background during
+// the benchmark would be counted too.
+type pageFaults struct {
+	minor, major int64
+	ok           bool
+}
+
+// startPageFaults records the process's page faults so far.
+func startPageFaults() pageFaults {
+	minor, major, ok := readPageFaults()
+	return pageFaults{minor: minor, major: major, ok: ok}
+}
+
+// report reports the faults since f was started, per op of b.
+func (f pageFaults) report(b *testing.B) {
+	minor, major, ok := readPageFaults()
+	if !f.ok || !ok || b.N == 0 {
+		return
+	}
+	b.ReportMetric(float64(minor-f.minor)/float64(b.N), "minor-faults/op")
+	b.ReportMetric(float64(major-f.major)/float64(b.N), "major-faults/op")
+}
@@ -0,0 +1,266 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+	"github.com/cockroachdb/pebble/objstorage/objstorageprovider"
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// pebbleCacheSize is the size of Pebble's block cache.  It is deliberately
+// smaller than the dataset so the benchmark exercises cache misses too;
+// BenchmarkSweepGet tries others.
+const pebbleCacheSize = 64 << 20
+
+var (
+	benchTablePebbleOnce sync.Once
+	benchTablePebble     *pebble.DB
+)
+
+func init() {
+	registerBackend(backend{
+		name: "pebble",
+		open: func(path string) backendTable {
+			db := createPebbleTable(path, pebbleCacheSize)
+			return newPebbleBackendTable(db, func() { _ = db.Close() })
+		},
+		// sstable writers require strictly increasing keys.
+		duplicates:   duplicatesError,
+		lookupAllocs: 1,
+		openMutable: func(path string) backendTable {
+			db, closeTable := createMutablePebbleTable(path)
+			t := newPebbleBackendTable(db, closeTable)
+			t.newWriter = sharedWriter(func(key, value []byte) error {
+				return db.Set(key, value, pebble.NoSync)
+			})
+			return t
+		},
+		tunables: []tunable{
+			{name: "cache", values: []string{"8M", "64M", "512M"}},
+		},
+		openTuned: func(path string, params map[string]string) backendTable {
+			db := createPebbleTable(path, parseTunableSize(params["cache"]))
+			return newPebbleBackendTable(db, func() { _ = db.Close() })
+		},
+		benchTable: func() backendTable {
+			benchTablePebbleOnce.Do(loadPebbleBenchTable)
+			return newPebbleBackendTable(benchTablePebble, noClose)
+		},
+	})
+}
+
+// newPebbleBackendTable returns the backendTable reading db, closed by
+// closeTable.
+func newPebbleBackendTable(db *pebble.DB, closeTable func()) backendTable {
+	return backendTable{
+		newBytesReader: func() (bytesLookupFunc, func()) {
+			// values are only valid until the closer is closed, so
+			// copy them out.
+			var buf []byte
+			return func(key []byte) ([]byte, bool) {
+				value, closer, err := db.Get(key)
+				if err != nil {
+					return nil, false
+				}
+				buf = append(buf[:0], value...)
+				_ = closer.Close()
+				return buf, true
+			}, noClose
+		},
+		close: closeTable,
+	}
+}
+
+func loadPebbleBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTablePebble = createPebbleTable(testData, pebbleCacheSize)
+}
+
+func newPebbleOptions(cache *pebble.Cache) *pebble.Options {
+	opts := &pebble.Options{
+		Cache: cache,
+		Levels: []pebble.LevelOptions{{
+			Compression:  pebble.NoCompression,
+			FilterPolicy: bloom.FilterPolicy(10),
+		}},
+		Logger:        pebbleLogger{},
+		EventListener: &pebble.EventListener{},
+	}
+	return opts.EnsureDefaults()
+}
+
+// pebbleLogger drops pebble's informational logging, which its default
+// logger writes into the benchmark output cmd/bit-benchmark parses.  A
+// fatal error still panics.
+type pebbleLogger struct{}
+
+func (pebbleLogger) Infof(format string, args ...interface{}) {}
+
+func (pebbleLogger) Fatalf(format string, args ...interface{}) {
+	panic(fmt.Sprintf(format, args...))
+}
+
+// createPebbleTable builds a table and opens it read-only with a block
+// cache of cacheSize bytes.
+func createPebbleTable(testDataPath string, cacheSize int64) *pebble.DB {
+	dir, err := newTableDir("bit-test.*.pebble")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	cache := pebble.NewCache(cacheSize)
+	defer cache.Unref()
+	dbPath := buildPebbleTable(testDataPath, dir, cache)
+
+	opts := newPebbleOptions(cache)
+	opts.ReadOnly = true
+	table, err := pebble.Open(dbPath, opts)
+	if err != nil {
+		panic(err)
+	}
+
+	// Pebble opens sstables lazily through its table cache.  A full scan
+	// gets every file open before we unlink the directory, the same as we
+	// do for the other tables.
+	iter, err := table.NewIter(nil)
+	if err != nil {
+		panic(err)
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+	}
+	if err := iter.Close(); err != nil {
+		panic(err)
+	}
+
+	return table
+}
+
+// createMutablePebbleTable builds a table and opens it for writing too,
+// returning it and a function closing it and removing its directory.
+func createMutablePebbleTable(testDataPath string) (*pebble.DB, func()) {
+	dir, err := newTableDir("bit-test.*.pebble")
+	if err != nil {
+		panic(err)
+	}
+	cache := pebble.NewCache(pebbleCacheSize)
+	defer cache.Unref()
+	db, err := pebble.Open(buildPebbleTable(testDataPath, dir, cache), newPebbleOptions(cache))
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		panic(err)
+	}
+	return db, func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// buildPebbleTable builds a database in dir, returning its path.
+func buildPebbleTable(testDataPath, dir string, cache *pebble.Cache) string {
+	// sstables must be written in key order, so (unlike the other builders)
+	// we have to buffer and sort the whole dataset first.
+	var entries []benchEntry
+	streamTestFile(testDataPath, func(k, v []byte) {
+		entries = append(entries, benchEntry{Key: string(k), Value: string(v)})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	opts := newPebbleOptions(cache)
+
+	sstPath := filepath.Join(dir, "bulk.sst")
+	f, err := vfs.Default.Create(sstPath)
+	if err != nil {
+		panic(err)
+	}
+	writerOpts := opts.MakeWriterOptions(0, opts.FormatMajorVersion.MaxTableFormat())
+	writer := sstable.NewWriter(objstorageprovider.NewFileWritable(f), writerOpts)
+	for _, entry := range entries {
+		if err := writer.Set(zerocopy.Bytes(entry.Key), zerocopy.Bytes(entry.Value)); err != nil {
+			panic(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		panic(err)
+	}
+
+	dbPath := filepath.Join(dir, "db")
+	db, err := pebble.Open(dbPath, opts)
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Ingest([]string{sstPath}); err != nil {
+		panic(err)
+	}
+	if err := db.Close(); err != nil {
+		panic(err)
+	}
+	return dbPath
+}
+
+func BenchmarkPebbleGet(b *testing.B) {
+	loadTable(b, "pebble", &benchTablePebbleOnce, loadPebbleBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "pebble", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, closer, err := benchTablePebble.Get(zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, err == nil) {
+				panic("bad data or lookup")
+			}
+			if err == nil {
+				_ = closer.Close()
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTablePebbleCreate *pebble.DB
+
+func BenchmarkPebbleCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		if benchTablePebbleCreate != nil {
+			_ = benchTablePebbleCreate.Close()
+		}
+		benchTablePebbleCreate = buildTable(b, "pebble", func(path string) *pebble.DB {
+			return createPebbleTable(path, pebbleCacheSize)
+		}, testData)
+		if benchTablePebbleCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build linux
+
+package bitbenchmark
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const mpolBind = 2
+
+// execPinned re-runs the test binary with its CPU affinity, and for a NUMA
+// node its memory policy, set to cpus and node.  Both are inherited across
+// exec, and by every thread the new process starts.
+func execPinned(cpus []int, node int) error {
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		return err
+	}
+	if node >= 0 {
+		var nodes [16]uint64
+		if node >= len(nodes)*64 {
+			return unix.EINVAL
+		}
+		nodes[node/64] |= 1 << (node % 64)
+		if _, _, errno := unix.Syscall(unix.SYS_SET_MEMPOLICY, mpolBind, uintptr(unsafe.Pointer(&nodes[0])), uintptr(len(nodes)*64)); errno != 0 {
+			return errno
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return unix.Exec(exe, os.Args, append(os.Environ(), pinnedEnv+"=1"))
+}
+
+var processCPUs struct {
+	once sync.Once
+	cpus []int
+	err  error
+}
+
+// allowedCPUs returns the CPUs the process could run on when it started.
+func allowedCPUs() ([]int, error) {
+	processCPUs.once.Do(func() {
+		var set unix.CPUSet
+		if processCPUs.err = unix.SchedGetaffinity(0, &set); processCPUs.err != nil {
+			return
+		}
+		for cpu := 0; cpu < len(set)*64; cpu++ {
+			if set.IsSet(cpu) {
+				processCPUs.cpus = append(processCPUs.cpus, cpu)
+			}
+		}
+	})
+	return processCPUs.cpus, processCPUs.err
+}
+
+// pinThread locks the calling goroutine to its thread, and the thread to
+// cpu, returning a function restoring the thread's affinity and unlocking
+// it.
+func pinThread(cpu int) (func(), error) {
+	runtime.LockOSThread()
+	var old, set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &old); err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	set.Set(cpu)
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	return func() {
+		_ = unix.SchedSetaffinity(0, &old)
+		runtime.UnlockOSThread()
+	}, nil
+}
+
+func TestPinThread(t *testing.T) {
+	cpus, err := allowedCPUs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := cpus[len(cpus)-1]
+	unpin, err := pinThread(cpu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		t.Fatal(err)
+	}
+	unpin()
+	if set.Count() != 1 || !set.IsSet(cpu) {
+		t.Fatalf("pinned thread's affinity is %d CPUs; want just %d", set.Count(), cpu)
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !linux
+
+package bitbenchmark
+
+import "errors"
+
+var errPinningUnsupported = errors.New("CPU and NUMA pinning are only supported on Linux")
+
+func execPinned(cpus []int, node int) error {
+	return errPinningUnsupported
+}
+
+func allowedCPUs() ([]int, error) {
+	return nil, errPinningUnsupported
+}
+
+func pinThread(cpu int) (func(), error) {
+	return nil, errPinningUnsupported
+}
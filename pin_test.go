@@ -0,0 +1,197 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// On a multi-socket machine the scheduler moves goroutines, and the heap
+// ends up, on whichever socket, and a lookup reaching across to the other
+// socket's memory costs far more than a local one: enough noise to swamp
+// the differences between backends over a large dataset.  -cpuset and
+// -numa pin the test process to some CPUs (and with -numa, its memory to
+// a node) by re-running the test binary with its affinity set, so that
+// every thread the runtime starts inherits it; -pin-workers additionally
+// pins each RunParallel goroutine to one of those CPUs.
+var (
+	cpuSet     string
+	numaNode   = -1
+	pinWorkers bool
+)
+
+// pinnedEnv marks the re-run test binary as already pinned.
+const pinnedEnv = "BIT_BENCHMARK_PINNED"
+
+func init() {
+	flag.StringVar(&cpuSet, "cpuset", cpuSet, "run on only these `cpus`, a list like 0-3,8")
+	flag.IntVar(&numaNode, "numa", numaNode, "run on only the CPUs of, and allocate only from, NUMA `node`")
+	flag.BoolVar(&pinWorkers, "pin-workers", pinWorkers, "pin each RunParallel goroutine to its own CPU")
+}
+
+// applyPinning re-runs the test binary pinned as -cpuset and -numa ask,
+// returning only if there's nothing to do or the binary already has been.
+func applyPinning() error {
+	if os.Getenv(pinnedEnv) != "" || (cpuSet == "" && numaNode < 0) {
+		return nil
+	}
+	var cpus []int
+	if cpuSet != "" {
+		var err error
+		if cpus, err = parseCPUList(cpuSet); err != nil {
+			return fmt.Errorf("-cpuset: %w", err)
+		}
+	}
+	if numaNode >= 0 {
+		nodeCPUs, err := readCPUList(filepath.Join(numaNodeDir(numaNode), "cpulist"))
+		if err != nil {
+			return fmt.Errorf("-numa: %w", err)
+		}
+		if cpus == nil {
+			cpus = nodeCPUs
+		} else {
+			cpus = intersectCPUs(cpus, nodeCPUs)
+		}
+	}
+	if len(cpus) == 0 {
+		return fmt.Errorf("-cpuset %q and -numa %d leave no CPUs", cpuSet, numaNode)
+	}
+	return execPinned(cpus, numaNode)
+}
+
+// reportTopology prints the CPUs the benchmarks can run on, and the NUMA
+// layout, as configuration lines in the benchmark output, alongside the
+// ones go test prints.
+func reportTopology() {
+	cpus, err := allowedCPUs()
+	if err == nil {
+		fmt.Printf("cpuset: %s\n", formatCPUList(cpus))
+	}
+	if nodes, _ := filepath.Glob(filepath.Join(numaNodeDir(0), "..", "node[0-9]*")); len(nodes) > 0 {
+		fmt.Printf("numa-nodes: %d\n", len(nodes))
+	}
+	if numaNode >= 0 {
+		fmt.Printf("numa-node: %d\n", numaNode)
+	}
+	if pinWorkers {
+		fmt.Printf("pin-workers: true\n")
+	}
+}
+
+func numaNodeDir(node int) string {
+	return fmt.Sprintf("/sys/devices/system/node/node%d", node)
+}
+
+// nextWorkerCPU picks the CPUs pinWorker pins goroutines to, round-robin.
+var nextWorkerCPU atomic.Int64
+
+// pinWorker pins the calling goroutine, and the thread it's locked to, to
+// the next of the allowed CPUs if -pin-workers is set, returning a function
+// that undoes it; RunParallel bodies start with defer pinWorker()().
+func pinWorker() func() {
+	if !pinWorkers {
+		return noClose
+	}
+	cpus, err := allowedCPUs()
+	if err != nil {
+		panic(err)
+	}
+	cpu := cpus[int(nextWorkerCPU.Add(1)-1)%len(cpus)]
+	unpin, err := pinThread(cpu)
+	if err != nil {
+		panic(err)
+	}
+	return unpin
+}
+
+// parseCPUList parses the kernel's CPU list format: comma-separated CPUs and
+// ranges of them, like 0-3,8,10-11.
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("bad CPU list %q", s)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("bad CPU list %q", s)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+func readCPUList(path string) ([]int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUList(string(b))
+}
+
+// formatCPUList is the inverse of parseCPUList, for sorted CPUs.
+func formatCPUList(cpus []int) string {
+	var parts []string
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+func intersectCPUs(a, b []int) []int {
+	in := make(map[int]bool, len(b))
+	for _, cpu := range b {
+		in[cpu] = true
+	}
+	var both []int
+	for _, cpu := range a {
+		if in[cpu] {
+			both = append(both, cpu)
+		}
+	}
+	return both
+}
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := parseCPUList("8,0-3,10-11\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := formatCPUList(cpus), "0-3,8,10-11"; got != want {
+		t.Fatalf("got %s; want %s", got, want)
+	}
+	for _, bad := range []string{"a", "3-1", "1-"} {
+		if _, err := parseCPUList(bad); err == nil {
+			t.Errorf("parseCPUList(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build pogreb
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/akrylysov/pogreb"
+	"github.com/akrylysov/pogreb/fs"
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+)
+
+// pogreb is pure Go, but it isn't in go.mod yet, so this backend is
+// opt-in until it is (nopogreb_test.go stands in for it until then):
+//
+//	go get github.com/akrylysov/pogreb@v0.10.2
+//	go test -tags pogreb -bench=Pogreb
+//
+// It takes writes once built, so BenchmarkWrite and BenchmarkMixed run it
+// too.
+
+var (
+	benchTablePogrebOnce sync.Once
+	benchTablePogreb     *pogreb.DB
+)
+
+func init() {
+	registerBackend(backend{
+		name: "pogreb",
+		open: func(path string) backendTable {
+			return newPogrebBackendTable(createPogrebTable(path))
+		},
+		duplicates:   duplicatesLastWins,
+		lookupAllocs: allocsUnmeasured,
+		openMutable: func(path string) backendTable {
+			db, closeTable := createMutablePogrebTable(path)
+			return backendTable{
+				newBytesReader: sharedBytesReader(func(key []byte) ([]byte, bool) {
+					value, err := db.Get(key)
+					return value, err == nil && value != nil
+				}),
+				newWriter: sharedWriter(db.Put),
+				close:     closeTable,
+			}
+		},
+		benchTable: func() backendTable {
+			benchTablePogrebOnce.Do(loadPogrebBenchTable)
+			return newPogrebBackendTable(benchTablePogreb)
+		},
+	})
+}
+
+// newPogrebBackendTable returns the backendTable reading db.
+func newPogrebBackendTable(db *pogreb.DB) backendTable {
+	return backendTable{
+		newBytesReader: sharedBytesReader(func(key []byte) ([]byte, bool) {
+			value, err := db.Get(key)
+			return value, err == nil && value != nil
+		}),
+		close: func() { _ = db.Close() },
+	}
+}
+
+func loadPogrebBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTablePogreb = createPogrebTable(testData)
+}
+
+func createPogrebTable(testDataPath string) *pogreb.DB {
+	dir, err := newTableDir("bit-test.*.pogreb")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	buildPogrebTable(testDataPath, dir)
+	// pogreb has no read-only mode, but it can mmap its segment and index
+	// files, which is how a read-heavy deployment would run it.
+	table, err := pogreb.Open(dir, &pogreb.Options{FileSystem: fs.OSMMap})
+	if err != nil {
+		panic(err)
+	}
+
+	return table
+}
+
+// createMutablePogrebTable is createPogrebTable, which is already writable,
+// but keeping the directory new segments are written to around: it returns
+// the table and a function closing it and removing its directory.
+func createMutablePogrebTable(testDataPath string) (*pogreb.DB, func()) {
+	dir, err := newTableDir("bit-test.*.pogreb")
+	if err != nil {
+		panic(err)
+	}
+	buildPogrebTable(testDataPath, dir)
+	db, err := pogreb.Open(dir, &pogreb.Options{FileSystem: fs.OSMMap})
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		panic(err)
+	}
+	return db, func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func buildPogrebTable(testDataPath, dir string) {
+	// background syncing and compaction only matter for long-lived
+	// mutable databases; leave them off while loading.
+	db, err := pogreb.Open(dir, &pogreb.Options{FileSystem: fs.OS})
+	if err != nil {
+		panic(err)
+	}
+	streamTestFile(testDataPath, func(k, v []byte) {
+		if err := db.Put(k, v); err != nil {
+			panic(err)
+		}
+	})
+	if err := db.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func BenchmarkPogrebGet(b *testing.B) {
+	loadTable(b, "pogreb", &benchTablePogrebOnce, loadPogrebBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "pogreb", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, err := benchTablePogreb.Get(zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, err == nil && value != nil) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTablePogrebCreate *pogreb.DB
+
+func BenchmarkPogrebCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		if benchTablePogrebCreate != nil {
+			_ = benchTablePogrebCreate.Close()
+		}
+		benchTablePogrebCreate = buildTable(b, "pogreb", createPogrebTable, testData)
+		if benchTablePogrebCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
@@ -0,0 +1,30 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !linux
+
+package bitbenchmark
+
+import "testing"
+
+// preadUnavailable is why the pread benchmarks are skipped off Linux: the
+// backends lean on O_DIRECT and x/sys/unix's Linux pread; see pread_test.go.
+const preadUnavailable = "the pread backends only build on linux"
+
+func init() {
+	registerUnavailableBackend("pread", preadUnavailable)
+	registerUnavailableBackend("pread-direct", preadUnavailable)
+}
+
+func BenchmarkPreadGet(b *testing.B) {
+	b.Skip(preadUnavailable)
+}
+
+func BenchmarkPreadDirectGet(b *testing.B) {
+	b.Skip(preadUnavailable)
+}
+
+func BenchmarkPreadCreate(b *testing.B) {
+	b.Skip(preadUnavailable)
+}
@@ -0,0 +1,265 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build linux
+
+package bitbenchmark
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"golang.org/x/sys/unix"
+)
+
+// preadTable reads values out of a file with pread(2) rather than through
+// an mmap, the other side of the mmap-or-explicit-reads debate.  Opened
+// with O_DIRECT, every lookup goes to the device, bypassing the page
+// cache: the cold-read case, which mmapped tables only hit after their
+// pages are evicted.  Keys are indexed in the heap, so that only the value
+// reads differ from the mmapped backends.
+type preadTable struct {
+	f     *os.File
+	index map[string]preadEntry
+	// maxRead is the most any one lookup reads, rounded out to
+	// preadAlign at both ends.
+	maxRead int
+}
+
+type preadEntry struct {
+	off int64
+	len int32
+}
+
+// preadAlign is the alignment O_DIRECT needs of reads' offsets, lengths and
+// buffers: the device's logical block size, which is at most a page.
+const preadAlign = 4096
+
+// preadReader is a preadTable lookup with its own read buffer, for the use
+// of a single goroutine.  The values it returns alias that buffer, so are
+// only valid until the next lookup.
+type preadReader struct {
+	table *preadTable
+	buf   []byte
+}
+
+func (t *preadTable) newReader() *preadReader {
+	// an anonymous mapping is page aligned, as O_DIRECT needs.
+	buf, err := unix.Mmap(-1, 0, t.maxRead, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		panic(err)
+	}
+	return &preadReader{table: t, buf: buf}
+}
+
+func (r *preadReader) Get(key []byte) ([]byte, bool) {
+	e, ok := r.table.index[string(key)]
+	if !ok {
+		return nil, false
+	}
+	start := e.off &^ (preadAlign - 1)
+	end := (e.off + int64(e.len) + preadAlign - 1) &^ (preadAlign - 1)
+	// the last block of the file comes back short, but never short of
+	// the value.  A failed read isn't a miss: the key is in the index.
+	n, err := unix.Pread(int(r.table.f.Fd()), r.buf[:end-start], start)
+	if err != nil {
+		panic(fmt.Errorf("pread %s at %d: %w", r.table.f.Name(), start, err))
+	}
+	if want := e.off + int64(e.len) - start; int64(n) < want {
+		panic(fmt.Errorf("pread %s at %d: read %d bytes, want %d: %w", r.table.f.Name(), start, n, want, io.ErrUnexpectedEOF))
+	}
+	return r.buf[e.off-start : e.off-start+int64(e.len)], true
+}
+
+func (r *preadReader) Close() {
+	_ = unix.Munmap(r.buf)
+}
+
+func (t *preadTable) Close() error {
+	return t.f.Close()
+}
+
+var (
+	benchTablePreadOnce       sync.Once
+	benchTablePread           *preadTable
+	benchTablePreadDirectOnce sync.Once
+	benchTablePreadDirect     *preadTable
+)
+
+func init() {
+	for _, direct := range []bool{false, true} {
+		name := "pread"
+		if direct {
+			name = "pread-direct"
+		}
+		b := backend{
+			name: name,
+			open: func(path string) backendTable {
+				return newPreadBackendTable(createPreadTable(path, direct))
+			},
+			duplicates: duplicatesLastWins,
+			benchTable: func() backendTable {
+				benchTablePreadOnce.Do(loadPreadBenchTable)
+				return newPreadBackendTable(benchTablePread)
+			},
+		}
+		if direct {
+			b.probe = probeDirectIO
+			b.benchTable = func() backendTable {
+				benchTablePreadDirectOnce.Do(loadPreadDirectBenchTable)
+				return newPreadBackendTable(benchTablePreadDirect)
+			}
+		}
+		registerBackend(b)
+	}
+}
+
+// newPreadBackendTable returns the backendTable reading table.
+func newPreadBackendTable(table *preadTable) backendTable {
+	return backendTable{
+		newBytesReader: func() (bytesLookupFunc, func()) {
+			r := table.newReader()
+			return r.Get, r.Close
+		},
+		close: func() { _ = table.Close() },
+	}
+}
+
+// probeDirectIO checks that files in tableDir can be opened with O_DIRECT,
+// which tmpfs (often what os.TempDir() is) doesn't support.
+func probeDirectIO() string {
+	f, err := os.CreateTemp(tableDir, "bit-test.*.data")
+	if err != nil {
+		return err.Error()
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+		_ = f.Close()
+	}()
+	direct, err := os.OpenFile(f.Name(), os.O_RDONLY|unix.O_DIRECT, 0)
+	if errors.Is(err, unix.EINVAL) {
+		return "O_DIRECT isn't supported in " + f.Name() + "'s filesystem; pick another with -tabledir"
+	} else if err != nil {
+		return err.Error()
+	}
+	_ = direct.Close()
+	return ""
+}
+
+func loadPreadBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTablePread = createPreadTable(testData, false)
+}
+
+func loadPreadDirectBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTablePreadDirect = createPreadTable(testData, true)
+}
+
+func createPreadTable(testDataPath string, direct bool) *preadTable {
+	tableFile, err := newTableFile("bit-test.*.data")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.Remove(tableFile.Name())
+	}()
+
+	t := &preadTable{index: make(map[string]preadEntry), maxRead: preadAlign}
+	w := bufio.NewWriterSize(tableFile, 1<<20)
+	var off int64
+	streamTestFile(testDataPath, func(k, v []byte) {
+		if _, err := w.Write(v); err != nil {
+			panic(err)
+		}
+		t.index[string(k)] = preadEntry{off: off, len: int32(len(v))}
+		// a value can straddle one more block than it fills.
+		t.maxRead = max(t.maxRead, (len(v)+preadAlign-1)&^(preadAlign-1)+preadAlign)
+		off += int64(len(v))
+	})
+	if err := w.Flush(); err != nil {
+		panic(err)
+	}
+	if err := tableFile.Close(); err != nil {
+		panic(err)
+	}
+
+	flags := os.O_RDONLY
+	if direct {
+		flags |= unix.O_DIRECT
+	}
+	t.f, err = os.OpenFile(tableFile.Name(), flags, 0)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func BenchmarkPreadGet(b *testing.B) {
+	loadTable(b, "pread", &benchTablePreadOnce, loadPreadBenchTable)
+
+	benchmarkPreadGet(b, "pread", benchTablePread)
+}
+
+func BenchmarkPreadDirectGet(b *testing.B) {
+	backends["pread-direct"].skipIfUnavailable(b)
+	loadTable(b, "pread-direct", &benchTablePreadDirectOnce, loadPreadDirectBenchTable)
+
+	benchmarkPreadGet(b, "pread-direct", benchTablePreadDirect)
+}
+
+func benchmarkPreadGet(b *testing.B, name string, table *preadTable) {
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, name, func(b *testing.PB) {
+		defer pinWorker()()
+		r := table.newReader()
+		defer r.Close()
+
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := r.Get(zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTablePreadCreate *preadTable
+
+func BenchmarkPreadCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		if benchTablePreadCreate != nil {
+			_ = benchTablePreadCreate.Close()
+		}
+		benchTablePreadCreate = buildTable(b, "pread", func(path string) *preadTable {
+			return createPreadTable(path, false)
+		}, testData)
+		if benchTablePreadCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
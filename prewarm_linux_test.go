@@ -0,0 +1,32 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build linux
+
+package bitbenchmark
+
+import (
+	"errors"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// prewarmPages faults in the pages of the tables currently mmapped.
+// MADV_POPULATE_READ needs Linux 5.14; before that, MADV_WILLNEED at
+// least reads the tables into the page cache.
+func prewarmPages() error {
+	// as in liveTableMappings, don't advise what a finalizer that's due
+	// is about to unmap.
+	runtime.GC()
+	runtime.GC()
+	mappings, err := tableMappings()
+	if err != nil {
+		return err
+	}
+	if err := madvise(mappings, unix.MADV_POPULATE_READ); !errors.Is(err, unix.EINVAL) {
+		return err
+	}
+	return madvise(mappings, unix.MADV_WILLNEED)
+}
@@ -0,0 +1,13 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !linux
+
+package bitbenchmark
+
+// prewarmPages does nothing: finding the tables' mappings needs Linux's
+// /proc/self/maps, so only the lookup pass of -prewarm is done here.
+func prewarmPages() error {
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"flag"
+	"testing"
+)
+
+// A table's pages aren't mapped into the process until they're first read,
+// so a benchmark's first lookups also pay for page faults, more of them for
+// the backends that mmap bigger tables, which skews short runs.  -prewarm
+// faults in every page of the mmapped tables before the timer starts, and
+// the benchmarks over every backend also look every key up once, which
+// fills the caches of the backends that don't mmap.  BenchmarkMadviseGet
+// isn't prewarmed, as it times exactly those faults.
+var prewarmTables = flag.Bool("prewarm", false, "fault in the mmapped tables' pages, and look every key up once, before timing lookups")
+
+// prewarm faults in the pages of every mmapped table, if -prewarm is set.
+func prewarm(tb testing.TB) {
+	if !*prewarmTables {
+		return
+	}
+	if err := prewarmPages(); err != nil {
+		tb.Fatalf("prewarm: %v", err)
+	}
+}
+
+// prewarmTable is prewarm, followed by a lookup of every key in benchEntries
+// in table.
+func prewarmTable(tb testing.TB, table backendTable) {
+	if !*prewarmTables {
+		return
+	}
+	prewarm(tb)
+	get, release := table.reader()
+	defer release()
+	for _, entry := range benchEntries {
+		if value, ok := get(entry.Key); !entry.matches(value, ok) {
+			tb.Fatalf("prewarm: bad lookup of %q", entry.Key)
+		}
+	}
+}
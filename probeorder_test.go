@@ -0,0 +1,113 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// The Get benchmarks probe keys in a random order, unrelated to the order
+// the tables were built in, which is the worst case for locality: each
+// lookup lands on a different page, or block, to the last.  Scan-like
+// access patterns see something much closer to the insertion order.
+// BenchmarkProbeOrderGet probes each backend in both, and the difference
+// is how much a format gains from keeping neighbouring entries together:
+//
+//	go test -run XXX -bench ProbeOrderGet -backends bit,bbolt,pebble
+func BenchmarkProbeOrderGet(b *testing.B) {
+	loadBenchTables(b)
+	orders := []struct {
+		name    string
+		entries []benchEntry
+	}{
+		{"insertion", withMisses(insertionOrder(testData, benchEntries), missRatio, inBenchTable)},
+		{"shuffled", benchEntries},
+	}
+
+	for _, be := range sortedBackends() {
+		b.Run(be.name, func(b *testing.B) {
+			be.skipIfUnavailable(b)
+			table := buildTable(b, be.name, be.open, testData)
+			defer table.close()
+			prewarmTable(b, table)
+
+			for _, order := range orders {
+				b.Run(order.name, func(b *testing.B) {
+					b.ReportAllocs()
+					b.ResetTimer()
+					faults := startPageFaults()
+					runParallel(b, be.name, func(b *testing.PB) {
+						defer pinWorker()()
+						get, release := table.reader()
+						defer release()
+						entries := order.entries
+						entryCount := len(entries)
+						i := rand.Int() % entryCount
+						for b.Next() {
+							entry := entries[i]
+							value, ok := get(entry.Key)
+							if !entry.matches(value, ok) {
+								panic("bad data or lookup")
+							}
+							i = (i + 1) % entryCount
+						}
+					})
+					reportGetThroughput(b)
+					faults.report(b)
+				})
+			}
+		})
+	}
+}
+
+// insertionOrder returns entries in the order their keys first appear in
+// the testdata at path.
+func insertionOrder(path string, entries []benchEntry) []benchEntry {
+	values := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		values[entry.Key] = entry.Value
+	}
+	ordered := make([]benchEntry, 0, len(entries))
+	streamTestFile(path, func(k, v []byte) {
+		if value, ok := values[string(k)]; ok {
+			ordered = append(ordered, benchEntry{Key: string(k), Value: value})
+			delete(values, string(k))
+		}
+	})
+	return ordered
+}
+
+func TestInsertionOrder(t *testing.T) {
+	path := writeGeneratedTestData(t, 1000, 0.1)
+	var keys []string
+	seen := make(map[string]bool)
+	streamTestFile(path, func(k, v []byte) {
+		if !seen[string(k)] {
+			seen[string(k)] = true
+			keys = append(keys, string(k))
+		}
+	})
+	entries := hotEntries(mapEntries(createInMemoryTable(path)), 0.5)
+
+	ordered := insertionOrder(path, entries)
+	if len(ordered) != len(entries) {
+		t.Fatalf("got %d entries; want %d", len(ordered), len(entries))
+	}
+	want := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		want[entry.Key] = entry.Value
+	}
+	i := 0
+	for _, key := range keys {
+		if _, ok := want[key]; !ok {
+			continue
+		}
+		if ordered[i].Key != key || ordered[i].Value != want[key] {
+			t.Fatalf("entry %d: got %+v; want %s:%s", i, ordered[i], key, want[key])
+		}
+		i++
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build rocksdb
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/linxGnu/grocksdb"
+)
+
+// The RocksDB backend links against librocksdb via cgo, so it is only built
+// with `-tags rocksdb`, e.g.:
+//
+//	go test -tags rocksdb -bench=Rocksdb
+
+var (
+	benchTableRocksdbOnce sync.Once
+	benchTableRocksdb     *grocksdb.DB
+)
+
+func init() {
+	registerBackend(backend{
+		name: "rocksdb",
+		open: func(path string) backendTable {
+			db := createRocksdbTable(path)
+			return newRocksdbBackendTable(db, db.Close)
+		},
+		// SST writers require strictly increasing keys.
+		duplicates:   duplicatesError,
+		lookupAllocs: allocsUnmeasured,
+		openMutable: func(path string) backendTable {
+			db, closeTable := createMutableRocksdbTable(path)
+			t := newRocksdbBackendTable(db, closeTable)
+			t.newWriter = func() (writeFunc, func()) {
+				wo := grocksdb.NewDefaultWriteOptions()
+				return func(key, value []byte) error {
+					return db.Put(wo, key, value)
+				}, wo.Destroy
+			}
+			return t
+		},
+		benchTable: func() backendTable {
+			benchTableRocksdbOnce.Do(loadRocksdbBenchTable)
+			return newRocksdbBackendTable(benchTableRocksdb, noClose)
+		},
+	})
+}
+
+// newRocksdbBackendTable returns the backendTable reading db, closed by
+// closeTable.
+func newRocksdbBackendTable(db *grocksdb.DB, closeTable func()) backendTable {
+	return backendTable{
+		newBytesReader: func() (bytesLookupFunc, func()) {
+			ro := grocksdb.NewDefaultReadOptions()
+			// pinned values are released by Destroy, so
+			// copy them out.
+			var buf []byte
+			return func(key []byte) ([]byte, bool) {
+				value, err := db.GetPinned(ro, key)
+				if err != nil {
+					return nil, false
+				}
+				defer value.Destroy()
+				buf = append(buf[:0], value.Data()...)
+				return buf, value.Exists()
+			}, ro.Destroy
+		},
+		newBatchReader: func() (batchLookupFunc, func()) {
+			ro := grocksdb.NewDefaultReadOptions()
+			var keys [][]byte
+			return func(batch []string, found func(i int, value []byte)) {
+				keys = keys[:0]
+				for _, key := range batch {
+					keys = append(keys, zerocopy.Bytes(key))
+				}
+				values, err := db.MultiGet(ro, keys...)
+				if err != nil {
+					panic(err)
+				}
+				defer values.Destroy()
+				for i, value := range values {
+					if value.Exists() {
+						found(i, value.Data())
+					}
+				}
+			}, ro.Destroy
+		},
+		close: closeTable,
+	}
+}
+
+func loadRocksdbBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableRocksdb = createRocksdbTable(testData)
+}
+
+func newRocksdbOptions() *grocksdb.Options {
+	// a bloom filter and pinned index/filter blocks are what anyone serving
+	// point lookups out of RocksDB would configure, so do the same here.
+	tableOpts := grocksdb.NewDefaultBlockBasedTableOptions()
+	tableOpts.SetFilterPolicy(grocksdb.NewBloomFilterFull(10))
+	tableOpts.SetCacheIndexAndFilterBlocks(true)
+	tableOpts.SetPinL0FilterAndIndexBlocksInCache(true)
+	tableOpts.SetBlockCache(grocksdb.NewLRUCache(64 << 20))
+
+	opts := grocksdb.NewDefaultOptions()
+	opts.SetCreateIfMissing(true)
+	opts.SetBlockBasedTableFactory(tableOpts)
+	// open every SST up front: we unlink the database directory once the
+	// read-only handle is open, the same as we do for the other tables.
+	opts.SetMaxOpenFiles(-1)
+	return opts
+}
+
+func createRocksdbTable(testDataPath string) *grocksdb.DB {
+	dir, err := newTableDir("bit-test.*.rocksdb")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	opts := newRocksdbOptions()
+	defer opts.Destroy()
+	table, err := grocksdb.OpenDbForReadOnly(opts, buildRocksdbTable(testDataPath, dir, opts), false)
+	if err != nil {
+		panic(err)
+	}
+
+	return table
+}
+
+// createMutableRocksdbTable builds a table and opens it for writing too,
+// returning it and a function closing it and removing its directory.
+func createMutableRocksdbTable(testDataPath string) (*grocksdb.DB, func()) {
+	dir, err := newTableDir("bit-test.*.rocksdb")
+	if err != nil {
+		panic(err)
+	}
+	opts := newRocksdbOptions()
+	defer opts.Destroy()
+	db, err := grocksdb.OpenDb(opts, buildRocksdbTable(testDataPath, dir, opts))
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		panic(err)
+	}
+	return db, func() {
+		db.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// buildRocksdbTable builds a database in dir, returning its path.
+func buildRocksdbTable(testDataPath, dir string, opts *grocksdb.Options) string {
+
+	// SST files must be written in key order, so (unlike the other builders)
+	// we have to buffer and sort the whole dataset first.
+	var entries []benchEntry
+	streamTestFile(testDataPath, func(k, v []byte) {
+		entries = append(entries, benchEntry{Key: string(k), Value: string(v)})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	envOpts := grocksdb.NewDefaultEnvOptions()
+	defer envOpts.Destroy()
+
+	sstPath := filepath.Join(dir, "bulk.sst")
+	writer := grocksdb.NewSSTFileWriter(envOpts, opts)
+	defer writer.Destroy()
+	if err := writer.Open(sstPath); err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		if err := writer.Add(zerocopy.Bytes(entry.Key), zerocopy.Bytes(entry.Value)); err != nil {
+			panic(err)
+		}
+	}
+	if err := writer.Finish(); err != nil {
+		panic(err)
+	}
+
+	dbPath := filepath.Join(dir, "db")
+	db, err := grocksdb.OpenDb(opts, dbPath)
+	if err != nil {
+		panic(err)
+	}
+	ingestOpts := grocksdb.NewDefaultIngestExternalFileOptions()
+	defer ingestOpts.Destroy()
+	ingestOpts.SetMoveFiles(true)
+	if err := db.IngestExternalFile([]string{sstPath}, ingestOpts); err != nil {
+		panic(err)
+	}
+	db.Close()
+	return dbPath
+}
+
+func BenchmarkRocksdbGet(b *testing.B) {
+	loadTable(b, "rocksdb", &benchTableRocksdbOnce, loadRocksdbBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "rocksdb", func(b *testing.PB) {
+		defer pinWorker()()
+		ro := grocksdb.NewDefaultReadOptions()
+		defer ro.Destroy()
+
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, err := benchTableRocksdb.GetPinned(ro, zerocopy.Bytes(entry.Key))
+			if err != nil || !entry.matches(value.Data(), value.Exists()) {
+				panic("bad data or lookup")
+			}
+			value.Destroy()
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableRocksdbCreate *grocksdb.DB
+
+func BenchmarkRocksdbCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		if benchTableRocksdbCreate != nil {
+			benchTableRocksdbCreate.Close()
+		}
+		benchTableRocksdbCreate = buildTable(b, "rocksdb", createRocksdbTable, testData)
+		if benchTableRocksdbCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
@@ -0,0 +1,258 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit"
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/dgryski/go-farm"
+)
+
+// A single bit table is indexed in memory by one goroutine, and the bit we
+// build against can't index some key sets at all, more of them the more
+// keys there are.  Datasets of billions of keys are instead deployed as
+// many tables, with keys hash-partitioned between them, each smaller and
+// indexed in parallel with the others.  shardedbit is that, benchmarked
+// with shardedBitShards tables (and the tunable's counts in
+// BenchmarkSweepGet), e.g. at 100M keys:
+//
+//	go test -run XXX -bench 'BitGet|KeyTypeGet/(bit|shardedbit)' -entries 100000000
+const shardedBitShards = 16
+
+var (
+	benchTableShardedBitOnce sync.Once
+	benchTableShardedBit     *shardedBitTable
+)
+
+func init() {
+	registerBackend(backend{
+		name: "shardedbit",
+		open: func(path string) backendTable {
+			return newShardedBitBackendTable(createShardedBitTable(path, shardedBitShards))
+		},
+		// Finalize retries index seeds forever if a key repeats.
+		duplicates: duplicatesHang,
+		tunables: []tunable{
+			{name: "shards", values: []string{"4", "16", "64"}},
+		},
+		openTuned: func(path string, params map[string]string) backendTable {
+			n, err := strconv.Atoi(params["shards"])
+			if err != nil || n <= 0 {
+				panic("shards: not a positive number: " + params["shards"])
+			}
+			return newShardedBitBackendTable(createShardedBitTable(path, n))
+		},
+		benchTable: func() backendTable {
+			benchTableShardedBitOnce.Do(loadShardedBitBenchTable)
+			return newShardedBitBackendTable(benchTableShardedBit)
+		},
+	})
+}
+
+func newShardedBitBackendTable(table *shardedBitTable) backendTable {
+	return backendTable{
+		newReader:      sharedReader(table.GetString),
+		newBytesReader: sharedBytesReader(table.Get),
+		close:          noClose,
+	}
+}
+
+// shardedBitTable is bit tables with keys hash-partitioned between them.
+type shardedBitTable struct {
+	shards []*bit.Table
+	// pads is how many padding keys the shards were given between them.
+	pads int
+}
+
+func (t *shardedBitTable) Get(key []byte) ([]byte, bool) {
+	return t.shards[shardedBitShard(key, len(t.shards))].Get(key)
+}
+
+func (t *shardedBitTable) GetString(key string) ([]byte, bool) {
+	return t.shards[shardedBitShard(zerocopy.Bytes(key), len(t.shards))].GetString(key)
+}
+
+// shardedBitShard is which of n shards key is in.  This is cdbShard's hash
+// for the same reason: bit picks first-level buckets with bitHash, and
+// routing by that would leave each shard only every n'th bucket.
+func shardedBitShard(key []byte, n int) int {
+	return int(farm.Hash64(key) % uint64(n))
+}
+
+// shardedBitPad returns the i'th padding key.  With shards of tens of keys,
+// as tests build, most shards' keys are ones bit can't index, and even at
+// a million keys a few percent are (see bitIndexWouldPanic), so no one
+// partitioning would do for all shards.  A shard that bit can't index is
+// given padding keys until it can, each one that shardedBitShard routes to
+// another shard, so that looking one up still misses.
+func shardedBitPad(i int) []byte {
+	return fmt.Appendf(nil, "\x00shardedbit-pad:%d", i)
+}
+
+func loadShardedBitBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableShardedBit = createShardedBitTable(testData, shardedBitShards)
+}
+
+// createShardedBitTable builds a table of n shards from the test data,
+// finalizing them in parallel.
+func createShardedBitTable(testDataPath string, n int) *shardedBitTable {
+	builders := make([]*bit.Builder, n)
+	for i := range builders {
+		tableFile, err := newTableFile("bit-test.*.data")
+		if err != nil {
+			panic(err)
+		}
+		defer func() {
+			_ = os.Remove(tableFile.Name())
+			_ = os.Remove(tableFile.Name() + ".index")
+		}()
+		if err = tableFile.Close(); err != nil {
+			panic(err)
+		}
+		if err = os.Remove(tableFile.Name()); err != nil {
+			panic(err)
+		}
+		if builders[i], err = bit.NewBuilder(tableFile.Name()); err != nil {
+			panic(err)
+		}
+	}
+
+	// the hashes of each shard's keys, to tell which need padding.
+	hashes := make([][]uint32, n)
+	streamTestFile(testDataPath, func(k, v []byte) {
+		i := shardedBitShard(k, n)
+		if err := builders[i].Put(k, v); err != nil {
+			panic(err)
+		}
+		hashes[i] = append(hashes[i], bitHash(k))
+	})
+
+	table := &shardedBitTable{shards: make([]*bit.Table, n)}
+	pad := 0
+	for i, h := range hashes {
+		for bitHashesWouldPanic(len(h), func(j int) uint32 { return h[j] }) {
+			for shardedBitShard(shardedBitPad(pad), n) == i {
+				pad++
+			}
+			key := shardedBitPad(pad)
+			pad++
+			// bit's Finalize panics reading back an empty value.
+			if err := builders[i].Put(key, key); err != nil {
+				panic(err)
+			}
+			h = append(h, bitHash(key))
+			table.pads++
+		}
+	}
+	hashes = nil
+
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i, builder := range builders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			table.shards[i], errs[i] = builder.Finalize()
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		panic(err)
+	}
+
+	return table
+}
+
+func BenchmarkShardedBitGet(b *testing.B) {
+	loadTable(b, "shardedbit", &benchTableShardedBitOnce, loadShardedBitBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "shardedbit", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := benchTableShardedBit.GetString(entry.Key)
+			if !entry.matches(value, ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	b.ReportMetric(float64(len(benchTableShardedBit.shards)), "shards")
+	b.ReportMetric(float64(benchTableShardedBit.pads), "pads")
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableShardedBitCreate *shardedBitTable
+
+func BenchmarkShardedBitCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		benchTableShardedBitCreate = buildTable(b, "shardedbit", func(path string) *shardedBitTable {
+			return createShardedBitTable(path, shardedBitShards)
+		}, testData)
+		if benchTableShardedBitCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
+
+func TestShardedBitTable(t *testing.T) {
+	const n = 4
+	path := writeGeneratedTestData(t, 5000, 0)
+	table := createShardedBitTable(path, n)
+	if len(table.shards) != n {
+		t.Fatalf("got %d shards; want %d", len(table.shards), n)
+	}
+
+	sizes := make([]int, n)
+	streamTestFile(path, func(k, v []byte) {
+		sizes[shardedBitShard(k, n)]++
+		if value, ok := table.Get(k); !ok || string(value) != string(v) {
+			t.Fatalf("Get(%q) = %q, %v; want %q", k, value, ok, v)
+		}
+	})
+	for i, size := range sizes {
+		if size < 5000/n/2 {
+			t.Errorf("shard %d has %d of 5000 keys", i, size)
+		}
+	}
+
+	// shards of a few keys each mostly need padding.
+	table = createShardedBitTable(path, 256)
+	if table.pads == 0 {
+		t.Error("no shards padded")
+	}
+	for i := 0; i < table.pads+256; i++ {
+		if value, ok := table.Get(shardedBitPad(i)); ok {
+			t.Fatalf("padding key %d found, = %q", i, value)
+		}
+	}
+	streamTestFile(path, func(k, v []byte) {
+		if value, ok := table.Get(k); !ok || string(value) != string(v) {
+			t.Fatalf("256 shards: Get(%q) = %q, %v; want %q", k, value, ok, v)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"hash/maphash"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+)
+
+// shardedMapShards is the number of independently locked shards.  It is a
+// power of two so the shard can be picked with a mask.
+const shardedMapShards = 64
+
+var (
+	benchTableShardedMapOnce sync.Once
+	benchTableShardedMap     *shardedMap
+)
+
+// shardedMap is the usual way a mutable in-memory table is made
+// concurrency-friendly: a fixed set of RWMutex-guarded maps, with keys
+// assigned to shards by hash so readers rarely contend on the same lock.
+type shardedMap struct {
+	seed   maphash.Seed
+	shards [shardedMapShards]struct {
+		sync.RWMutex
+		m map[string]string
+	}
+}
+
+func newShardedMap() *shardedMap {
+	m := &shardedMap{seed: maphash.MakeSeed()}
+	for i := range m.shards {
+		m.shards[i].m = make(map[string]string)
+	}
+	return m
+}
+
+func (m *shardedMap) shard(key string) int {
+	return int(maphash.String(m.seed, key) & (shardedMapShards - 1))
+}
+
+func (m *shardedMap) Get(key string) (string, bool) {
+	s := &m.shards[m.shard(key)]
+	s.RLock()
+	value, ok := s.m[key]
+	s.RUnlock()
+	return value, ok
+}
+
+func (m *shardedMap) Put(key, value string) {
+	s := &m.shards[m.shard(key)]
+	s.Lock()
+	s.m[key] = value
+	s.Unlock()
+}
+
+func init() {
+	open := func(path string) backendTable {
+		return newShardedMapBackendTable(createShardedMapTable(path))
+	}
+	registerBackend(backend{
+		name:        "shardedmap",
+		open:        open,
+		duplicates:  duplicatesLastWins,
+		openMutable: open,
+		benchTable: func() backendTable {
+			benchTableShardedMapOnce.Do(loadShardedMapBenchTable)
+			return newShardedMapBackendTable(benchTableShardedMap)
+		},
+	})
+}
+
+// newShardedMapBackendTable returns the backendTable reading and writing m.
+func newShardedMapBackendTable(m *shardedMap) backendTable {
+	return backendTable{
+		newReader: sharedReader(stringLookup(m.Get)),
+		newWriter: sharedWriter(func(key, value []byte) error {
+			m.Put(string(key), string(value))
+			return nil
+		}),
+		close: noClose,
+	}
+}
+
+func loadShardedMapBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableShardedMap = createShardedMapTable(testData)
+}
+
+func createShardedMapTable(testDataPath string) *shardedMap {
+	data := newShardedMap()
+
+	streamTestFile(testDataPath, func(k, v []byte) {
+		data.Put(string(k), string(v))
+	})
+
+	return data
+}
+
+func BenchmarkShardedMapGet(b *testing.B) {
+	loadTable(b, "shardedmap", &benchTableShardedMapOnce, loadShardedMapBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "shardedmap", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := benchTableShardedMap.Get(entry.Key)
+			if !entry.matches(zerocopy.Bytes(value), ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
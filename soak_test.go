@@ -0,0 +1,168 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"flag"
+	"math/rand"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Page-cache churn and slow memory growth only show up over far longer
+// runs than go test -bench does, so TestSoak (enabled with -soak) builds
+// every backend from the testdata and looks keys up in all of them
+// continuously, logging throughput, RSS and GC pauses as it goes:
+//
+//	go test -run TestSoak -v -timeout 0 -soak 30m
+var (
+	soakDuration = flag.Duration("soak", 0, "run TestSoak for this `duration`")
+	soakInterval = flag.Duration("soak-interval", time.Minute, "how often TestSoak logs stats")
+	soakBackends = flag.String("soak-backends", "", "comma-separated `backends` for TestSoak (default all)")
+)
+
+// statmPageSize is the unit /proc/self/statm reports sizes in.
+var statmPageSize = int64(os.Getpagesize())
+
+// currentRSS returns the resident set size of this process, or 0 where
+// that can't be read.
+func currentRSS() int64 {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * statmPageSize
+}
+
+func TestSoak(t *testing.T) {
+	if *soakDuration <= 0 {
+		t.Skip("soak testing not enabled with -soak")
+	}
+
+	var selected []backend
+	if *soakBackends == "" {
+		for _, b := range sortedBackends() {
+			if b.unavailable != "" {
+				t.Logf("skipping %s: %s", b.name, b.unavailable)
+				continue
+			}
+			selected = append(selected, b)
+		}
+	} else {
+		for _, name := range strings.Split(*soakBackends, ",") {
+			b, ok := backends[name]
+			if !ok {
+				t.Fatalf("unknown backend %q", name)
+			}
+			if b.unavailable != "" {
+				t.Fatalf("%s: %s", b.name, b.unavailable)
+			}
+			selected = append(selected, b)
+		}
+	}
+
+	data := createInMemoryTable(testData)
+	entries := withMisses(hotEntries(mapEntries(data), hotset), missRatio, func(key string) bool {
+		_, ok := data[key]
+		return ok
+	})
+	tables := make([]backendTable, len(selected))
+	for i, b := range selected {
+		start := time.Now()
+		tables[i] = b.open(testData)
+		defer tables[i].close()
+		t.Logf("built %s in %v (rss %d MB)", b.name, time.Since(start).Round(time.Millisecond), currentRSS()>>20)
+	}
+
+	lookups := make([]atomic.Int64, len(selected))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range tables {
+		for r := 0; r < runtime.GOMAXPROCS(0); r++ {
+			wg.Add(1)
+			go func(i int, seed int64) {
+				defer wg.Done()
+				get, release := tables[i].reader()
+				defer release()
+				rng := rand.New(rand.NewSource(seed))
+				for n := 0; ; n++ {
+					// checking for stop on every lookup would cost
+					// more than some of the lookups do.
+					if n%1024 == 0 {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+					}
+					entry := entries[rng.Intn(len(entries))]
+					if value, ok := get(entry.Key); !entry.matches(value, ok) {
+						panic("bad data or lookup")
+					}
+					lookups[i].Add(1)
+				}
+			}(i, rand.Int63())
+		}
+	}
+
+	var gcStats debug.GCStats
+	gcStats.PauseQuantiles = make([]time.Duration, 5)
+	var lastNumGC int64
+	var lastPauseTotal time.Duration
+	last := make([]int64, len(selected))
+	lastTick := time.Now()
+
+	ticker := time.NewTicker(*soakInterval)
+	defer ticker.Stop()
+	deadline := time.After(*soakDuration)
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			done = true
+		}
+		now := time.Now()
+		if done && now.Sub(lastTick) < *soakInterval/10 {
+			// the deadline came (all but) on a tick.
+			break
+		}
+		elapsed := now.Sub(lastTick).Seconds()
+		lastTick = now
+
+		var line strings.Builder
+		for i, b := range selected {
+			n := lookups[i].Load()
+			line.WriteString(" " + b.name + "=" + strconv.FormatFloat(float64(n-last[i])/elapsed, 'f', 0, 64))
+			last[i] = n
+		}
+		t.Logf("lookups/s:%s", line.String())
+
+		// PauseQuantiles are over the pauses the runtime still
+		// remembers (the most recent 256), not just this interval.
+		debug.ReadGCStats(&gcStats)
+		t.Logf("rss %d MB, %d GCs (%v paused), recent pauses p50 %v p100 %v",
+			currentRSS()>>20, gcStats.NumGC-lastNumGC, gcStats.PauseTotal-lastPauseTotal,
+			gcStats.PauseQuantiles[2], gcStats.PauseQuantiles[4])
+		lastNumGC, lastPauseTotal = gcStats.NumGC, gcStats.PauseTotal
+	}
+
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+)
+
+var (
+	benchTableSortedSliceOnce sync.Once
+	benchTableSortedSlice     sortedSliceTable
+)
+
+// sortedSliceTable is about the simplest read-only index there is: entries
+// sorted by key and found by binary search.
+type sortedSliceTable []benchEntry
+
+func (t sortedSliceTable) GetString(key string) (string, bool) {
+	i := sort.Search(len(t), func(i int) bool {
+		return t[i].Key >= key
+	})
+	if i >= len(t) || t[i].Key != key {
+		return "", false
+	}
+	return t[i].Value, true
+}
+
+func init() {
+	registerBackend(backend{
+		name: "sortedslice",
+		open: func(path string) backendTable {
+			return backendTable{
+				newReader: sharedReader(stringLookup(createSortedSliceTable(path).GetString)),
+				close:     noClose,
+			}
+		},
+		// repeated keys sit next to each other after an unstable sort,
+		// and the binary search finds whichever comes first.
+		duplicates: duplicatesAnyWins,
+		benchTable: func() backendTable {
+			benchTableSortedSliceOnce.Do(loadSortedSliceBenchTable)
+			return backendTable{
+				newReader: sharedReader(stringLookup(benchTableSortedSlice.GetString)),
+				close:     noClose,
+			}
+		},
+	})
+}
+
+func loadSortedSliceBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableSortedSlice = createSortedSliceTable(testData)
+}
+
+func createSortedSliceTable(testDataPath string) sortedSliceTable {
+	var entries sortedSliceTable
+	streamTestFile(testDataPath, func(k, v []byte) {
+		entries = append(entries, benchEntry{Key: string(k), Value: string(v)})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries
+}
+
+func BenchmarkSortedSliceGet(b *testing.B) {
+	loadTable(b, "sortedslice", &benchTableSortedSliceOnce, loadSortedSliceBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "sortedslice", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := benchTableSortedSlice.GetString(entry.Key)
+			if !entry.matches(zerocopy.Bytes(value), ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableSortedSliceCreate sortedSliceTable
+
+func BenchmarkSortedSliceCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		benchTableSortedSliceCreate = buildTable(b, "sortedslice", createSortedSliceTable, testData)
+		if benchTableSortedSliceCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
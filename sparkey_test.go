@@ -0,0 +1,331 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build sparkey
+
+package bitbenchmark
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/bsm/go-sparkey"
+)
+
+// The sparkey backend links against libsparkey via cgo, so it is only built
+// with `-tags sparkey`.  make test builds the C libraries and passes the tag
+// along with the flags to link them; without it, nosparkey_test.go stands in
+// for this file.
+
+var (
+	benchTableSparkeyOnce             sync.Once
+	benchTableSparkeyUncompressed     *sparkey.HashReader
+	benchTableSparkeyUncompressedSize int64
+)
+
+// sparkeySnappyBlockSizes are the compression block sizes the Snappy-
+// compressed sparkey benchmarks are run with.  Larger blocks compress
+// better, but every lookup has to decompress a whole block.
+var sparkeySnappyBlockSizes = [...]int{4 * sparkey.KiB, 16 * sparkey.KiB, 64 * sparkey.KiB}
+
+// benchTableSparkeySnappy holds one lazily-built table per entry in
+// sparkeySnappyBlockSizes, so a filtered benchmark run only pays to build
+// the tables it uses.
+var benchTableSparkeySnappy [len(sparkeySnappyBlockSizes)]struct {
+	once  sync.Once
+	table *sparkey.HashReader
+	size  int64
+}
+
+func init() {
+	registerBackend(backend{
+		name: "sparkey",
+		open: func(path string) backendTable {
+			table, _ := createSparkeyTable(path, nil, sparkey.HASH_SIZE_AUTO)
+			return newSparkeyBackendTable(table)
+		},
+		// later log entries supersede earlier ones for the same key.
+		duplicates: duplicatesLastWins,
+		// HashIter.Get copies the value out with ioutil.ReadAll.
+		lookupAllocs: 2,
+		// a block of 0 is an uncompressed log, and the others
+		// Snappy-compressed blocks of that size.  The auto hash size
+		// is 32 bits for tables of under 2^23 entries.
+		tunables: []tunable{
+			{name: "block", values: []string{"0", "4K", "16K"}},
+			{name: "hash", values: []string{"auto", "32", "64"}},
+		},
+		openTuned: func(path string, params map[string]string) backendTable {
+			var opts *sparkey.Options
+			if blockSize := int(parseTunableSize(params["block"])); blockSize > 0 {
+				opts = &sparkey.Options{Compression: sparkey.COMPRESSION_SNAPPY, CompressionBlockSize: blockSize}
+			}
+			hashSizes := map[string]sparkey.HashSize{
+				"auto": sparkey.HASH_SIZE_AUTO,
+				"32":   sparkey.HASH_SIZE_32BIT,
+				"64":   sparkey.HASH_SIZE_64BIT,
+			}
+			hashSize, ok := hashSizes[params["hash"]]
+			if !ok {
+				panic(fmt.Sprintf("bad sparkey hash size %q", params["hash"]))
+			}
+			table, _ := createSparkeyTable(path, opts, hashSize)
+			return newSparkeyBackendTable(table)
+		},
+		benchTable: func() backendTable {
+			benchTableSparkeyOnce.Do(loadSparkeyBenchTable)
+			return newSparkeyBackendTable(benchTableSparkeyUncompressed)
+		},
+	})
+
+	sharedFormats = append(sharedFormats, sharedFormat{
+		name: "sparkey",
+		build: func(testDataPath, tablePath string) error {
+			buildSparkeyTable(testDataPath, tablePath, nil, sparkey.HASH_SIZE_AUTO).Close()
+			return nil
+		},
+		open: func(tablePath string) func(key string) ([]byte, bool) {
+			table, err := sparkey.Open(tablePath)
+			if err != nil {
+				panic(err)
+			}
+			iter, err := table.Iterator()
+			if err != nil {
+				panic(err)
+			}
+			return func(key string) ([]byte, bool) {
+				value, err := iter.Get(zerocopy.Bytes(key))
+				return value, err == nil && value != nil
+			}
+		},
+	})
+}
+
+// newSparkeyBackendTable returns the backendTable reading table.
+func newSparkeyBackendTable(table *sparkey.HashReader) backendTable {
+	return backendTable{
+		// an iterator holds its position in the log, so each goroutine
+		// needs its own.
+		newBytesReader: func() (bytesLookupFunc, func()) {
+			iter, err := table.Iterator()
+			if err != nil {
+				panic(err)
+			}
+			return func(key []byte) ([]byte, bool) {
+				value, err := iter.Get(key)
+				return value, err == nil && value != nil
+			}, iter.Close
+		},
+		close: table.Close,
+	}
+}
+
+// loadSparkeyBenchTable builds the sparkey table alongside the others (see
+// loadBenchTable) rather than after them.
+func loadSparkeyBenchTable() {
+	buildConcurrently(func() {
+		benchTableOnce.Do(loadBenchTable)
+	}, func() {
+		benchTableSparkeyUncompressed, benchTableSparkeyUncompressedSize = openSparkeyBenchTable("sparkey", nil)
+	})
+}
+
+// openSparkeyBenchTable opens the named sparkey table for the testdata from
+// -tabledir, building it there with opts first if need be, or builds a
+// temporary one if -tabledir isn't set.
+func openSparkeyBenchTable(name string, opts *sparkey.Options) (*sparkey.HashReader, int64) {
+	dir, err := cachedTableDir(name, func(dir string) error {
+		buildSparkeyTable(testData, filepath.Join(dir, "table"), opts, sparkey.HASH_SIZE_AUTO).Close()
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if dir == "" {
+		return createSparkeyTable(testData, opts, sparkey.HASH_SIZE_AUTO)
+	}
+	tablePath := filepath.Join(dir, "table")
+	table, err := sparkey.Open(tablePath)
+	if err != nil {
+		panic(err)
+	}
+	return table, sparkeyTableSize(tablePath)
+}
+
+// createSparkeyTable builds a sparkey table with the given options (nil
+// for an uncompressed log) and hash size, and returns it along with its
+// total size on disk.
+func createSparkeyTable(testDataPath string, opts *sparkey.Options, hashSize sparkey.HashSize) (*sparkey.HashReader, int64) {
+	tableFile, err := newTableFile("bit-test.*.data")
+	if err != nil {
+		panic(err)
+	}
+	logPath := sparkey.LogFileName(tableFile.Name())
+	hashPath := sparkey.HashFileName(tableFile.Name())
+	defer func() {
+		_ = os.Remove(tableFile.Name())
+		_ = os.Remove(logPath)
+		_ = os.Remove(hashPath)
+	}()
+	if err = tableFile.Close(); err != nil {
+		panic(err)
+	}
+	if err = os.Remove(tableFile.Name()); err != nil {
+		panic(err)
+	}
+
+	table := buildSparkeyTable(testDataPath, tableFile.Name(), opts, hashSize)
+
+	return table, sparkeyTableSize(tableFile.Name())
+}
+
+// sparkeyTableSize returns the total size of the log and hash files of the
+// sparkey table at tablePath.
+func sparkeyTableSize(tablePath string) int64 {
+	var size int64
+	for _, path := range []string{sparkey.LogFileName(tablePath), sparkey.HashFileName(tablePath)} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			panic(err)
+		}
+		size += fi.Size()
+	}
+	return size
+}
+
+// buildSparkeyTable builds a sparkey table with its log and hash files
+// alongside tablePath, leaving them in place.
+func buildSparkeyTable(testDataPath, tablePath string, opts *sparkey.Options, hashSize sparkey.HashSize) *sparkey.HashReader {
+	builder, err := sparkey.CreateLogWriter(tablePath, opts)
+	if err != nil {
+		panic(err)
+	}
+
+	streamTestFile(testDataPath, func(k, v []byte) {
+		if err := builder.Put(k, v); err != nil {
+			panic(err)
+		}
+	})
+
+	if err := builder.Flush(); err != nil {
+		panic(err)
+	}
+	if err := builder.WriteHashFile(hashSize); err != nil {
+		panic(err)
+	}
+	if err := builder.Close(); err != nil {
+		panic(err)
+	}
+
+	table, err := sparkey.Open(tablePath)
+	if err != nil {
+		panic(err)
+	}
+
+	return table
+}
+
+func BenchmarkSparkeySnappyGet(b *testing.B) {
+	loadBenchTables(b)
+
+	for i, blockSize := range sparkeySnappyBlockSizes {
+		t := &benchTableSparkeySnappy[i]
+		b.Run(fmt.Sprintf("block=%d", blockSize), func(b *testing.B) {
+			loadTable(b, "sparkey", &t.once, func() {
+				t.table, t.size = openSparkeyBenchTable(fmt.Sprintf("sparkey-snappy-%d", blockSize), &sparkey.Options{
+					Compression:          sparkey.COMPRESSION_SNAPPY,
+					CompressionBlockSize: blockSize,
+				})
+			})
+			benchmarkSparkeyGet(b, t.table, t.size)
+		})
+	}
+}
+
+func BenchmarkSparkeyUncompressedGet(b *testing.B) {
+	loadTable(b, "sparkey", &benchTableSparkeyOnce, loadSparkeyBenchTable)
+
+	benchmarkSparkeyGet(b, benchTableSparkeyUncompressed, benchTableSparkeyUncompressedSize)
+}
+
+func benchmarkSparkeyGet(b *testing.B, table *sparkey.HashReader, diskSize int64) {
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "sparkey", func(b *testing.PB) {
+		defer pinWorker()()
+		iter, err := table.Iterator()
+		if err != nil {
+			panic(err)
+		}
+
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, err := iter.Get(zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, err == nil && value != nil) {
+				panic("bad data or lookup")
+			}
+
+			i = (i + 1) % entryCount
+		}
+	})
+	b.ReportMetric(float64(diskSize), "disk-bytes")
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableSparkeyCreate *sparkey.HashReader
+
+func BenchmarkSparkeyCreateUncompressed(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		benchTableSparkeyCreate = buildTable(b, "sparkey", func(path string) *sparkey.HashReader {
+			table, _ := createSparkeyTable(path, nil, sparkey.HASH_SIZE_AUTO)
+			return table
+		}, testData)
+		if benchTableSparkeyCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
+
+func BenchmarkSparkeyCreateSnappy(b *testing.B) {
+	for _, blockSize := range sparkeySnappyBlockSizes {
+		opts := &sparkey.Options{
+			Compression:          sparkey.COMPRESSION_SNAPPY,
+			CompressionBlockSize: blockSize,
+		}
+		b.Run(fmt.Sprintf("block=%d", blockSize), func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			faults := startPageFaults()
+			mem := startBuildMemory()
+			for i := 0; i < b.N; i++ {
+				benchTableSparkeyCreate = buildTable(b, "sparkey", func(path string) *sparkey.HashReader {
+					table, _ := createSparkeyTable(path, opts, sparkey.HASH_SIZE_AUTO)
+					return table
+				}, testData)
+				if benchTableSparkeyCreate == nil {
+					b.Fatal("bad data or lookup")
+				}
+			}
+			mem.report(b)
+			faults.report(b)
+		})
+	}
+}
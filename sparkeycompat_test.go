@@ -0,0 +1,65 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build sparkey && unix
+
+package bitbenchmark
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/bsm/go-sparkey"
+)
+
+// TestSparkeyGoCompatible checks the pure-Go reader and writer in
+// sparkeygo_test.go against libsparkey, in both directions.
+func TestSparkeyGoCompatible(t *testing.T) {
+	benchTableOnce.Do(loadBenchTable)
+
+	dir := t.TempDir()
+
+	goPath := filepath.Join(dir, "go")
+	buildSparkeyGoTable(testData, sparkey.LogFileName(goPath), sparkey.HashFileName(goPath)).Close()
+	cReader, err := sparkey.Open(goPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cReader.Close()
+	iter, err := cReader.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+
+	cPath := filepath.Join(dir, "c")
+	buildSparkeyTable(testData, cPath, nil, sparkey.HASH_SIZE_AUTO).Close()
+	goReader, err := openSparkeyGoTable(sparkey.LogFileName(cPath), sparkey.HashFileName(cPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer goReader.Close()
+
+	for _, entry := range presentEntries(benchEntries) {
+		if value, err := iter.Get(zerocopy.Bytes(entry.Key)); err != nil || string(value) != entry.Value {
+			t.Fatalf("libsparkey reading a Go-built table: %q = %q, %v; want %q", entry.Key, value, err, entry.Value)
+		}
+		if value, ok := goReader.Get(zerocopy.Bytes(entry.Key)); !ok || string(value) != entry.Value {
+			t.Fatalf("sparkeygo reading a libsparkey-built table: %q = %q, %v; want %q", entry.Key, value, ok, entry.Value)
+		}
+	}
+	if value, ok := goReader.Get([]byte("missing key")); ok {
+		t.Fatalf("sparkeygo found a missing key: %q", value)
+	}
+
+	snappyPath := filepath.Join(dir, "snappy")
+	buildSparkeyTable(testData, snappyPath, &sparkey.Options{
+		Compression:          sparkey.COMPRESSION_SNAPPY,
+		CompressionBlockSize: 4 * sparkey.KiB,
+	}, sparkey.HASH_SIZE_AUTO).Close()
+	if _, err := openSparkeyGoTable(sparkey.LogFileName(snappyPath), sparkey.HashFileName(snappyPath)); err != errSparkeyCompressed {
+		t.Fatalf("opening a compressed log: got %v, want %v", err, errSparkeyCompressed)
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !unix
+
+package bitbenchmark
+
+import "testing"
+
+// sparkeyGoUnavailable is why the sparkeygo benchmarks are skipped off
+// unix: the reader maps its files with x/sys/unix's Mmap; see
+// sparkeygo_test.go.
+const sparkeyGoUnavailable = "sparkeygo only builds on unix"
+
+func init() {
+	registerUnavailableBackend("sparkeygo", sparkeyGoUnavailable)
+}
+
+func BenchmarkSparkeyGoGet(b *testing.B) {
+	b.Skip(sparkeyGoUnavailable)
+}
+
+func BenchmarkSparkeyGoCreate(b *testing.B) {
+	b.Skip(sparkeyGoUnavailable)
+}
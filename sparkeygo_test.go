@@ -0,0 +1,586 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build unix
+
+package bitbenchmark
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/twmb/murmur3"
+	"golang.org/x/sys/unix"
+)
+
+// sparkeyGoTable reads sparkey's file format in pure Go, so the format can be
+// benchmarked without libsparkey, and so that comparing it with the sparkey
+// backend shows what the cgo calls cost.  Only uncompressed logs are
+// supported.  The files are mapped with mmap(2), so it's only built on
+// unix; sparkeygo_other_test.go stands in for it elsewhere.
+//
+// A sparkey log is a header followed by entries, each a pair of uvarints
+// and then the key and value: keyLen+1 and valueLen for a put, or 0 and
+// keyLen for a delete.  The hash file is a header followed by an
+// open-addressed (Robin Hood) table of slots, each holding the MurmurHash3
+// of a key and the log offset of its entry, with an offset of 0 for an
+// empty slot.  All integers are little-endian.
+type sparkeyGoTable struct {
+	log   []byte
+	index []byte
+	slots []byte
+
+	dataEnd     uint64
+	capacity    uint64
+	seed        uint32
+	hashSize    int
+	addressSize int
+}
+
+const (
+	sparkeyLogMagic       = 0x49b39c95
+	sparkeyLogHeaderSize  = 84
+	sparkeyHashMagic      = 0x9a11318f
+	sparkeyHashHeaderSize = 112
+)
+
+var errSparkeyCompressed = errors.New("sparkeygo: compressed logs aren't supported")
+
+// sparkeyLogHeader is the header of a sparkey log file, version 1.0.
+type sparkeyLogHeader struct {
+	fileID                  uint32
+	numPuts, numDeletes     uint64
+	dataEnd                 uint64
+	maxKeyLen, maxValueLen  uint64
+	deleteSize              uint64
+	compressionType         uint32
+	compressionBlockSize    uint32
+	putSize                 uint64
+	maxEntriesPerBlockCount uint32
+}
+
+func (h *sparkeyLogHeader) marshal() []byte {
+	b := make([]byte, sparkeyLogHeaderSize)
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], sparkeyLogMagic)
+	le.PutUint32(b[4:], 1) // major version
+	le.PutUint32(b[8:], 0) // minor version
+	le.PutUint32(b[12:], h.fileID)
+	le.PutUint64(b[16:], h.numPuts)
+	le.PutUint64(b[24:], h.numDeletes)
+	le.PutUint64(b[32:], h.dataEnd)
+	le.PutUint64(b[40:], h.maxKeyLen)
+	le.PutUint64(b[48:], h.maxValueLen)
+	le.PutUint64(b[56:], h.deleteSize)
+	le.PutUint32(b[64:], h.compressionType)
+	le.PutUint32(b[68:], h.compressionBlockSize)
+	le.PutUint64(b[72:], h.putSize)
+	le.PutUint32(b[80:], h.maxEntriesPerBlockCount)
+	return b
+}
+
+func (h *sparkeyLogHeader) unmarshal(b []byte) error {
+	le := binary.LittleEndian
+	if len(b) < sparkeyLogHeaderSize || le.Uint32(b[0:]) != sparkeyLogMagic {
+		return errors.New("sparkeygo: not a sparkey log")
+	}
+	if major := le.Uint32(b[4:]); major != 1 {
+		return fmt.Errorf("sparkeygo: unsupported log version %d", major)
+	}
+	*h = sparkeyLogHeader{
+		fileID:                  le.Uint32(b[12:]),
+		numPuts:                 le.Uint64(b[16:]),
+		numDeletes:              le.Uint64(b[24:]),
+		dataEnd:                 le.Uint64(b[32:]),
+		maxKeyLen:               le.Uint64(b[40:]),
+		maxValueLen:             le.Uint64(b[48:]),
+		deleteSize:              le.Uint64(b[56:]),
+		compressionType:         le.Uint32(b[64:]),
+		compressionBlockSize:    le.Uint32(b[68:]),
+		putSize:                 le.Uint64(b[72:]),
+		maxEntriesPerBlockCount: le.Uint32(b[80:]),
+	}
+	if h.dataEnd < sparkeyLogHeaderSize || h.dataEnd > uint64(len(b)) {
+		return errors.New("sparkeygo: log truncated")
+	}
+	return nil
+}
+
+// sparkeyHashHeader is the header of a sparkey hash file, version 1.1.
+type sparkeyHashHeader struct {
+	fileID, seed           uint32
+	dataEnd                uint64
+	maxKeyLen, maxValueLen uint64
+	numPuts                uint64
+	garbageSize            uint64
+	totalDisplacement      uint64
+	capacity               uint64
+	numEntries             uint64
+	numCollisions          uint64
+	maxDisplacement        uint64
+	entryBlockBits         uint32
+	hashSize, addressSize  uint32
+}
+
+func (h *sparkeyHashHeader) marshal() []byte {
+	b := make([]byte, sparkeyHashHeaderSize)
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], sparkeyHashMagic)
+	le.PutUint32(b[4:], 1) // major version
+	le.PutUint32(b[8:], 1) // minor version
+	le.PutUint32(b[12:], h.fileID)
+	le.PutUint32(b[16:], h.seed)
+	le.PutUint64(b[20:], h.dataEnd)
+	le.PutUint64(b[28:], h.maxKeyLen)
+	le.PutUint64(b[36:], h.maxValueLen)
+	le.PutUint64(b[44:], h.numPuts)
+	le.PutUint64(b[52:], h.garbageSize)
+	le.PutUint64(b[60:], h.totalDisplacement)
+	le.PutUint64(b[68:], h.capacity)
+	le.PutUint64(b[76:], h.numEntries)
+	le.PutUint64(b[84:], h.numCollisions)
+	le.PutUint64(b[92:], h.maxDisplacement)
+	le.PutUint32(b[100:], h.entryBlockBits)
+	le.PutUint32(b[104:], h.hashSize)
+	le.PutUint32(b[108:], h.addressSize)
+	return b
+}
+
+func (h *sparkeyHashHeader) unmarshal(b []byte) error {
+	le := binary.LittleEndian
+	if len(b) < sparkeyHashHeaderSize || le.Uint32(b[0:]) != sparkeyHashMagic {
+		return errors.New("sparkeygo: not a sparkey hash file")
+	}
+	if major, minor := le.Uint32(b[4:]), le.Uint32(b[8:]); major != 1 || minor != 1 {
+		return fmt.Errorf("sparkeygo: unsupported hash file version %d.%d", major, minor)
+	}
+	*h = sparkeyHashHeader{
+		fileID:            le.Uint32(b[12:]),
+		seed:              le.Uint32(b[16:]),
+		dataEnd:           le.Uint64(b[20:]),
+		maxKeyLen:         le.Uint64(b[28:]),
+		maxValueLen:       le.Uint64(b[36:]),
+		numPuts:           le.Uint64(b[44:]),
+		garbageSize:       le.Uint64(b[52:]),
+		totalDisplacement: le.Uint64(b[60:]),
+		capacity:          le.Uint64(b[68:]),
+		numEntries:        le.Uint64(b[76:]),
+		numCollisions:     le.Uint64(b[84:]),
+		maxDisplacement:   le.Uint64(b[92:]),
+		entryBlockBits:    le.Uint32(b[100:]),
+		hashSize:          le.Uint32(b[104:]),
+		addressSize:       le.Uint32(b[108:]),
+	}
+	if (h.hashSize != 4 && h.hashSize != 8) || (h.addressSize != 4 && h.addressSize != 8) {
+		return fmt.Errorf("sparkeygo: unsupported hash size %d or address size %d", h.hashSize, h.addressSize)
+	}
+	if h.capacity == 0 || uint64(len(b)) != sparkeyHashHeaderSize+h.capacity*uint64(h.hashSize+h.addressSize) {
+		return errors.New("sparkeygo: hash file size doesn't match its header")
+	}
+	return nil
+}
+
+// sparkeyKeyHash is the hash sparkey indexes keys by: 32-bit MurmurHash3
+// for 4-byte hashes, and the first half of the 128-bit one for 8-byte.
+func sparkeyKeyHash(key []byte, seed uint32, hashSize int) uint64 {
+	if hashSize == 4 {
+		return uint64(murmur3.SeedSum32(seed, key))
+	}
+	h1, _ := murmur3.SeedSum128(uint64(seed), uint64(seed), key)
+	return h1
+}
+
+func readSparkeyUint(b []byte, size int) uint64 {
+	if size == 4 {
+		return uint64(binary.LittleEndian.Uint32(b))
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func putSparkeyUint(b []byte, size int, v uint64) {
+	if size == 4 {
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	} else {
+		binary.LittleEndian.PutUint64(b, v)
+	}
+}
+
+// sparkeyEntry parses the log entry at off, returning its key and value
+// (nil for a delete) and the offset of the next entry.
+func sparkeyEntry(log []byte, off uint64) (key, value []byte, next uint64) {
+	a, n := binary.Uvarint(log[off:])
+	off += uint64(n)
+	b, n := binary.Uvarint(log[off:])
+	off += uint64(n)
+	if a == 0 {
+		return log[off : off+b], nil, off + b
+	}
+	key = log[off : off+a-1]
+	off += a - 1
+	return key, log[off : off+b], off + b
+}
+
+// openSparkeyGoTable maps a sparkey log and hash file.
+func openSparkeyGoTable(logPath, hashPath string) (*sparkeyGoTable, error) {
+	log, err := mmapFile(logPath)
+	if err != nil {
+		return nil, err
+	}
+	index, err := mmapFile(hashPath)
+	if err != nil {
+		_ = unix.Munmap(log)
+		return nil, err
+	}
+	t := &sparkeyGoTable{log: log, index: index}
+
+	var logHeader sparkeyLogHeader
+	var hashHeader sparkeyHashHeader
+	if err = logHeader.unmarshal(log); err == nil {
+		err = hashHeader.unmarshal(index)
+	}
+	if err == nil && logHeader.compressionType != 0 {
+		err = errSparkeyCompressed
+	}
+	if err == nil && (hashHeader.fileID != logHeader.fileID || hashHeader.dataEnd != logHeader.dataEnd) {
+		err = errors.New("sparkeygo: hash file doesn't belong to log")
+	}
+	if err != nil {
+		_ = t.Close()
+		return nil, err
+	}
+
+	t.slots = index[sparkeyHashHeaderSize:]
+	t.dataEnd = logHeader.dataEnd
+	t.capacity = hashHeader.capacity
+	t.seed = hashHeader.seed
+	t.hashSize = int(hashHeader.hashSize)
+	t.addressSize = int(hashHeader.addressSize)
+	return t, nil
+}
+
+func mmapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return unix.Mmap(int(f.Fd()), 0, int(fi.Size()), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+// Get returns the value for key, aliasing the mapped log.
+func (t *sparkeyGoTable) Get(key []byte) ([]byte, bool) {
+	hash := sparkeyKeyHash(key, t.seed, t.hashSize)
+	slotSize := uint64(t.hashSize + t.addressSize)
+	slot := hash % t.capacity
+	for displacement := uint64(0); ; displacement++ {
+		s := t.slots[slot*slotSize:]
+		slotHash := readSparkeyUint(s, t.hashSize)
+		address := readSparkeyUint(s[t.hashSize:], t.addressSize)
+		if address == 0 {
+			return nil, false
+		}
+		if slotHash == hash {
+			if k, v, _ := sparkeyEntry(t.log, address); v != nil && bytes.Equal(k, key) {
+				return v, true
+			}
+		}
+		// Robin Hood hashing keeps entries ordered by how far they
+		// are from where they hashed to, so once we're further from
+		// home than this slot's entry is from its, key isn't here.
+		if displacement > (slot+t.capacity-slotHash%t.capacity)%t.capacity {
+			return nil, false
+		}
+		if slot++; slot == t.capacity {
+			slot = 0
+		}
+	}
+}
+
+func (t *sparkeyGoTable) Close() error {
+	err := unix.Munmap(t.log)
+	if t.index != nil {
+		if err2 := unix.Munmap(t.index); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// writeSparkeyGoLog writes the testdata to an uncompressed sparkey log.
+func writeSparkeyGoLog(testDataPath, logPath string) error {
+	f, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	header := sparkeyLogHeader{fileID: rand.Uint32(), dataEnd: sparkeyLogHeaderSize}
+	w := bufio.NewWriterSize(f, 1<<20)
+	if _, err := w.Write(header.marshal()); err != nil {
+		return err
+	}
+	var buf [2 * binary.MaxVarintLen64]byte
+	streamTestFile(testDataPath, func(k, v []byte) {
+		if err != nil {
+			return
+		}
+		n := binary.PutUvarint(buf[:], uint64(len(k))+1)
+		n += binary.PutUvarint(buf[n:], uint64(len(v)))
+		if _, err = w.Write(buf[:n]); err != nil {
+			return
+		}
+		if _, err = w.Write(k); err != nil {
+			return
+		}
+		if _, err = w.Write(v); err != nil {
+			return
+		}
+		header.numPuts++
+		header.putSize += uint64(n + len(k) + len(v))
+		header.dataEnd += uint64(n + len(k) + len(v))
+		header.maxKeyLen = max(header.maxKeyLen, uint64(len(k)))
+		header.maxValueLen = max(header.maxValueLen, uint64(len(v)))
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(header.marshal(), 0); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeSparkeyGoHash indexes a sparkey log, writing the hash file sparkey
+// would: a Robin Hood table with 30% headroom, where later puts of a key
+// replace earlier ones.
+func writeSparkeyGoHash(logPath, hashPath string) error {
+	log, err := mmapFile(logPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = unix.Munmap(log)
+	}()
+	var logHeader sparkeyLogHeader
+	if err := logHeader.unmarshal(log); err != nil {
+		return err
+	}
+	if logHeader.compressionType != 0 {
+		return errSparkeyCompressed
+	}
+	if logHeader.numDeletes != 0 {
+		return errors.New("sparkeygo: logs with deletes aren't supported")
+	}
+
+	header := sparkeyHashHeader{
+		fileID:      logHeader.fileID,
+		seed:        rand.Uint32(),
+		dataEnd:     logHeader.dataEnd,
+		maxKeyLen:   logHeader.maxKeyLen,
+		maxValueLen: logHeader.maxValueLen,
+		numPuts:     logHeader.numPuts,
+		capacity:    logHeader.numPuts*13/10 + 1,
+		hashSize:    8,
+		addressSize: 8,
+	}
+	// the same sizes sparkey picks with HASH_SIZE_AUTO.
+	if logHeader.numPuts < 1<<23 {
+		header.hashSize = 4
+	}
+	if logHeader.dataEnd < 1<<32 {
+		header.addressSize = 4
+	}
+	hashSize, addressSize := int(header.hashSize), int(header.addressSize)
+	slotSize := uint64(hashSize + addressSize)
+	slots := make([]byte, header.capacity*slotSize)
+
+	for off := uint64(sparkeyLogHeaderSize); off < logHeader.dataEnd; {
+		key, _, next := sparkeyEntry(log, off)
+		hash, address := sparkeyKeyHash(key, header.seed, hashSize), off
+		slot := hash % header.capacity
+		for displacement := uint64(0); ; displacement++ {
+			s := slots[slot*slotSize:]
+			slotHash := readSparkeyUint(s, hashSize)
+			slotAddress := readSparkeyUint(s[hashSize:], addressSize)
+			if slotAddress == 0 {
+				putSparkeyUint(s, hashSize, hash)
+				putSparkeyUint(s[hashSize:], addressSize, address)
+				header.numEntries++
+				break
+			}
+			if slotHash == hash {
+				if k, _, oldNext := sparkeyEntry(log, slotAddress); bytes.Equal(k, key) {
+					putSparkeyUint(s[hashSize:], addressSize, address)
+					header.garbageSize += oldNext - slotAddress
+					break
+				}
+				header.numCollisions++
+			}
+			if slotDisplacement := (slot + header.capacity - slotHash%header.capacity) % header.capacity; displacement > slotDisplacement {
+				putSparkeyUint(s, hashSize, hash)
+				putSparkeyUint(s[hashSize:], addressSize, address)
+				hash, address, displacement = slotHash, slotAddress, slotDisplacement
+			}
+			if slot++; slot == header.capacity {
+				slot = 0
+			}
+		}
+		off = next
+	}
+
+	for slot := uint64(0); slot < header.capacity; slot++ {
+		s := slots[slot*slotSize:]
+		if readSparkeyUint(s[hashSize:], addressSize) == 0 {
+			continue
+		}
+		hash := readSparkeyUint(s, hashSize)
+		displacement := (slot + header.capacity - hash%header.capacity) % header.capacity
+		header.totalDisplacement += displacement
+		header.maxDisplacement = max(header.maxDisplacement, displacement)
+	}
+
+	f, err := os.Create(hashPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(header.marshal()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Write(slots); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// buildSparkeyGoTable builds a sparkey table from the testdata without
+// libsparkey, leaving its files in place.
+func buildSparkeyGoTable(testDataPath, logPath, hashPath string) *sparkeyGoTable {
+	if err := writeSparkeyGoLog(testDataPath, logPath); err != nil {
+		panic(err)
+	}
+	if err := writeSparkeyGoHash(logPath, hashPath); err != nil {
+		panic(err)
+	}
+	table, err := openSparkeyGoTable(logPath, hashPath)
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+var (
+	benchTableSparkeyGoOnce sync.Once
+	benchTableSparkeyGo     *sparkeyGoTable
+)
+
+func init() {
+	registerBackend(backend{
+		name: "sparkeygo",
+		open: func(path string) backendTable {
+			return newSparkeyGoBackendTable(createSparkeyGoTable(path))
+		},
+		// later log entries supersede earlier ones for the same key.
+		duplicates: duplicatesLastWins,
+		benchTable: func() backendTable {
+			benchTableSparkeyGoOnce.Do(loadSparkeyGoBenchTable)
+			return newSparkeyGoBackendTable(benchTableSparkeyGo)
+		},
+	})
+}
+
+// newSparkeyGoBackendTable returns the backendTable reading table.
+func newSparkeyGoBackendTable(table *sparkeyGoTable) backendTable {
+	return backendTable{
+		newBytesReader: sharedBytesReader(table.Get),
+		close:          func() { _ = table.Close() },
+	}
+}
+
+func loadSparkeyGoBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableSparkeyGo = createSparkeyGoTable(testData)
+}
+
+func createSparkeyGoTable(testDataPath string) *sparkeyGoTable {
+	tableFile, err := newTableFile("bit-test.*.spl")
+	if err != nil {
+		panic(err)
+	}
+	logPath := tableFile.Name()
+	hashPath := logPath[:len(logPath)-len(".spl")] + ".spi"
+	defer func() {
+		_ = os.Remove(logPath)
+		_ = os.Remove(hashPath)
+	}()
+	if err = tableFile.Close(); err != nil {
+		panic(err)
+	}
+
+	return buildSparkeyGoTable(testDataPath, logPath, hashPath)
+}
+
+func BenchmarkSparkeyGoGet(b *testing.B) {
+	loadTable(b, "sparkeygo", &benchTableSparkeyGoOnce, loadSparkeyGoBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "sparkeygo", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := benchTableSparkeyGo.Get(zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableSparkeyGoCreate *sparkeyGoTable
+
+func BenchmarkSparkeyGoCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		if benchTableSparkeyGoCreate != nil {
+			_ = benchTableSparkeyGoCreate.Close()
+		}
+		benchTableSparkeyGoCreate = buildTable(b, "sparkeygo", createSparkeyGoTable, testData)
+		if benchTableSparkeyGoCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
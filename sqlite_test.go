@@ -0,0 +1,340 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMmapSize is passed to PRAGMA mmap_size so that SQLite reads pages
+// out of a mapping, the same as the other on-disk tables, rather than
+// through read(2) into its own page cache.
+const sqliteMmapSize = 1 << 30
+
+var (
+	benchTableSqliteOnce sync.Once
+	benchTableSqlite     *sqliteTable
+)
+
+type sqliteTable struct {
+	db  *sql.DB
+	get *sql.Stmt
+}
+
+func init() {
+	registerBackend(backend{
+		name: "sqlite",
+		open: func(path string) backendTable {
+			return newSqliteBackendTable(createSqliteTable(path))
+		},
+		// the unique index on k can't be built over repeated keys.
+		duplicates:   duplicatesError,
+		lookupAllocs: 20,
+		openMutable: func(path string) backendTable {
+			t, closeTable := createMutableSqliteTable(path)
+			put, err := t.db.Prepare(`INSERT INTO kv (k, v) VALUES (?, ?) ON CONFLICT (k) DO UPDATE SET v = excluded.v`)
+			if err != nil {
+				panic(err)
+			}
+			return backendTable{
+				newReader: func() (lookupFunc, func()) {
+					var value []byte
+					return func(key string) ([]byte, bool) {
+						err := t.get.QueryRow(key).Scan(&value)
+						return value, err == nil
+					}, noClose
+				},
+				newWriter: sharedWriter(func(key, value []byte) error {
+					_, err := put.Exec(string(key), string(value))
+					return err
+				}),
+				close: closeTable,
+			}
+		},
+		benchTable: func() backendTable {
+			benchTableSqliteOnce.Do(loadSqliteBenchTable)
+			return newSqliteBackendTable(benchTableSqlite)
+		},
+	})
+}
+
+// newSqliteBackendTable returns the backendTable reading t.
+func newSqliteBackendTable(t *sqliteTable) backendTable {
+	return backendTable{
+		newReader: func() (lookupFunc, func()) {
+			var value []byte
+			return func(key string) ([]byte, bool) {
+				err := t.get.QueryRow(key).Scan(&value)
+				return value, err == nil
+			}, noClose
+		},
+		newBatchReader: func() (batchLookupFunc, func()) {
+			r := &sqliteBatchReader{db: t.db, stmts: make(map[int]*sql.Stmt)}
+			return r.get, r.close
+		},
+		close: func() { _ = t.db.Close() },
+	}
+}
+
+// sqliteBatchReader looks keys up a batch at a time, with one query per
+// batch.  Statements are prepared for each batch size as it's first seen.
+type sqliteBatchReader struct {
+	db    *sql.DB
+	stmts map[int]*sql.Stmt
+	args  []any
+	value []byte
+}
+
+func (r *sqliteBatchReader) get(keys []string, found func(i int, value []byte)) {
+	stmt := r.stmts[len(keys)]
+	if stmt == nil {
+		var err error
+		if stmt, err = r.db.Prepare(sqliteBatchQuery(len(keys))); err != nil {
+			panic(err)
+		}
+		r.stmts[len(keys)] = stmt
+	}
+	r.args = r.args[:0]
+	for _, key := range keys {
+		r.args = append(r.args, key)
+	}
+	rows, err := stmt.Query(r.args...)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var i int
+		if err := rows.Scan(&i, &r.value); err != nil {
+			panic(err)
+		}
+		found(i, r.value)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+}
+
+func (r *sqliteBatchReader) close() {
+	for _, stmt := range r.stmts {
+		_ = stmt.Close()
+	}
+}
+
+// sqliteBatchQuery returns a query looking up n keys at once, returning the
+// index of each key found along with its value.
+func sqliteBatchQuery(n int) string {
+	var q strings.Builder
+	q.WriteString(`WITH q (i, k) AS (VALUES `)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			q.WriteString(", ")
+		}
+		fmt.Fprintf(&q, "(%d, ?)", i)
+	}
+	q.WriteString(`) SELECT q.i, kv.v FROM q JOIN kv ON kv.k = q.k`)
+	return q.String()
+}
+
+func loadSqliteBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableSqlite = createSqliteTable(testData)
+}
+
+func sqliteDSN(path string, params url.Values) string {
+	return (&url.URL{Scheme: "file", OmitHost: true, Path: path, RawQuery: params.Encode()}).String()
+}
+
+func createSqliteTable(testDataPath string) *sqliteTable {
+	tableFile, err := newTableFile("bit-test.*.data")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.Remove(tableFile.Name())
+	}()
+	if err = tableFile.Close(); err != nil {
+		panic(err)
+	}
+
+	buildSqliteTable(testDataPath, tableFile.Name())
+	db, err := sql.Open("sqlite", sqliteDSN(tableFile.Name(), url.Values{
+		"mode":      {"ro"},
+		"immutable": {"1"},
+		"_pragma":   {fmt.Sprintf("mmap_size(%d)", sqliteMmapSize)},
+	}))
+	if err != nil {
+		panic(err)
+	}
+
+	// database/sql opens connections lazily, so open the whole pool up
+	// front before we unlink the file, the same as we do for the other
+	// tables.  Goroutines beyond the pool size wait for a free connection.
+	poolSize := runtime.NumCPU()
+	db.SetMaxOpenConns(poolSize)
+	db.SetMaxIdleConns(poolSize)
+	conns := make([]*sql.Conn, 0, poolSize)
+	for i := 0; i < poolSize; i++ {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			panic(err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		if err := conn.Close(); err != nil {
+			panic(err)
+		}
+	}
+
+	get, err := db.Prepare(`SELECT v FROM kv WHERE k = ?`)
+	if err != nil {
+		panic(err)
+	}
+
+	return &sqliteTable{db: db, get: get}
+}
+
+// createMutableSqliteTable builds a table and opens it for writing too, in
+// WAL mode so that readers don't block on writers, returning it and a
+// function closing it and removing its files.
+func createMutableSqliteTable(testDataPath string) (*sqliteTable, func()) {
+	tableFile, err := newTableFile("bit-test.*.data")
+	if err != nil {
+		panic(err)
+	}
+	if err = tableFile.Close(); err != nil {
+		panic(err)
+	}
+	remove := func() {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			_ = os.Remove(tableFile.Name() + suffix)
+		}
+	}
+	buildSqliteTable(testDataPath, tableFile.Name())
+	// writers wait for each other rather than failing with SQLITE_BUSY.
+	db, err := sql.Open("sqlite", sqliteDSN(tableFile.Name(), url.Values{
+		"_pragma": {"journal_mode(WAL)", "synchronous(OFF)", "busy_timeout(10000)", fmt.Sprintf("mmap_size(%d)", sqliteMmapSize)},
+	}))
+	if err != nil {
+		remove()
+		panic(err)
+	}
+	get, err := db.Prepare(`SELECT v FROM kv WHERE k = ?`)
+	if err != nil {
+		_ = db.Close()
+		remove()
+		panic(err)
+	}
+	return &sqliteTable{db: db, get: get}, func() {
+		_ = db.Close()
+		remove()
+	}
+}
+
+// buildSqliteTable replaces the file at path with a database of the
+// testdata.
+func buildSqliteTable(testDataPath, path string) {
+	if err := os.Remove(path); err != nil {
+		panic(err)
+	}
+
+	// durability doesn't matter while building a table we're about to
+	// reopen.
+	db, err := sql.Open("sqlite", sqliteDSN(path, url.Values{
+		"_pragma": {"journal_mode(OFF)", "synchronous(OFF)"},
+	}))
+	if err != nil {
+		panic(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE kv (k TEXT NOT NULL, v TEXT NOT NULL)`); err != nil {
+		panic(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		panic(err)
+	}
+	insert, err := tx.Prepare(`INSERT INTO kv (k, v) VALUES (?, ?)`)
+	if err != nil {
+		panic(err)
+	}
+	streamTestFile(testDataPath, func(k, v []byte) {
+		if _, err := insert.Exec(string(k), string(v)); err != nil {
+			panic(err)
+		}
+	})
+	if err := insert.Close(); err != nil {
+		panic(err)
+	}
+	if err := tx.Commit(); err != nil {
+		panic(err)
+	}
+	// building the index after the rows are in is much faster than
+	// maintaining it on every insert.
+	if _, err := db.Exec(`CREATE UNIQUE INDEX kv_k ON kv (k)`); err != nil {
+		panic(err)
+	}
+	if err := db.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func BenchmarkSqliteGet(b *testing.B) {
+	loadTable(b, "sqlite", &benchTableSqliteOnce, loadSqliteBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "sqlite", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		var value []byte
+		for b.Next() {
+			entry := benchEntries[i]
+			err := benchTableSqlite.get.QueryRow(entry.Key).Scan(&value)
+			if !entry.matches(value, err == nil) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableSqliteCreate *sqliteTable
+
+func BenchmarkSqliteCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		if benchTableSqliteCreate != nil {
+			_ = benchTableSqliteCreate.db.Close()
+		}
+		benchTableSqliteCreate = buildTable(b, "sqlite", createSqliteTable, testData)
+		if benchTableSqliteCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
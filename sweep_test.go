@@ -0,0 +1,239 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Most backends have settings that trade memory, build time and lookup
+// speed, and the Get benchmarks each run with one choice of them.
+// BenchmarkSweepGet runs every combination of the values of the tunables a
+// backend declares (see backend.tunables), each as a sub-benchmark named
+// for its settings, so they end up as configuration keys in the results
+// (cache=64M and so on).  -sweep replaces the values a tunable is swept
+// over:
+//
+//	go test -run XXX -bench SweepGet -backends pebble -sweep 'pebble.cache=1M|8M|64M'
+//
+// bit's builder has no options to sweep, and Badger's table loading modes
+// went with its move to mmapping every table.
+var sweep = flag.String("sweep", "", "comma-separated `backend.tunable=values` settings for BenchmarkSweepGet to try, the values separated by |")
+
+// tunable is a setting of a backend's, and the values BenchmarkSweepGet
+// tries for it by default.
+type tunable struct {
+	name   string
+	values []string
+}
+
+// parseSweep returns the values -sweep gives tunables, keyed by
+// backend.tunable.
+func parseSweep(s string) (map[string][]string, error) {
+	values := make(map[string][]string)
+	for _, setting := range splitSweep(s, ",") {
+		name, list, ok := strings.Cut(setting, "=")
+		name = strings.TrimSpace(name)
+		backend, tunableName, dotted := strings.Cut(name, ".")
+		if !ok || !dotted || len(splitSweep(list, "|")) == 0 {
+			return nil, fmt.Errorf("bad -sweep setting %q: want backend.tunable=value|value", setting)
+		}
+		be, ok := backends[backend]
+		if !ok {
+			return nil, fmt.Errorf("-sweep: unknown backend %q", backend)
+		}
+		known := false
+		for _, t := range be.tunables {
+			known = known || t.name == tunableName
+		}
+		if !known {
+			return nil, fmt.Errorf("-sweep: %s has no tunable %q", backend, tunableName)
+		}
+		values[name] = splitSweep(list, "|")
+	}
+	return values, nil
+}
+
+func splitSweep(s, sep string) []string {
+	var fields []string
+	for _, field := range strings.Split(s, sep) {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// sweepCombinations returns every combination of values for tunables, each
+// a map from tunable name to value, in the order the sub-benchmarks run:
+// the last tunable varies fastest.  overrides replaces a tunable's values,
+// keyed by backend.tunable.
+func sweepCombinations(backend string, tunables []tunable, overrides map[string][]string) []map[string]string {
+	combinations := []map[string]string{{}}
+	for _, t := range tunables {
+		values := t.values
+		if v, ok := overrides[backend+"."+t.name]; ok {
+			values = v
+		}
+		var next []map[string]string
+		for _, c := range combinations {
+			for _, v := range values {
+				params := make(map[string]string, len(c)+1)
+				for k, cv := range c {
+					params[k] = cv
+				}
+				params[t.name] = v
+				next = append(next, params)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+// sweepName is the sub-benchmark name for params.
+func sweepName(tunables []tunable, params map[string]string) string {
+	parts := make([]string, len(tunables))
+	for i, t := range tunables {
+		parts[i] = t.name + "=" + params[t.name]
+	}
+	return strings.Join(parts, "/")
+}
+
+// parseTunableSize parses a size in bytes with an optional K, M or G
+// suffix, for the powers of 1024, panicking if it's malformed as the
+// backends' open functions do on a failed build.
+func parseTunableSize(s string) int64 {
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		panic(fmt.Sprintf("bad size %q", s))
+	}
+	return n << shift
+}
+
+func BenchmarkSweepGet(b *testing.B) {
+	overrides, err := parseSweep(*sweep)
+	if err != nil {
+		b.Fatal(err)
+	}
+	loadBenchTables(b)
+
+	for _, be := range sortedBackends() {
+		if be.openTuned == nil {
+			continue
+		}
+		b.Run(be.name, func(b *testing.B) {
+			be.skipIfUnavailable(b)
+			for _, params := range sweepCombinations(be.name, be.tunables, overrides) {
+				b.Run(sweepName(be.tunables, params), func(b *testing.B) {
+					// a hung build of one combination would
+					// likely hang the next too.
+					be.skipIfUnavailable(b)
+					table := buildTable(b, be.name, func(path string) backendTable {
+						return be.openTuned(path, params)
+					}, testData)
+					defer table.close()
+					prewarmTable(b, table)
+
+					b.ReportAllocs()
+					b.ResetTimer()
+					faults := startPageFaults()
+					runParallel(b, be.name, func(b *testing.PB) {
+						defer pinWorker()()
+						get, release := table.reader()
+						defer release()
+						entryCount := len(benchEntries)
+						i := rand.Int() % entryCount
+						for b.Next() {
+							entry := benchEntries[i]
+							value, ok := get(entry.Key)
+							if !entry.matches(value, ok) {
+								panic("bad data or lookup")
+							}
+							i = (i + 1) % entryCount
+						}
+					})
+					reportGetThroughput(b)
+					faults.report(b)
+				})
+			}
+		})
+	}
+}
+
+func TestSweepCombinations(t *testing.T) {
+	tunables := []tunable{
+		{name: "cache", values: []string{"8M", "64M"}},
+		{name: "block", values: []string{"4K"}},
+	}
+	var names []string
+	for _, params := range sweepCombinations("pebble", tunables, map[string][]string{"pebble.block": {"4K", "16K"}}) {
+		names = append(names, sweepName(tunables, params))
+	}
+	want := "cache=8M/block=4K cache=8M/block=16K cache=64M/block=4K cache=64M/block=16K"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+
+	if got, err := parseSweep(" pebble.cache = 1M|2M "); err != nil || strings.Join(got["pebble.cache"], "|") != "1M|2M" {
+		t.Errorf("parseSweep: got %v, %v", got, err)
+	}
+	for _, bad := range []string{"pebble.cache", "pebble=1M", "pebble.nope=1M", "nope.cache=1M", "pebble.cache="} {
+		if _, err := parseSweep(bad); err == nil {
+			t.Errorf("parseSweep(%q) succeeded", bad)
+		}
+	}
+	if got := parseTunableSize("64M"); got != 64<<20 {
+		t.Errorf("parseTunableSize(64M) = %d", got)
+	}
+}
+
+func TestTunedBackends(t *testing.T) {
+	path := writeGeneratedTestData(t, 1000, 0)
+	var entries []benchEntry
+	streamTestFile(path, func(k, v []byte) {
+		entries = append(entries, benchEntry{Key: string(k), Value: string(v)})
+	})
+
+	for _, b := range sortedBackends() {
+		if b.openTuned == nil {
+			continue
+		}
+		t.Run(b.name, func(t *testing.T) {
+			b.skipIfUnavailable(t)
+			for _, params := range sweepCombinations(b.name, b.tunables, nil) {
+				table := buildTable(t, b.name, func(path string) backendTable {
+					return b.openTuned(path, params)
+				}, path)
+				get, release := table.reader()
+				for _, entry := range entries[:100] {
+					if value, ok := get(entry.Key); !ok || string(value) != entry.Value {
+						t.Errorf("%s: %s: got %q, %v; want %q", sweepName(b.tunables, params), entry.Key, value, ok, entry.Value)
+						break
+					}
+				}
+				release()
+				table.close()
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/cockroachdb/swiss"
+)
+
+// The Go runtime's own map has been a Swiss table since Go 1.24, so the
+// difference between this and BenchmarkMapGet is largely down to
+// implementation details (hashing, group width, probing) rather than design.
+// Like the builtin map, a swiss.Map isn't goroutine-safe, but concurrent
+// Gets are fine once nothing is writing to it.
+
+var (
+	benchTableSwissOnce sync.Once
+	benchTableSwiss     *swiss.Map[string, string]
+)
+
+func init() {
+	registerBackend(backend{
+		name: "swiss",
+		open: func(path string) backendTable {
+			return backendTable{
+				newReader: sharedReader(stringLookup(createSwissTable(path).Get)),
+				close:     noClose,
+			}
+		},
+		duplicates: duplicatesLastWins,
+		benchTable: func() backendTable {
+			benchTableSwissOnce.Do(loadSwissBenchTable)
+			return backendTable{
+				newReader: sharedReader(stringLookup(benchTableSwiss.Get)),
+				close:     noClose,
+			}
+		},
+	})
+}
+
+func loadSwissBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableSwiss = createSwissTable(testData)
+}
+
+func createSwissTable(testDataPath string) *swiss.Map[string, string] {
+	data := swiss.New[string, string](0)
+
+	streamTestFile(testDataPath, func(k, v []byte) {
+		data.Put(string(k), string(v))
+	})
+
+	return data
+}
+
+func BenchmarkSwissGet(b *testing.B) {
+	loadTable(b, "swiss", &benchTableSwissOnce, loadSwissBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "swiss", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := benchTableSwiss.Get(entry.Key)
+			if !entry.matches(zerocopy.Bytes(value), ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+)
+
+var (
+	benchTableSyncMapOnce sync.Once
+	benchTableSyncMap     *sync.Map
+)
+
+func init() {
+	open := func(path string) backendTable {
+		return newSyncMapBackendTable(createSyncMapTable(path))
+	}
+	registerBackend(backend{
+		name:        "syncmap",
+		open:        open,
+		duplicates:  duplicatesLastWins,
+		openMutable: open,
+		benchTable: func() backendTable {
+			benchTableSyncMapOnce.Do(loadSyncMapBenchTable)
+			return newSyncMapBackendTable(benchTableSyncMap)
+		},
+	})
+}
+
+// newSyncMapBackendTable returns the backendTable reading and writing m.
+func newSyncMapBackendTable(m *sync.Map) backendTable {
+	return backendTable{
+		newReader: sharedReader(func(key string) ([]byte, bool) {
+			value, ok := m.Load(key)
+			if !ok {
+				return nil, false
+			}
+			return zerocopy.Bytes(value.(string)), true
+		}),
+		newWriter: sharedWriter(func(key, value []byte) error {
+			m.Store(string(key), string(value))
+			return nil
+		}),
+		close: noClose,
+	}
+}
+
+func loadSyncMapBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableSyncMap = createSyncMapTable(testData)
+}
+
+func createSyncMapTable(testDataPath string) *sync.Map {
+	data := new(sync.Map)
+
+	streamTestFile(testDataPath, func(k, v []byte) {
+		data.Store(string(k), string(v))
+	})
+
+	return data
+}
+
+func BenchmarkSyncMapGet(b *testing.B) {
+	loadTable(b, "syncmap", &benchTableSyncMapOnce, loadSyncMapBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "syncmap", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := benchTableSyncMap.Load(entry.Key)
+			if s, _ := value.(string); !entry.matches(zerocopy.Bytes(s), ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+func BenchmarkSyncMapGetSerial(b *testing.B) {
+	loadTable(b, "syncmap", &benchTableSyncMapOnce, loadSyncMapBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runPhase(b, "syncmap", "benchmark", func() {
+		entryCount := len(benchEntries)
+		j := rand.Int() % entryCount
+		for i := 0; i < b.N; i++ {
+			entry := benchEntries[j]
+			value, ok := benchTableSyncMap.Load(entry.Key)
+			if s, _ := value.(string); !entry.matches(zerocopy.Bytes(s), ok) {
+				b.Fatal("bad data or lookup")
+			}
+			j = (j + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
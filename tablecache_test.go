@@ -0,0 +1,344 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tableDir, if set, is where tables are built, in place of os.TempDir()
+// (which is often a tmpfs), and opened from: pointing it at different
+// devices compares them.  The tables the Get benchmarks read are also kept
+// there between runs.  Building them from a large fixture takes far longer
+// than benchmarking them, so with -tabledir each table is built once for
+// each distinct testdata (keyed by a hash of its contents) and opened from
+// there by later runs.  The in-heap map has no on-disk form and is always
+// rebuilt.
+var tableDir string
+
+// rebuildTables forces the tables cached in tableDir to be rebuilt.
+var rebuildTables bool
+
+func init() {
+	flag.StringVar(&tableDir, "tabledir", tableDir, "build tables in `dir`, keeping the ones Get benchmarks read between runs")
+	flag.BoolVar(&rebuildTables, "rebuild", rebuildTables, "rebuild the tables in -tabledir even if they already exist")
+}
+
+var testDataDigest struct {
+	once sync.Once
+	sum  string
+	err  error
+}
+
+// testDataHash returns a hash of the (decompressed) contents of testData,
+// computed once per run.
+func testDataHash() (string, error) {
+	testDataDigest.once.Do(func() {
+		f, err := openTestFile(testData)
+		if err != nil {
+			testDataDigest.err = err
+			return
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			testDataDigest.err = err
+			return
+		}
+		testDataDigest.sum = hex.EncodeToString(h.Sum(nil))[:16]
+	})
+	return testDataDigest.sum, testDataDigest.err
+}
+
+// cachedTableDir returns the directory under tableDir holding the named
+// table for testData, calling build to create it first if it doesn't exist
+// yet or -rebuild was given.  build fills in an empty directory that is
+// only renamed into place once it succeeds, so an interrupted build is
+// never mistaken for a finished one.  It returns "" if -tabledir isn't set.
+func cachedTableDir(name string, build func(dir string) error) (string, error) {
+	if tableDir == "" {
+		return "", nil
+	}
+	sum, err := testDataHash()
+	if err != nil {
+		return "", err
+	}
+	parent := filepath.Join(tableDir, sum)
+	dir := filepath.Join(parent, name)
+	if !rebuildTables {
+		if _, err := os.Stat(dir); err == nil {
+			addTablePath(dir)
+			return dir, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(parent, "."+name+".*")
+	if err != nil {
+		return "", err
+	}
+	if err := build(tmp); err != nil {
+		_ = os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		_ = os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		_ = os.RemoveAll(tmp)
+		return "", err
+	}
+	addTablePath(dir)
+	return dir, nil
+}
+
+// tablePaths are the files and directories tables are built in: the
+// temporary ones from newTableFile and newTableDir, and those cachedTableDir
+// returns.  prewarm finds the tables' mappings by them.
+var tablePaths struct {
+	sync.Mutex
+	m map[string]bool
+}
+
+// newTableFile is os.CreateTemp in tableDir, for a table's file.
+func newTableFile(pattern string) (*os.File, error) {
+	f, err := os.CreateTemp(tableDir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	addTablePath(f.Name())
+	return f, nil
+}
+
+// newTableDir is os.MkdirTemp in tableDir, for a table's directory.
+func newTableDir(pattern string) (string, error) {
+	dir, err := os.MkdirTemp(tableDir, pattern)
+	if err != nil {
+		return "", err
+	}
+	addTablePath(dir)
+	return dir, nil
+}
+
+// addTablePath records path as a table's file or directory.
+func addTablePath(path string) {
+	// /proc/self/maps lists absolute paths.
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	tablePaths.Lock()
+	defer tablePaths.Unlock()
+	if tablePaths.m == nil {
+		tablePaths.m = make(map[string]bool)
+	}
+	tablePaths.m[path] = true
+}
+
+// isTablePath reports whether path is a table's file, one named after it
+// with an extension added (as bit names its index), or is in a table's
+// directory.
+func isTablePath(path string) bool {
+	tablePaths.Lock()
+	defer tablePaths.Unlock()
+	if tablePaths.m[strings.TrimSuffix(path, filepath.Ext(path))] {
+		return true
+	}
+	for {
+		if tablePaths.m[path] {
+			return true
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
+
+// reportTableDir prints the directory tables are built in, and the
+// filesystem and device it's on, as configuration lines in the benchmark
+// output, so that benchstat keeps results from different devices apart.
+func reportTableDir() error {
+	dir := tableDir
+	if dir == "" {
+		dir = os.TempDir()
+	} else if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	mount, err := findMount(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("tabledir: %s\n", dir)
+	fmt.Printf("tablefs: %s\n", mount.fsType)
+	fmt.Printf("tabledev: %s\n", mount.source)
+	if rotational, ok := mount.rotational(); ok {
+		fmt.Printf("tablerotational: %t\n", rotational)
+	}
+	return nil
+}
+
+// mountInfo is a line of /proc/self/mountinfo.
+type mountInfo struct {
+	device     string // major:minor
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+// findMount returns the mount dir is on; off Linux, where there's no
+// mountinfo, it reports the filesystem as unknown.
+func findMount(dir string) (mountInfo, error) {
+	unknown := mountInfo{fsType: "unknown", source: "unknown"}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return unknown, err
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if errors.Is(err, fs.ErrNotExist) {
+		return unknown, nil
+	} else if err != nil {
+		return unknown, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	// the mount is the one with the longest mount point containing dir
+	// (the last one listed, if several are stacked on the same point).
+	found := unknown
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		sep := slices.Index(fields, "-")
+		if sep < 5 || len(fields) < sep+3 {
+			continue
+		}
+		mountPoint := unescapeMountInfo(fields[4])
+		rel, err := filepath.Rel(mountPoint, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if len(mountPoint) >= len(found.mountPoint) {
+			found = mountInfo{
+				device:     fields[2],
+				mountPoint: mountPoint,
+				fsType:     fields[sep+1],
+				source:     unescapeMountInfo(fields[sep+2]),
+			}
+		}
+	}
+	return found, s.Err()
+}
+
+// unescapeMountInfo undoes the octal escapes mountinfo uses for spaces,
+// tabs, newlines and backslashes in paths.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// rotational reports whether the mount's device is a spinning disk, if it
+// is a block device at all.
+func (m mountInfo) rotational() (rotational, ok bool) {
+	if m.device == "" {
+		return false, false
+	}
+	// a partition's queue is its disk's.
+	dev := filepath.Join("/sys/dev/block", m.device)
+	for _, path := range []string{filepath.Join(dev, "queue", "rotational"), filepath.Join(dev, "..", "queue", "rotational")} {
+		if b, err := os.ReadFile(path); err == nil {
+			return strings.TrimSpace(string(b)) == "1", true
+		}
+	}
+	return false, false
+}
+
+func TestUnescapeMountInfo(t *testing.T) {
+	if got := unescapeMountInfo(`/mnt/with\040space\134`); got != `/mnt/with space\` {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestCachedTableDir(t *testing.T) {
+	defer func(dir string, rebuild bool) {
+		tableDir, rebuildTables = dir, rebuild
+	}(tableDir, rebuildTables)
+	tableDir, rebuildTables = t.TempDir(), false
+
+	builds := 0
+	build := func(dir string) error {
+		builds++
+		return os.WriteFile(filepath.Join(dir, "table"), []byte("table"), 0o644)
+	}
+	first, err := cachedTableDir("test", build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cachedTableDir("test", build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || builds != 1 {
+		t.Fatalf("got %q then %q after %d builds; want the same directory after 1", first, second, builds)
+	}
+	if _, err := os.Stat(filepath.Join(first, "table")); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuildTables = true
+	if _, err := cachedTableDir("test", build); err != nil {
+		t.Fatal(err)
+	}
+	if builds != 2 {
+		t.Fatalf("-rebuild didn't rebuild the table")
+	}
+
+	failed := errors.New("failed")
+	if _, err := cachedTableDir("failed", func(string) error { return failed }); err != failed {
+		t.Fatalf("got %v; want %v", err, failed)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(first), "failed")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("a failed build was left in place: %v", err)
+	}
+}
@@ -0,0 +1,972 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/bits"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/dgryski/go-farm"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The text testdata format is one "key:value" pair per line, so neither
+// keys nor values can contain ':' or '\n'.  The binary format lifts that
+// restriction: after an 8-byte magic and a uvarint version, each entry is
+// a uvarint key length, the key, a uvarint value length and the value,
+// until EOF.  streamTestFile tells the two apart by the magic, which starts
+// with a NUL byte no text fixture would.
+const (
+	binaryTestDataMagic   = "\x00bitdata"
+	binaryTestDataVersion = 1
+)
+
+var (
+	spooledTestDataMu sync.Mutex
+	spooledTestData   = make(map[string]string)
+)
+
+// localTestDataPath returns the path of a local file holding the testdata
+// from source, which may be "-" for stdin or an http(s) URL as well as a
+// path.  Every backend streams the testdata separately, so remote sources
+// are copied to a temporary file the first time they're used rather than
+// read again for each one; removeSpooledTestData cleans these up.
+func localTestDataPath(source string) (string, error) {
+	if source != "-" && !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return source, nil
+	}
+
+	spooledTestDataMu.Lock()
+	defer spooledTestDataMu.Unlock()
+	if path, ok := spooledTestData[source]; ok {
+		return path, nil
+	}
+
+	var r io.Reader
+	if source == "-" {
+		r = os.Stdin
+	} else {
+		resp, err := http.Get(source)
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("fetching %s: %s", source, resp.Status)
+		}
+		r = resp.Body
+	}
+
+	// openTestFile picks a decompressor by extension, so sniff the
+	// compression format from the stream and name the copy to match.
+	br := bufio.NewReaderSize(r, 64*1024)
+	ext := ""
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		ext = ".gz"
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		ext = ".zst"
+	}
+
+	f, err := os.CreateTemp("", "bit-test.*.testdata"+ext)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, br); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("reading %s: %w", source, err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	spooledTestData[source] = f.Name()
+	return f.Name(), nil
+}
+
+// removeSpooledTestData removes the local copies localTestDataPath made.
+func removeSpooledTestData() {
+	spooledTestDataMu.Lock()
+	defer spooledTestDataMu.Unlock()
+	for source, path := range spooledTestData {
+		_ = os.Remove(path)
+		delete(spooledTestData, source)
+	}
+}
+
+// testFile is an open testdata file, decompressed if need be.
+type testFile struct {
+	io.Reader
+	f     *os.File
+	close func() error
+}
+
+// openTestFile opens path for reading, transparently decompressing it if
+// its name ends in .gz or .zst.
+func openTestFile(path string) (*testFile, error) {
+	path, err := localTestDataPath(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	tf := &testFile{Reader: f, f: f}
+	switch filepath.Ext(path) {
+	case ".gz":
+		zr, err := gzip.NewReader(bufio.NewReaderSize(f, 64*1024))
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		tf.Reader = zr
+		// Close doesn't check the trailer, which Read does once it
+		// reaches it, but it does report a corrupt stream.
+		tf.close = zr.Close
+	case ".zst":
+		zr, err := zstd.NewReader(bufio.NewReaderSize(f, 64*1024))
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		tf.Reader = zr
+		tf.close = func() error {
+			zr.Close()
+			return nil
+		}
+	}
+	return tf, nil
+}
+
+func (tf *testFile) Close() error {
+	var err error
+	if tf.close != nil {
+		err = tf.close()
+	}
+	return errors.Join(err, tf.f.Close())
+}
+
+// testDataSize returns the size of the (decompressed) testdata at path.
+// Compressed formats don't reliably record that, so for them this has to
+// read through the whole file.
+func testDataSize(path string) int64 {
+	path, err := localTestDataPath(path)
+	if err != nil {
+		panic(err)
+	}
+	switch filepath.Ext(path) {
+	case ".gz", ".zst":
+	default:
+		fi, err := os.Stat(path)
+		if err != nil {
+			panic(err)
+		}
+		return fi.Size()
+	}
+
+	f, err := openTestFile(path)
+	if err != nil {
+		panic(err)
+	}
+	n, err := io.Copy(io.Discard, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// binaryTestDataWriter writes testdata in the binary format.
+type binaryTestDataWriter struct {
+	// f is the file written, if the writer created it.
+	f   *os.File
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func newBinaryTestDataWriter(path string) (*binaryTestDataWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newBinaryTestDataStream(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	w.f = f
+	return w, nil
+}
+
+// newBinaryTestDataStream returns a binaryTestDataWriter writing to w,
+// which its Close flushes but leaves open.
+func newBinaryTestDataStream(w io.Writer) (*binaryTestDataWriter, error) {
+	bw := &binaryTestDataWriter{w: bufio.NewWriterSize(w, 64*1024)}
+	if _, err := bw.w.WriteString(binaryTestDataMagic); err != nil {
+		return nil, err
+	}
+	if err := bw.writeUvarint(binaryTestDataVersion); err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+func (w *binaryTestDataWriter) writeUvarint(x uint64) error {
+	n := binary.PutUvarint(w.buf[:], x)
+	_, err := w.w.Write(w.buf[:n])
+	return err
+}
+
+func (w *binaryTestDataWriter) Put(key, value []byte) error {
+	if err := w.writeUvarint(uint64(len(key))); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(key); err != nil {
+		return err
+	}
+	if err := w.writeUvarint(uint64(len(value))); err != nil {
+		return err
+	}
+	_, err := w.w.Write(value)
+	return err
+}
+
+func (w *binaryTestDataWriter) Close() error {
+	err := w.w.Flush()
+	if w.f == nil {
+		return err
+	}
+	if err != nil {
+		_ = w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// isBinaryTestData reports whether r is positioned at the start of a
+// binary-format testdata file, without consuming anything.
+func isBinaryTestData(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(binaryTestDataMagic))
+	return string(magic) == binaryTestDataMagic
+}
+
+// binaryTestDataChunk is the most readBinaryTestData grows a field's
+// buffer by before reading into it, so that a corrupt length can't make it
+// allocate more than the file has.
+const binaryTestDataChunk = 1 << 20
+
+// readBinaryTestData calls put for each entry in a binary-format testdata
+// file, returning an error if it's malformed.  As with the text format, the
+// slices passed to put are only valid until it returns.
+func readBinaryTestData(r *bufio.Reader, put func(key, value []byte)) error {
+	if _, err := r.Discard(len(binaryTestDataMagic)); err != nil {
+		return err
+	}
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("reading version: %w", noEOF(err))
+	}
+	if version != binaryTestDataVersion {
+		return fmt.Errorf("unsupported binary testdata version %d", version)
+	}
+
+	readField := func(buf []byte) ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return buf, noEOF(err)
+		}
+		buf = buf[:0]
+		for n > 0 {
+			chunk := int(min(n, binaryTestDataChunk))
+			buf = slices.Grow(buf, chunk)
+			if _, err := io.ReadFull(r, buf[len(buf):len(buf)+chunk]); err != nil {
+				return buf, noEOF(err)
+			}
+			buf = buf[:len(buf)+chunk]
+			n -= uint64(chunk)
+		}
+		return buf, nil
+	}
+
+	var k, v []byte
+	for i := 0; ; i++ {
+		if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+			return nil
+		}
+		if k, err = readField(k); err != nil {
+			return fmt.Errorf("entry %d key: %w", i, err)
+		}
+		if v, err = readField(v); err != nil {
+			return fmt.Errorf("entry %d value: %w", i, err)
+		}
+		put(k, v)
+	}
+}
+
+// noEOF returns io.ErrUnexpectedEOF for io.EOF: the binary format only
+// ends between entries.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func TestBinaryTestDataRoundTrip(t *testing.T) {
+	entries := []benchEntry{
+		{Key: "plain", Value: "value"},
+		{Key: "has:colon", Value: "has\nnewline"},
+		{Key: "\x00\xff\x89binary", Value: "\r\n:\x00"},
+		{Key: "empty-value", Value: ""},
+		{Key: "long", Value: strings.Repeat("x", 100*1024)},
+	}
+
+	path := filepath.Join(t.TempDir(), "testdata.bin")
+	w, err := newBinaryTestDataWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := w.Put([]byte(entry.Key), []byte(entry.Value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []benchEntry
+	streamTestFile(path, func(k, v []byte) {
+		got = append(got, benchEntry{Key: string(k), Value: string(v)})
+	})
+	if !reflect.DeepEqual(got, entries) {
+		t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", got, entries)
+	}
+}
+
+// encodeBinaryTestData returns entries in the binary testdata format.
+func encodeBinaryTestData(tb testing.TB, entries []benchEntry) []byte {
+	var buf bytes.Buffer
+	w, err := newBinaryTestDataStream(&buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := w.Put([]byte(entry.Key), []byte(entry.Value)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadTestDataErrors(t *testing.T) {
+	binaryData := encodeBinaryTestData(t, []benchEntry{{Key: "key", Value: "value"}})
+	for name, data := range map[string]string{
+		"no colon":          "a:1\nno colon\n",
+		"line too long":     strings.Repeat("x", 70*1024) + ":long\n",
+		"no version":        binaryTestDataMagic,
+		"unknown version":   binaryTestDataMagic + "\x02",
+		"truncated value":   string(binaryData[:len(binaryData)-1]),
+		"truncated length":  binaryTestDataMagic + "\x01\x80",
+		"length past end":   binaryTestDataMagic + "\x01\xff\xff\xff\xff\xff\xff\xff\xff\x7f",
+		"key with no value": binaryTestDataMagic + "\x01\x01k",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := readTestData(strings.NewReader(data), func(k, v []byte) {}); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+// FuzzReadTestData checks that malformed testdata, in either format, is
+// reported as an error rather than panicking, and that whatever it does
+// parse survives a trip through the binary format.
+func FuzzReadTestData(f *testing.F) {
+	f.Add([]byte("a:1\nb:2\n"))
+	f.Add([]byte("no colon\n"))
+	f.Add([]byte("k:v\r\n:\n::\n"))
+	binaryData := encodeBinaryTestData(f, []benchEntry{{Key: "has:colon", Value: "has\nnewline"}, {Key: "\x00", Value: ""}})
+	f.Add(binaryData)
+	f.Add(binaryData[:len(binaryData)-1])
+	f.Add([]byte(binaryTestDataMagic))
+	f.Add([]byte(binaryTestDataMagic + "\x02"))
+	f.Add([]byte(binaryTestDataMagic + "\x01\xff\xff\xff\xff\xff\xff\xff\xff\x7f"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var got []benchEntry
+		err := readTestData(bytes.NewReader(data), func(k, v []byte) {
+			got = append(got, benchEntry{Key: string(k), Value: string(v)})
+		})
+		if err != nil {
+			return
+		}
+		var again []benchEntry
+		if err := readTestData(bytes.NewReader(encodeBinaryTestData(t, got)), func(k, v []byte) {
+			again = append(again, benchEntry{Key: string(k), Value: string(v)})
+		}); err != nil {
+			t.Fatalf("re-reading %d entries: %v", len(got), err)
+		}
+		if !slices.Equal(again, got) {
+			t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", again, got)
+		}
+	})
+}
+
+// FuzzGenerateTestData checks that what generateTestData writes reads back
+// as the entries it meant to write: n of them, each key either a repeat or
+// the next of its shape, each value "pref_" and 16 hex digits, ending in a
+// valid checksum if asked for.
+func FuzzGenerateTestData(f *testing.F) {
+	for i := range keyShapes {
+		f.Add(uint8(100), int64(1), uint8(i), uint8(0), false)
+		f.Add(uint8(100), int64(2), uint8(i), uint8(128), true)
+	}
+	f.Add(uint8(0), int64(3), uint8(0), uint8(0), false)
+	f.Add(uint8(1), int64(-1), uint8(0), uint8(255), true)
+
+	f.Fuzz(func(t *testing.T, n uint8, seed int64, shapeIndex, duplicates uint8, checksums bool) {
+		shape := keyShapes[int(shapeIndex)%len(keyShapes)]
+		var buf bytes.Buffer
+		if err := generateTestData(&buf, int(n), float64(duplicates)/256, seed, shape, checksums); err != nil {
+			t.Fatal(err)
+		}
+
+		seen := make(map[string]bool)
+		entries := 0
+		err := readTestData(&buf, func(k, v []byte) {
+			entries++
+			if !seen[string(k)] {
+				if want := shape.key(seed, len(seen)); !bytes.Equal(k, want) {
+					t.Fatalf("entry %d: key %q is neither a repeat nor the next, %q", entries-1, k, want)
+				}
+				seen[string(k)] = true
+			}
+			if checksums {
+				if !validValueChecksum(v) {
+					t.Fatalf("entry %d: value %q has a bad checksum", entries-1, v)
+				}
+				v = v[:len(v)-valueChecksumLen]
+			}
+			if digits, ok := bytes.CutPrefix(v, []byte("pref_")); !ok || len(digits) != 16 || !isLowerHex(digits) {
+				t.Fatalf("entry %d: value %q not shaped like pref_ and 16 hex digits", entries-1, v)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entries != int(n) {
+			t.Fatalf("read %d entries; want %d", entries, n)
+		}
+	})
+}
+
+// isLowerHex reports whether s is all lowercase hex digits.
+func isLowerHex(s []byte) bool {
+	for _, c := range s {
+		if strings.IndexByte(lowerHexDigits, c) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCompressedTestData(t *testing.T) {
+	const text = "a:1\nb:2\nc:3\n"
+	want := []benchEntry{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "c", Value: "3"}}
+
+	dir := t.TempDir()
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte(text))
+	_ = gw.Close()
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"testdata.gz":  gz.Bytes(),
+		"testdata.zst": zw.EncodeAll([]byte(text), nil),
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, contents, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var got []benchEntry
+		streamTestFile(path, func(k, v []byte) {
+			got = append(got, benchEntry{Key: string(k), Value: string(v)})
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+		if size := testDataSize(path); size != int64(len(text)) {
+			t.Errorf("%s: testDataSize = %d, want %d", name, size, len(text))
+		}
+	}
+}
+
+func TestCorruptGzipTestData(t *testing.T) {
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte("a:1\nb:2\n"))
+	_ = gw.Close()
+	// the trailer's last 8 bytes are the CRC-32 and size of the data.
+	corrupt := gz.Bytes()
+	corrupt[len(corrupt)-8] ^= 0xff
+	path := filepath.Join(t.TempDir(), "testdata.gz")
+	if err := os.WriteFile(path, corrupt, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, read := range map[string]func(){
+		"streamTestFile": func() { streamTestFile(path, func(k, v []byte) {}) },
+		"testDataSize":   func() { testDataSize(path) },
+	} {
+		err := func() (err any) {
+			defer func() { err = recover() }()
+			read()
+			return nil
+		}()
+		if e, ok := err.(error); !ok || !errors.Is(e, gzip.ErrChecksum) {
+			t.Errorf("%s: got %v; want %v", name, err, gzip.ErrChecksum)
+		}
+	}
+}
+
+func TestRemoteTestData(t *testing.T) {
+	const text = "a:1\nb:2\nc:3\n"
+	want := []benchEntry{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "c", Value: "3"}}
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte(text))
+	_ = gw.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/testdata":
+			_, _ = io.WriteString(w, text)
+		case "/compressed":
+			_, _ = w.Write(gz.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer removeSpooledTestData()
+
+	for _, path := range []string{"/testdata", "/compressed"} {
+		url := srv.URL + path
+		var got []benchEntry
+		streamTestFile(url, func(k, v []byte) {
+			got = append(got, benchEntry{Key: string(k), Value: string(v)})
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", path, got, want)
+		}
+		if size := testDataSize(url); size != int64(len(text)) {
+			t.Errorf("%s: testDataSize = %d, want %d", path, size, len(text))
+		}
+	}
+
+	if _, err := localTestDataPath(srv.URL + "/missing"); err == nil {
+		t.Error("expected an error fetching a missing fixture")
+	}
+}
+
+// generatedTestDataEntries is the size of the fixture generated in place of
+// testdata.large when it's missing, as it is from a clone without it.
+// Setting -entries generates one even when it isn't, for benchmarking at
+// other sizes without keeping fixtures of each around.
+var generatedTestDataEntries = flag.Int("entries", 1000000, "generate a fixture of this many `entries` if -testdata isn't set")
+
+// generatedTestDataKeys is the shape of key generated fixtures have.
+var generatedTestDataKeys = flag.String("keys", hexKeys.name, "generate fixtures with keys of this `shape`: hex, binary, unicode or url")
+
+// generatedTestDataChecksums ends each generated value in its checksum, for
+// BenchmarkChecksumGet to verify.
+var generatedTestDataChecksums = flag.Bool("checksums", false, "generate fixtures with a checksum ending each value")
+
+// generatedTestDataSeed is where generateMissingTestData starts looking for
+// a seed to generate a fixture with.
+const generatedTestDataSeed = 1
+
+// generateMissingTestData points testData at a generated fixture, unless it
+// was set with -testdata or the default fixture exists and -entries wasn't
+// set.  It must be called after the flags are parsed.  The fixture for a
+// given size is always the same, so it's kept in the temporary directory
+// and reused by later runs.
+func generateMissingTestData() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if set["testdata"] || set["generate"] {
+		return nil
+	}
+	if !set["entries"] && !set["keys"] && !set["checksums"] {
+		if _, err := os.Stat(testData); !errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+	}
+	n := *generatedTestDataEntries
+	if n <= 0 {
+		return fmt.Errorf("-entries %d: must be positive", n)
+	}
+	shape, err := lookupKeyShape(*generatedTestDataKeys)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("bit-test.generated-%d", n)
+	if shape.name != hexKeys.name {
+		name += "-" + shape.name
+	}
+	if *generatedTestDataChecksums {
+		name += "-checksums"
+	}
+	path := filepath.Join(os.TempDir(), name+".testdata")
+	if _, err := os.Stat(path); err == nil {
+		testData = path
+		return nil
+	}
+
+	if err := generateTestDataFile(path, n, shape, *generatedTestDataChecksums); err != nil {
+		return err
+	}
+	testData = path
+	return nil
+}
+
+// generateTestDataFile writes a generated fixture of n entries with keys
+// of the given shape, and checksummed values if checksums is set, to path,
+// with the first seed from generatedTestDataSeed on that bit can index.
+// It's written to a temporary file that's renamed into place, so path is
+// never left half written.
+func generateTestDataFile(path string, n int, shape keyShape, checksums bool) error {
+	seed := int64(generatedTestDataSeed)
+	for bitIndexWouldPanic(n, func(i int) []byte { return shape.key(seed, i) }) {
+		seed++
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "bit-test.*.testdata")
+	if err != nil {
+		return err
+	}
+	if err := generateTestData(f, n, 0, seed, shape, checksums); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// generatePath is where TestGenerate writes a fixture.
+var generatePath = flag.String("generate", "", "write a generated fixture of -entries entries to `path` in TestGenerate")
+
+// TestGenerate writes a generated fixture to -generate, for keeping one
+// around (or copying it to another machine):
+//
+//	go test -run TestGenerate -generate testdata.10m -entries 10000000
+func TestGenerate(t *testing.T) {
+	if *generatePath == "" {
+		t.Skip("-generate not set")
+	}
+	shape, err := lookupKeyShape(*generatedTestDataKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := generateTestDataFile(*generatePath, *generatedTestDataEntries, shape, *generatedTestDataChecksums); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// bitIndexWouldPanic reports whether building a bit table over the n
+// distinct keys key returns would panic.  The bit we build against puts
+// keys in first-level hash buckets whose capacity starts at 4 and doubles
+// whenever one overflows, but panics reading back a bucket that's exactly
+// full, so there are key sets it can't index at all.
+func bitIndexWouldPanic(n int, key func(i int) []byte) bool {
+	return bitHashesWouldPanic(n, func(i int) uint32 { return bitHash(key(i)) })
+}
+
+// bitHashesWouldPanic is bitIndexWouldPanic for n keys given by their
+// bitHash.
+func bitHashesWouldPanic(n int, hash func(i int) uint32) bool {
+	buckets := uint32(1) << (64 - bits.LeadingZeros64(uint64(n/4)))
+	counts := make([]uint32, buckets)
+	var largest uint32
+	for i := 0; i < n; i++ {
+		b := hash(i) & (buckets - 1)
+		counts[b]++
+		largest = max(largest, counts[b])
+	}
+	capacity := uint32(4)
+	for capacity < largest {
+		capacity *= 2
+	}
+	return largest == capacity
+}
+
+// bitHash is the hash bit picks a key's first-level bucket with.
+func bitHash(key []byte) uint32 {
+	return uint32(farm.Hash64WithSeed(key, 0))
+}
+
+// A keyShape is a kind of key generateTestData can generate, each made
+// from a SHA-256 sum so that they're distinct.
+type keyShape struct {
+	name string
+	// binary is whether the keys need the binary testdata format.
+	binary  bool
+	fromSum func(sum []byte) []byte
+}
+
+var (
+	// hexKeys are hex SHA-256 sums, like testdata.large's.
+	hexKeys = keyShape{name: "hex", fromSum: func(sum []byte) []byte {
+		key := make([]byte, hex.EncodedLen(len(sum)))
+		hex.Encode(key, sum)
+		return key
+	}}
+	// binaryKeys are 8 to 32 arbitrary bytes, NULs, high bytes, ':'
+	// and '\n' included.
+	binaryKeys = keyShape{name: "binary", binary: true, fromSum: func(sum []byte) []byte {
+		return bytes.Clone(sum[:8+int(sum[len(sum)-1])%25])
+	}}
+	// unicodeKeys are 12 runes of 2, 3 and 4 byte UTF-8.
+	unicodeKeys = keyShape{name: "unicode", binary: true, fromSum: func(sum []byte) []byte {
+		var key []byte
+		for _, c := range sum[:12] {
+			key = utf8.AppendRune(key, unicodeKeyRunes[c>>6]+rune(c&63))
+		}
+		return key
+	}}
+	// urlKeys are URLs on a handful of hosts, under a handful of paths
+	// on each, so that most of any key is shared with many others: the
+	// hash tables compare a lot of bytes of a key to find entries like
+	// it are different, and the tries and FSTs share them.
+	urlKeys = keyShape{name: "url", binary: true, fromSum: func(sum []byte) []byte {
+		host := urlKeyHosts[int(sum[0])%len(urlKeyHosts)]
+		section := urlKeySections[int(sum[1])%len(urlKeySections)]
+		return fmt.Appendf(nil, "https://%s/%s/%d/%d", host, section, sum[2]%32, binary.BigEndian.Uint64(sum[8:16]))
+	}}
+)
+
+// keyShapes are the shapes of key -keys can choose.
+var keyShapes = []keyShape{hexKeys, binaryKeys, unicodeKeys, urlKeys}
+
+var (
+	urlKeyHosts    = []string{"www.example.com", "cdn.example.com", "api.example.com", "static.example.net"}
+	urlKeySections = []string{"products", "users", "images/thumbnails", "docs/reference", "search", "articles/2021"}
+)
+
+// unicodeKeyRunes are where the blocks of 64 runes unicodeKeys are made of
+// start: Latin-1 letters, Cyrillic, CJK ideographs and emoji.
+var unicodeKeyRunes = [4]rune{0xc0, 0x410, 0x4e00, 0x1f600}
+
+func lookupKeyShape(name string) (keyShape, error) {
+	for _, shape := range keyShapes {
+		if shape.name == name {
+			return shape, nil
+		}
+	}
+	return keyShape{}, fmt.Errorf("-keys %q: not hex, binary, unicode or url", name)
+}
+
+// key returns the i'th distinct key generateTestData writes with the given
+// seed.
+func (s keyShape) key(seed int64, i int) []byte {
+	sum := sha256.Sum256([]byte(strconv.FormatInt(seed, 10) + ":" + strconv.Itoa(i)))
+	return s.fromSum(sum[:])
+}
+
+// generateTestData writes n entries to w with keys of the given shape and
+// a "pref_"-prefixed hex value, so that hex keys make a fixture shaped
+// like testdata.large, in the text testdata format, and other shapes one
+// in the binary format.  If checksums is set, each value ends in its
+// checksum (see appendValueChecksum).  A duplicates fraction of the
+// entries after the first repeat a key already written, with a new value,
+// to exercise how tables handle repeated keys.  The output is determined
+// by seed.
+func generateTestData(w io.Writer, n int, duplicates float64, seed int64, shape keyShape, checksums bool) error {
+	var put func(key, value []byte) error
+	var flush func() error
+	if shape.binary {
+		tw, err := newBinaryTestDataStream(w)
+		if err != nil {
+			return err
+		}
+		put, flush = tw.Put, tw.Close
+	} else {
+		bw := bufio.NewWriter(w)
+		put = func(key, value []byte) error {
+			_, err := fmt.Fprintf(bw, "%s:%s\n", key, value)
+			return err
+		}
+		flush = bw.Flush
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+
+	var keys [][]byte
+	var value [8]byte
+	for i := 0; i < n; i++ {
+		var key []byte
+		if len(keys) > 0 && rng.Float64() < duplicates {
+			key = keys[rng.Intn(len(keys))]
+		} else {
+			key = shape.key(seed, len(keys))
+			keys = append(keys, key)
+		}
+		_, _ = rng.Read(value[:])
+		v := fmt.Appendf(nil, "pref_%x", value)
+		if checksums {
+			v = appendValueChecksum(v)
+		}
+		if err := put(key, v); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+func TestBitIndexWouldPanic(t *testing.T) {
+	const n = 2000
+	// find a seed whose keys bit can index and one whose it can't.
+	seeds := make(map[bool]int64)
+	for seed := int64(1); len(seeds) < 2; seed++ {
+		if seed > 1000 {
+			t.Fatal("no seed found for both outcomes")
+		}
+		wouldPanic := bitIndexWouldPanic(n, func(i int) []byte { return hexKeys.key(seed, i) })
+		if _, ok := seeds[wouldPanic]; !ok {
+			seeds[wouldPanic] = seed
+		}
+	}
+
+	for wouldPanic, seed := range seeds {
+		path := filepath.Join(t.TempDir(), "testdata")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := generateTestData(f, n, 0, seed, hexKeys, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		panicked := func() (panicked bool) {
+			defer func() {
+				panicked = recover() != nil
+			}()
+			createBitTable(path)
+			return false
+		}()
+		if panicked != wouldPanic {
+			t.Errorf("seed %d: building panicked = %v; predicted %v", seed, panicked, wouldPanic)
+		}
+	}
+}
+
+func TestKeyShapes(t *testing.T) {
+	const n = 1000
+	for _, shape := range keyShapes {
+		t.Run(shape.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := generateTestData(&buf, n, 0, 1, shape, false); err != nil {
+				t.Fatal(err)
+			}
+			if got := isBinaryTestData(bufio.NewReader(bytes.NewReader(buf.Bytes()))); got != shape.binary {
+				t.Fatalf("binary format: got %v; want %v", got, shape.binary)
+			}
+			path := filepath.Join(t.TempDir(), "testdata")
+			if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			var nul, high, multibyte, urls int
+			i := 0
+			streamTestFile(path, func(k, v []byte) {
+				if want := shape.key(1, i); !bytes.Equal(k, want) {
+					t.Fatalf("key %d: got %q; want %q", i, k, want)
+				}
+				i++
+				if bytes.IndexByte(k, 0) >= 0 {
+					nul++
+				}
+				if bytes.IndexFunc(k, func(r rune) bool { return r >= utf8.RuneSelf }) >= 0 {
+					high++
+				}
+				if utf8.Valid(k) && utf8.RuneCount(k) < len(k) {
+					multibyte++
+				}
+				if bytes.HasPrefix(k, []byte("https://")) {
+					urls++
+				}
+			})
+			if i != n {
+				t.Fatalf("got %d entries; want %d", i, n)
+			}
+			switch shape.name {
+			case binaryKeys.name:
+				if nul == 0 || high == 0 {
+					t.Errorf("%d keys with NULs and %d with high bytes; want some of each", nul, high)
+				}
+			case unicodeKeys.name:
+				if multibyte != n {
+					t.Errorf("%d of %d keys are multi-byte UTF-8", multibyte, n)
+				}
+			case urlKeys.name:
+				if urls != n {
+					t.Errorf("%d of %d keys are URLs", urls, n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"sync"
+	"testing"
+)
+
+// ns/op alone makes backends hard to compare across datasets whose values
+// differ in size, so benchmarks also report their throughput, as ops/s,
+// and the bandwidth of the values they read or write, as value-bytes/s.
+
+// meanValueSize is the mean size of benchEntries' values.  The lookup
+// benchmarks cycle through benchEntries, so over b.N lookups they read
+// about b.N times this much.
+var meanValueSize = sync.OnceValue(func() float64 {
+	if len(benchEntries) == 0 {
+		return 0
+	}
+	var n int
+	for _, entry := range benchEntries {
+		n += len(entry.Value)
+	}
+	return float64(n) / float64(len(benchEntries))
+})
+
+// reportThroughput reports the rate of b's ops operations, which read or
+// wrote valueBytes bytes of values between them.
+func reportThroughput(b *testing.B, ops int, valueBytes float64) {
+	elapsed := b.Elapsed()
+	if elapsed <= 0 {
+		return
+	}
+	b.ReportMetric(float64(ops)/elapsed.Seconds(), "ops/s")
+	b.ReportMetric(valueBytes/elapsed.Seconds(), "value-bytes/s")
+}
+
+// reportGetThroughput is reportThroughput for a benchmark's b.N lookups
+// of benchEntries' values.
+func reportGetThroughput(b *testing.B) {
+	reportThroughput(b, b.N, float64(b.N)*meanValueSize())
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bpowers/bit"
+	"github.com/dgraph-io/ristretto/v2"
+)
+
+// zipfS is the skew of the Zipfian probe distribution used by the tiered
+// cache benchmarks; 1.1 is in the range usually observed for web and
+// key/value serving traffic.
+const zipfS = 1.1
+
+// tieredCacheFractions are the cache sizes, as a fraction of the number of
+// entries in the table, that BenchmarkTieredCacheZipfGet is run with.
+// Zero benchmarks the bare bit table under the same access pattern.
+var tieredCacheFractions = []float64{0, 0.001, 0.01, 0.1}
+
+// tieredTable fronts a bit table with a small ristretto cache.  Values are
+// cached as the slices bit returns (which alias the mmapped data file), so a
+// hit saves the index probe and key comparison but not any copying.
+type tieredTable struct {
+	cache *ristretto.Cache[string, []byte]
+	table *bit.Table
+}
+
+func newTieredTable(table *bit.Table, cacheEntries int64) *tieredTable {
+	t := &tieredTable{table: table}
+	if cacheEntries <= 0 {
+		return t
+	}
+	cache, err := ristretto.NewCache(&ristretto.Config[string, []byte]{
+		// the ristretto docs recommend ~10x as many counters as
+		// entries expected in the cache when full.
+		NumCounters:        10 * cacheEntries,
+		MaxCost:            cacheEntries,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	t.cache = cache
+	return t
+}
+
+// GetString returns the value for key, and whether it was served from the
+// cache.
+func (t *tieredTable) GetString(key string) (value []byte, ok, hit bool) {
+	if t.cache != nil {
+		if value, ok := t.cache.Get(key); ok {
+			return value, true, true
+		}
+	}
+	value, ok = t.table.GetString(key)
+	if ok && t.cache != nil {
+		t.cache.Set(key, value, 1)
+	}
+	return value, ok, false
+}
+
+// newZipfProbes returns a generator of indexes into benchEntries following a
+// Zipfian distribution.  benchEntries is already in random order, so the hot
+// keys are scattered across the table rather than clustered.
+func newZipfProbes(seed int64) *rand.Zipf {
+	return rand.NewZipf(rand.New(rand.NewSource(seed)), zipfS, 1, uint64(len(benchEntries)-1))
+}
+
+func BenchmarkTieredCacheZipfGet(b *testing.B) {
+	loadBenchTables(b)
+
+	for _, fraction := range tieredCacheFractions {
+		cacheEntries := int64(fraction * float64(len(benchHashmap)))
+		b.Run(fmt.Sprintf("cache=%g", fraction), func(b *testing.B) {
+			table := newTieredTable(benchTableBit, cacheEntries)
+			if table.cache != nil {
+				defer table.cache.Close()
+			}
+
+			prewarm(b)
+			// give the cache's admission policy a chance to see the
+			// hot keys before we start timing.
+			warm := newZipfProbes(rand.Int63())
+			for i := 0; i < len(benchEntries); i++ {
+				table.GetString(benchEntries[warm.Uint64()].Key)
+			}
+			if table.cache != nil {
+				table.cache.Wait()
+			}
+
+			var lookups, hits, valueBytes atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			faults := startPageFaults()
+			runParallel(b, "bit", func(b *testing.PB) {
+				defer pinWorker()()
+				probes := newZipfProbes(rand.Int63())
+				var n, h, nb int64
+				for b.Next() {
+					entry := benchEntries[probes.Uint64()]
+					value, ok, hit := table.GetString(entry.Key)
+					if !entry.matches(value, ok) {
+						panic("bad data or lookup")
+					}
+					n++
+					nb += int64(len(value))
+					if hit {
+						h++
+					}
+				}
+				lookups.Add(n)
+				hits.Add(h)
+				valueBytes.Add(nb)
+			})
+			b.StopTimer()
+			// the hot values are read far more often than the
+			// rest, so their sizes are counted rather than
+			// assumed to average out.
+			reportThroughput(b, b.N, float64(valueBytes.Load()))
+			faults.report(b)
+			if n := lookups.Load(); n > 0 {
+				b.ReportMetric(float64(hits.Load())/float64(n), "hit-ratio")
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A backend that hangs, say a cgo store stuck compacting, would otherwise
+// hang the whole run until go test's -timeout kills it, losing every
+// result not yet printed.  The benchmarks instead build each table and run
+// each timed phase under -phase-timeout (a timed phase gets -benchtime on
+// top; see timeoutFor), as -verify does its checks: one that takes longer
+// fails its benchmark, and its backend is skipped from
+// then on.  The hung goroutine can't be stopped, so it's left behind,
+// still holding whatever it holds.
+var phaseTimeout = flag.Duration("phase-timeout", 5*time.Minute, "fail a backend that takes longer than this `duration` to build a table, or than this beyond -benchtime to run a benchmark (0 waits forever)")
+
+// hungBackends are the backends that have run past -phase-timeout, with
+// what they were doing.  It's only used from the goroutines running tests
+// and benchmarks, which run one at a time.
+var hungBackends = make(map[string]string)
+
+// runPhase runs f, a phase of the named backend's test or benchmark tb, in
+// a goroutine of its own, which lets tb fail, marking the backend hung,
+// if f hasn't returned within -phase-timeout.  f may call tb's FailNow and
+// SkipNow methods (and those calling them) as if it were tb's goroutine.
+// tb is skipped if the backend has already hung.
+func runPhase(tb testing.TB, name, phase string, f func()) {
+	tb.Helper()
+	if reason := hungBackends[name]; reason != "" {
+		tb.Skipf("%s: %s", name, reason)
+	}
+	returned, timedOut := awaitPhase(f, timeoutFor(phase))
+	switch {
+	case timedOut:
+		tb.Fatal(markHung(name, phase, tb.Name()))
+	case !returned:
+		// f's FailNow or SkipNow only ended its own goroutine.
+		if tb.Skipped() {
+			tb.SkipNow()
+		}
+		tb.FailNow()
+	}
+}
+
+// runDetachedPhase is runPhase for a phase run outside of any test or
+// benchmark, in where (as -verify's are), returning an error rather than
+// failing one.  With no test to fail, a panic in f, the way the create*Table
+// functions report a failed build, is returned as the error too.
+func runDetachedPhase(name, phase, where string, f func()) error {
+	if reason := hungBackends[name]; reason != "" {
+		return fmt.Errorf("%s: %s", name, reason)
+	}
+	var failed error
+	_, timedOut := awaitPhase(func() {
+		defer func() {
+			if r := recover(); r != nil {
+				failed = fmt.Errorf("%s: %s failed in %s: %v", name, phase, where, r)
+			}
+		}()
+		f()
+	}, timeoutFor(phase))
+	if timedOut {
+		return markHung(name, phase, where)
+	}
+	return failed
+}
+
+// markHung marks the named backend hung in phase of where, returning the
+// error saying so.
+func markHung(name, phase, where string) error {
+	reason := fmt.Sprintf("%s hung for over %v in %s", phase, timeoutFor(phase), where)
+	hungBackends[name] = reason
+	return fmt.Errorf("%s: %s", name, reason)
+}
+
+// timeoutFor is how long a phase gets before it's taken to have hung:
+// -phase-timeout, other than for "benchmark" phases, which run for as long
+// as -benchtime asks.  The testing package aims the last round of a
+// benchmark at -benchtime but can overshoot it by a fifth, so a benchmark
+// phase gets twice -benchtime on top of -phase-timeout.  How long a
+// -benchtime of a count of iterations takes isn't known, so with one,
+// benchmark phases aren't timed at all.
+func timeoutFor(phase string) time.Duration {
+	if phase != "benchmark" || *phaseTimeout == 0 {
+		return *phaseTimeout
+	}
+	f := flag.Lookup("test.benchtime")
+	if f == nil {
+		return *phaseTimeout
+	}
+	benchTime, err := time.ParseDuration(f.Value.String())
+	if err != nil {
+		// a count, like 100x.
+		return 0
+	}
+	return *phaseTimeout + 2*benchTime
+}
+
+// awaitPhase runs f in a goroutine of its own, reporting whether it
+// returned, rather than ending the goroutine with runtime.Goexit, or that
+// it timed out still running after timeout (unless that's 0).
+func awaitPhase(f func(), timeout time.Duration) (returned, timedOut bool) {
+	done := make(chan bool, 1)
+	go func() {
+		returned := false
+		defer func() { done <- returned }()
+		f()
+		returned = true
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case returned := <-done:
+		return returned, false
+	case <-expired:
+		return false, true
+	}
+}
+
+// buildTable returns open(path), the named backend's table, built under
+// -phase-timeout.  It's generic so that the Create benchmarks can build
+// their backends' own types of table with it.
+func buildTable[T any](tb testing.TB, name string, open func(path string) T, path string) T {
+	tb.Helper()
+	var table T
+	runPhase(tb, name, "build", func() {
+		table = open(path)
+	})
+	return table
+}
+
+// loadTable is once.Do(load), loading the named backend's table for its Get
+// benchmarks under -phase-timeout, after the tables (and entries) of
+// loadBenchTable that every load needs.  A load that hangs leaves once
+// locked for good, but the backend is skipped from then on rather than
+// waiting on it.
+func loadTable(tb testing.TB, name string, once *sync.Once, load func()) {
+	tb.Helper()
+	loadBenchTables(tb)
+	runPhase(tb, name, "build", func() {
+		once.Do(load)
+	})
+}
+
+// benchTablesName is what hungBackends calls loadBenchTable's tables, the
+// bit, cdb and map ones built from the testdata together.
+const benchTablesName = "testdata"
+
+// loadBenchTables is benchTableOnce.Do(loadBenchTable) under -phase-timeout.
+func loadBenchTables(tb testing.TB) {
+	tb.Helper()
+	runPhase(tb, benchTablesName, "build", func() {
+		benchTableOnce.Do(loadBenchTable)
+	})
+}
+
+// runParallel is b.RunParallel(body) for a benchmark of the named backend,
+// run under -phase-timeout.
+func runParallel(b *testing.B, name string, body func(*testing.PB)) {
+	b.Helper()
+	runPhase(b, name, "benchmark", func() {
+		b.RunParallel(body)
+	})
+}
+
+func TestAwaitPhase(t *testing.T) {
+	if returned, timedOut := awaitPhase(func() {}, time.Minute); !returned || timedOut {
+		t.Errorf("returning phase: got returned %v, timed out %v", returned, timedOut)
+	}
+	if returned, timedOut := awaitPhase(runtime.Goexit, time.Minute); returned || timedOut {
+		t.Errorf("exiting phase: got returned %v, timed out %v", returned, timedOut)
+	}
+	hang := make(chan struct{})
+	defer close(hang)
+	if returned, timedOut := awaitPhase(func() { <-hang }, 10*time.Millisecond); returned || !timedOut {
+		t.Errorf("hung phase: got returned %v, timed out %v", returned, timedOut)
+	}
+
+	ran := false
+	t.Run("skip", func(t *testing.T) {
+		runPhase(t, "test", "build", func() {
+			ran = true
+			t.SkipNow()
+		})
+		t.Error("runPhase returned after its phase skipped")
+	})
+	if !ran || hungBackends["test"] != "" {
+		t.Errorf("runPhase didn't run its phase, or marked the backend hung")
+	}
+
+	err := runDetachedPhase("test", "build", "-verify", func() { panic("no table") })
+	if err == nil || !strings.Contains(err.Error(), "no table") {
+		t.Errorf("panicking detached phase: got error %v", err)
+	}
+}
+
+func TestLongBenchmarkPhase(t *testing.T) {
+	defer func(timeout time.Duration) { *phaseTimeout = timeout }(*phaseTimeout)
+	defer func(benchTime string) { _ = flag.Set("test.benchtime", benchTime) }(flag.Lookup("test.benchtime").Value.String())
+	*phaseTimeout = 20 * time.Millisecond
+	if err := flag.Set("test.benchtime", "200ms"); err != nil {
+		t.Fatal(err)
+	}
+
+	var longest time.Duration
+	result := testing.Benchmark(func(b *testing.B) {
+		start := time.Now()
+		runParallel(b, "slow", func(pb *testing.PB) {
+			for pb.Next() {
+				time.Sleep(time.Millisecond)
+			}
+		})
+		longest = max(longest, time.Since(start))
+	})
+	if reason := hungBackends["slow"]; reason != "" {
+		t.Fatalf("a benchmark running for -benchtime was marked hung: %s", reason)
+	}
+	if result.N == 0 || longest <= *phaseTimeout {
+		t.Fatalf("the benchmark ran %d times, for at most %v; want it past -phase-timeout's %v", result.N, longest, *phaseTimeout)
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build !unix
+
+package bitbenchmark
+
+import "testing"
+
+// vellumUnavailable is why the vellum benchmarks are skipped off unix: the
+// values log is mapped with x/sys/unix's Mmap; see vellum_test.go.
+const vellumUnavailable = "the vellum backend only builds on unix"
+
+func init() {
+	registerUnavailableBackend("vellum", vellumUnavailable)
+}
+
+func BenchmarkVellumGet(b *testing.B) {
+	b.Skip(vellumUnavailable)
+}
+
+func BenchmarkVellumCreate(b *testing.B) {
+	b.Skip(vellumUnavailable)
+}
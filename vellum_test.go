@@ -0,0 +1,203 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+//go:build unix
+
+package bitbenchmark
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+	"github.com/couchbase/vellum"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	benchTableVellumOnce sync.Once
+	benchTableVellum     *vellumTable
+)
+
+// vellumTable maps each key through an FST to the offset of its value in an
+// mmapped log of uvarint-length-prefixed values.  For keys with long shared
+// prefixes the FST can be far smaller than a hash index over the same keys.
+// The log is mapped with mmap(2), so it's only built on unix;
+// vellum_other_test.go stands in for it elsewhere.
+type vellumTable struct {
+	fst    *vellum.FST
+	values []byte
+}
+
+func (t *vellumTable) Get(key []byte) ([]byte, bool) {
+	off, ok, err := t.fst.Get(key)
+	if err != nil || !ok {
+		return nil, false
+	}
+	n, sz := binary.Uvarint(t.values[off:])
+	if sz <= 0 {
+		return nil, false
+	}
+	start := off + uint64(sz)
+	return t.values[start : start+n], true
+}
+
+func init() {
+	registerBackend(backend{
+		name: "vellum",
+		open: func(path string) backendTable {
+			return newVellumBackendTable(createVellumTable(path))
+		},
+		// Insert accepts a repeated key (it only rejects keys that
+		// sort before the last one), but which value the FST keeps
+		// isn't documented.
+		duplicates:   duplicatesAnyWins,
+		lookupAllocs: 1,
+		benchTable: func() backendTable {
+			benchTableVellumOnce.Do(loadVellumBenchTable)
+			return newVellumBackendTable(benchTableVellum)
+		},
+	})
+}
+
+// newVellumBackendTable returns the backendTable reading t.
+func newVellumBackendTable(t *vellumTable) backendTable {
+	return backendTable{
+		newBytesReader: sharedBytesReader(t.Get),
+		close: func() {
+			_ = t.fst.Close()
+			_ = unix.Munmap(t.values)
+		},
+	}
+}
+
+func loadVellumBenchTable() {
+	benchTableOnce.Do(loadBenchTable)
+	benchTableVellum = createVellumTable(testData)
+}
+
+func createVellumTable(testDataPath string) *vellumTable {
+	fstFile, err := newTableFile("bit-test.*.fst")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.Remove(fstFile.Name())
+	}()
+	valuesFile, err := newTableFile("bit-test.*.data")
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_ = os.Remove(valuesFile.Name())
+	}()
+
+	// the FST builder requires keys in lexicographic order, so (unlike the
+	// other builders) we have to buffer and sort the whole dataset first.
+	var entries []benchEntry
+	streamTestFile(testDataPath, func(k, v []byte) {
+		entries = append(entries, benchEntry{Key: string(k), Value: string(v)})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	fstWriter := bufio.NewWriter(fstFile)
+	builder, err := vellum.New(fstWriter, nil)
+	if err != nil {
+		panic(err)
+	}
+	valuesWriter := bufio.NewWriter(valuesFile)
+	var off uint64
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, entry := range entries {
+		if err := builder.Insert(zerocopy.Bytes(entry.Key), off); err != nil {
+			panic(err)
+		}
+		n := binary.PutUvarint(lenBuf[:], uint64(len(entry.Value)))
+		if _, err := valuesWriter.Write(lenBuf[:n]); err != nil {
+			panic(err)
+		}
+		if _, err := valuesWriter.WriteString(entry.Value); err != nil {
+			panic(err)
+		}
+		off += uint64(n + len(entry.Value))
+	}
+	if err := builder.Close(); err != nil {
+		panic(err)
+	}
+	if err := fstWriter.Flush(); err != nil {
+		panic(err)
+	}
+	if err := fstFile.Close(); err != nil {
+		panic(err)
+	}
+	if err := valuesWriter.Flush(); err != nil {
+		panic(err)
+	}
+
+	fst, err := vellum.Open(fstFile.Name())
+	if err != nil {
+		panic(err)
+	}
+	values, err := unix.Mmap(int(valuesFile.Fd()), 0, int(off), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		panic(err)
+	}
+	if err := valuesFile.Close(); err != nil {
+		panic(err)
+	}
+
+	return &vellumTable{fst: fst, values: values}
+}
+
+func BenchmarkVellumGet(b *testing.B) {
+	loadTable(b, "vellum", &benchTableVellumOnce, loadVellumBenchTable)
+	prewarm(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, "vellum", func(b *testing.PB) {
+		defer pinWorker()()
+		entryCount := len(benchEntries)
+		i := rand.Int() % entryCount
+		for b.Next() {
+			entry := benchEntries[i]
+			value, ok := benchTableVellum.Get(zerocopy.Bytes(entry.Key))
+			if !entry.matches(value, ok) {
+				panic("bad data or lookup")
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	reportGetThroughput(b)
+	faults.report(b)
+}
+
+var benchTableVellumCreate *vellumTable
+
+func BenchmarkVellumCreate(b *testing.B) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	mem := startBuildMemory()
+	for i := 0; i < b.N; i++ {
+		if benchTableVellumCreate != nil {
+			_ = benchTableVellumCreate.fst.Close()
+			_ = unix.Munmap(benchTableVellumCreate.values)
+		}
+		benchTableVellumCreate = buildTable(b, "vellum", createVellumTable, testData)
+		if benchTableVellumCreate == nil {
+			b.Fatal("bad data or lookup")
+		}
+	}
+	mem.report(b)
+	faults.report(b)
+}
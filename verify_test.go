@@ -0,0 +1,184 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The benchmarks check every value they look up, but a table that was
+// built wrong is only found out when a lookup happens to hit a bad entry,
+// perhaps half an hour into a run.  -verify builds every backend's table
+// before anything is timed and looks every key up in it once, exiting
+// with a diff of what's wrong if any of them doesn't hold the testdata.
+var verify = flag.Bool("verify", false, "before running anything, check every key's value in every backend's table")
+
+// verifyMaxDiffs is how many wrong entries verifyTable lists per table.
+const verifyMaxDiffs = 10
+
+// verifyBackends checks the table each of sortedBackends' Get benchmarks
+// look up in (the one cached in -tabledir, if it's there), writing a diff
+// for each that doesn't hold the testdata to w.  The tables are built then
+// rather than by the benchmarks, under -phase-timeout, so a backend that
+// hangs is reported (and later skipped) rather than hanging the run, and
+// one that fails to build is reported rather than crashing it.
+func verifyBackends(w io.Writer) error {
+	err := runDetachedPhase(benchTablesName, "build", "-verify", func() {
+		benchTableOnce.Do(loadBenchTable)
+	})
+	if err != nil {
+		return err
+	}
+	entries := mapEntries(benchHashmap)
+	var (
+		errs []error
+		bad  []string
+	)
+	for _, be := range sortedBackends() {
+		if be.unavailable != "" {
+			continue
+		}
+		var table backendTable
+		err := runDetachedPhase(be.name, "build", "-verify", func() {
+			if be.benchTable != nil {
+				table = be.benchTable()
+			} else {
+				table = be.open(testData)
+			}
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var ok bool
+		err = runDetachedPhase(be.name, "verify", "-verify", func() {
+			ok = verifyTable(w, be.name, table, entries)
+		})
+		if err != nil {
+			// the failed check may still be reading table, so it's
+			// left open.
+			errs = append(errs, err)
+			continue
+		}
+		if be.benchTable == nil {
+			table.close()
+		}
+		if !ok {
+			bad = append(bad, be.name)
+		}
+	}
+	if len(bad) > 0 {
+		errs = append(errs, fmt.Errorf("%s didn't hold the testdata", strings.Join(bad, ", ")))
+	}
+	return errors.Join(errs...)
+}
+
+// verifyTable looks every entry up in table, from a goroutine per CPU,
+// reporting whether they were all there with the right values.  If not,
+// it writes a diff of the wrong ones (up to verifyMaxDiffs of them) to w,
+// named for the table.
+func verifyTable(w io.Writer, name string, table backendTable, entries []benchEntry) bool {
+	type diff struct {
+		entry benchEntry
+		value []byte
+		found bool
+	}
+	var (
+		mu    sync.Mutex
+		diffs []diff
+		wrong int
+		wg    sync.WaitGroup
+	)
+	workers := runtime.GOMAXPROCS(0)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			get, release := table.reader()
+			defer release()
+			for _, entry := range entries[lo:hi] {
+				value, ok := get(entry.Key)
+				if ok && string(value) == entry.Value {
+					continue
+				}
+				mu.Lock()
+				wrong++
+				if len(diffs) < verifyMaxDiffs {
+					diffs = append(diffs, diff{entry, append([]byte(nil), value...), ok})
+				}
+				mu.Unlock()
+			}
+		}(i*len(entries)/workers, (i+1)*len(entries)/workers)
+	}
+	wg.Wait()
+	if wrong == 0 {
+		return true
+	}
+
+	fmt.Fprintf(w, "--- testdata\n+++ %s\n@@ %d of %d entries wrong @@\n", name, wrong, len(entries))
+	for _, d := range diffs {
+		fmt.Fprintf(w, "-%q: %q\n", d.entry.Key, d.entry.Value)
+		if d.found {
+			fmt.Fprintf(w, "+%q: %q\n", d.entry.Key, d.value)
+		} else {
+			fmt.Fprintf(w, "+%q: (missing)\n", d.entry.Key)
+		}
+	}
+	if wrong > len(diffs) {
+		fmt.Fprintf(w, " ... and %d more\n", wrong-len(diffs))
+	}
+	return false
+}
+
+func TestVerifyTable(t *testing.T) {
+	var entries []benchEntry
+	for i := 0; i < 100; i++ {
+		entries = append(entries, benchEntry{Key: fmt.Sprintf("key-%d", i), Value: fmt.Sprintf("value-%d", i)})
+	}
+	m := make(map[string]string)
+	for _, entry := range entries {
+		m[entry.Key] = entry.Value
+	}
+	table := backendTable{
+		newReader: sharedReader(stringLookup(func(key string) (string, bool) {
+			value, ok := m[key]
+			return value, ok
+		})),
+		close: noClose,
+	}
+
+	var out strings.Builder
+	if !verifyTable(&out, "good", table, entries) || out.Len() > 0 {
+		t.Fatalf("a correct table failed:\n%s", out.String())
+	}
+
+	for i := 0; i < 2*verifyMaxDiffs; i++ {
+		delete(m, entries[i].Key)
+	}
+	m[entries[len(entries)-1].Key] = "corrupt"
+	if verifyTable(&out, "bad", table, entries) {
+		t.Fatal("a corrupt table passed")
+	}
+	report := out.String()
+	for _, want := range []string{
+		"+++ bad\n",
+		fmt.Sprintf("@@ %d of %d entries wrong @@", 2*verifyMaxDiffs+1, len(entries)),
+		fmt.Sprintf(" ... and %d more\n", verifyMaxDiffs+1),
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report doesn't contain %q:\n%s", want, report)
+		}
+	}
+	if n := strings.Count(report, "\n-"); n != verifyMaxDiffs {
+		t.Errorf("report lists %d entries; want %d:\n%s", n, verifyMaxDiffs, report)
+	}
+}
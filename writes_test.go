@@ -0,0 +1,131 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bpowers/bit-benchmark/internal/zerocopy"
+)
+
+// bit, cdb and the other build-once formats can only be changed by
+// rebuilding them, which their Create benchmarks time.  Stores that take
+// writes once built (see backend.openMutable) are timed doing that too:
+// BenchmarkWrite inserts new keys, and updates existing ones, concurrently
+// from every RunParallel goroutine, without syncing to disk (none of the
+// builders do either).  The lossy caches take writes too, but can drop
+// what's written, so aren't offered as mutable tables.
+//
+//	go test -run XXX -bench Write -backends badger,bbolt,pebble
+func BenchmarkWrite(b *testing.B) {
+	loadBenchTables(b)
+
+	for _, be := range sortedBackends() {
+		b.Run(be.name, func(b *testing.B) {
+			be.skipIfUnavailable(b)
+			if be.openMutable == nil {
+				b.Skipf("%s is build-only: it's rebuilt to change it, as its Create benchmark times", be.name)
+			}
+			table := buildTable(b, be.name, be.openMutable, testData)
+			defer table.close()
+			// updating -missratio's absent keys would insert them.
+			entries := presentEntries(benchEntries)
+
+			b.Run("insert", func(b *testing.B) {
+				benchmarkWrite(b, be.name, table, len(entries), func(i int, key []byte) ([]byte, string) {
+					return appendInsertKey(key[:0]), entries[i].Value
+				})
+			})
+			b.Run("update", func(b *testing.B) {
+				benchmarkWrite(b, be.name, table, len(entries), func(i int, key []byte) ([]byte, string) {
+					// a value from another entry, so it has a
+					// realistic size but does change.
+					return append(key[:0], entries[i].Key...), entries[(i+1)%len(entries)].Value
+				})
+			})
+		})
+	}
+}
+
+// insertKeys numbers the keys appendInsertKey makes.
+var insertKeys atomic.Uint64
+
+// appendInsertKey appends a key that isn't in the table, nor has been
+// inserted before, to key.
+func appendInsertKey(key []byte) []byte {
+	return strconv.AppendUint(append(key, "insert:"...), insertKeys.Add(1), 16)
+}
+
+// benchmarkWrite times writes of what next returns for successive indexes
+// below entryCount, each goroutine starting somewhere random.  next is
+// passed a buffer it can build the key in.
+func benchmarkWrite(b *testing.B, name string, table backendTable, entryCount int, next func(i int, key []byte) ([]byte, string)) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, name, func(b *testing.PB) {
+		defer pinWorker()()
+		put, release := table.newWriter()
+		defer release()
+
+		var key []byte
+		i := rand.Int() % entryCount
+		for b.Next() {
+			var value string
+			key, value = next(i, key)
+			if err := put(key, zerocopy.Bytes(value)); err != nil {
+				panic(err)
+			}
+			i = (i + 1) % entryCount
+		}
+	})
+	b.StopTimer()
+	reportThroughput(b, b.N, float64(b.N)*meanValueSize())
+	faults.report(b)
+}
+
+func TestBackendWrites(t *testing.T) {
+	path := writeGeneratedTestData(t, 2000, 0)
+	var entries []benchEntry
+	streamTestFile(path, func(k, v []byte) {
+		entries = append(entries, benchEntry{Key: string(k), Value: string(v)})
+	})
+
+	for _, b := range sortedBackends() {
+		if b.openMutable == nil {
+			continue
+		}
+		t.Run(b.name, func(t *testing.T) {
+			b.skipIfUnavailable(t)
+			table := buildTable(t, b.name, b.openMutable, path)
+			defer table.close()
+
+			put, release := table.newWriter()
+			inserted := string(appendInsertKey(nil))
+			writes := map[string]string{
+				inserted:       "an inserted value",
+				entries[0].Key: "an updated value",
+			}
+			for k, v := range writes {
+				if err := put([]byte(k), []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			release()
+
+			get, release := table.reader()
+			defer release()
+			writes[entries[1].Key] = entries[1].Value
+			for k, want := range writes {
+				if value, ok := get(k); !ok || string(value) != want {
+					t.Errorf("%s: got %q, %v; want %q", k, value, ok, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,427 @@
+// Copyright 2021 The bit Authors. All rights reserved.
+// Use of this source code is governed by the MIT License
+// that can be found in the LICENSE file.
+
+package bitbenchmark
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// YCSB (https://github.com/brianfrankcooper/YCSB) is the usual way
+// key-value stores are compared, so BenchmarkYCSB runs its core workloads,
+// or workloads from YCSB property files, against every backend that can
+// run them: a workload with writes needs a mutable backend (see
+// backend.openMutable), and E's range scans aren't something any backend
+// here is asked to do.  Like YCSB, it loads recordcount records of
+// fieldcount fields of fieldlength bytes each under hashed "user" keys,
+// then times a request mix drawn from requestdistribution, reporting
+// operations per second as YCSB does:
+//
+//	go test -run XXX -bench YCSB -ycsb a,b,workloads/workloadx -ycsb-records 1000000
+var (
+	ycsbWorkloads = flag.String("ycsb", "a,b,c,d,e,f", "comma-separated YCSB `workloads` for BenchmarkYCSB: a core workload's letter, or a property file")
+	ycsbRecords   = flag.Int("ycsb-records", 0, "override the YCSB workloads' recordcount with `n`")
+)
+
+// ycsbWorkload is the part of a YCSB workload spec BenchmarkYCSB
+// interprets; the property names are YCSB's.
+type ycsbWorkload struct {
+	name         string
+	recordCount  int     // recordcount
+	fieldCount   int     // fieldcount
+	fieldLength  int     // fieldlength
+	read         float64 // readproportion
+	update       float64 // updateproportion
+	insert       float64 // insertproportion
+	scan         float64 // scanproportion
+	readModWrite float64 // readmodifywriteproportion
+	distribution string  // requestdistribution: uniform, zipfian or latest
+}
+
+// ycsbCoreWorkloads are the workloads YCSB ships as workloads/workloada
+// through workloadf, with a recordcount large enough to be worth timing
+// in place of their 1000.
+var ycsbCoreWorkloads = map[string]ycsbWorkload{
+	"a": {read: 0.5, update: 0.5, distribution: "zipfian"},
+	"b": {read: 0.95, update: 0.05, distribution: "zipfian"},
+	"c": {read: 1, distribution: "zipfian"},
+	"d": {read: 0.95, insert: 0.05, distribution: "latest"},
+	"e": {scan: 0.95, insert: 0.05, distribution: "zipfian"},
+	"f": {read: 0.5, readModWrite: 0.5, distribution: "zipfian"},
+}
+
+// newYCSBWorkload returns YCSB's CoreWorkload defaults.
+func newYCSBWorkload(name string) ycsbWorkload {
+	return ycsbWorkload{
+		name:         name,
+		recordCount:  100000,
+		fieldCount:   10,
+		fieldLength:  100,
+		read:         0.95,
+		update:       0.05,
+		distribution: "uniform",
+	}
+}
+
+// loadYCSBWorkload returns the core workload named by a letter, or the
+// workload in a YCSB property file.
+func loadYCSBWorkload(spec string) (ycsbWorkload, error) {
+	var w ycsbWorkload
+	if core, ok := ycsbCoreWorkloads[strings.ToLower(spec)]; ok {
+		w = newYCSBWorkload(strings.ToLower(spec))
+		w.read, w.update, w.insert, w.scan, w.readModWrite = core.read, core.update, core.insert, core.scan, core.readModWrite
+		w.distribution = core.distribution
+	} else {
+		f, err := os.Open(spec)
+		if err != nil {
+			return ycsbWorkload{}, err
+		}
+		defer f.Close()
+		w, err = parseYCSBWorkload(filepath.Base(spec), f)
+		if err != nil {
+			return ycsbWorkload{}, fmt.Errorf("%s: %w", spec, err)
+		}
+	}
+	if *ycsbRecords > 0 {
+		w.recordCount = *ycsbRecords
+	}
+	return w, nil
+}
+
+// parseYCSBWorkload parses a YCSB property file, ignoring the properties
+// that don't apply here (like operationcount: b.N decides that).
+func parseYCSBWorkload(name string, r io.Reader) (ycsbWorkload, error) {
+	w := newYCSBWorkload(name)
+	// a property file's proportions replace the defaults' rather than
+	// adding to them.
+	w.read, w.update = 0, 0
+	ints := map[string]*int{
+		"recordcount": &w.recordCount,
+		"fieldcount":  &w.fieldCount,
+		"fieldlength": &w.fieldLength,
+	}
+	floats := map[string]*float64{
+		"readproportion":            &w.read,
+		"updateproportion":          &w.update,
+		"insertproportion":          &w.insert,
+		"scanproportion":            &w.scan,
+		"readmodifywriteproportion": &w.readModWrite,
+	}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return ycsbWorkload{}, fmt.Errorf("bad property %q", line)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		var err error
+		if p, ok := ints[key]; ok {
+			*p, err = strconv.Atoi(value)
+		} else if p, ok := floats[key]; ok {
+			*p, err = strconv.ParseFloat(value, 64)
+		} else if key == "requestdistribution" {
+			w.distribution = value
+		}
+		if err != nil {
+			return ycsbWorkload{}, fmt.Errorf("bad %s %q", key, value)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return ycsbWorkload{}, err
+	}
+	switch w.distribution {
+	case "uniform", "zipfian", "latest":
+	default:
+		return ycsbWorkload{}, fmt.Errorf("unsupported requestdistribution %q", w.distribution)
+	}
+	if w.recordCount <= 0 || w.fieldCount <= 0 || w.fieldLength <= 0 {
+		return ycsbWorkload{}, fmt.Errorf("recordcount, fieldcount and fieldlength must be positive")
+	}
+	return w, nil
+}
+
+func (w ycsbWorkload) mutates() bool {
+	return w.update > 0 || w.insert > 0 || w.readModWrite > 0
+}
+
+func (w ycsbWorkload) recordSize() int {
+	return w.fieldCount * w.fieldLength
+}
+
+// ycsbKey is YCSB's key for record n, inserted in hashed order.
+func ycsbKey(n uint64) string {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], n)
+	h := fnv.New64a()
+	_, _ = h.Write(b[:])
+	return "user" + strconv.FormatUint(h.Sum64(), 10)
+}
+
+// ycsbValue returns a random record of size bytes, the fields run
+// together.
+func ycsbValue(r *rand.Rand, size int) []byte {
+	value := make([]byte, size)
+	for i := range value {
+		value[i] = byte(' ' + r.Intn('~'-' '+1))
+	}
+	return value
+}
+
+// writeYCSBTestData writes a testdata file of w's records to tableDir,
+// returning its path.
+func writeYCSBTestData(w ycsbWorkload) (string, error) {
+	f, err := os.CreateTemp(tableDir, "bit-test.*.ycsb.testdata")
+	if err != nil {
+		return "", err
+	}
+	_ = f.Close()
+	tw, err := newBinaryTestDataWriter(f.Name())
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < w.recordCount && err == nil; n++ {
+		err = tw.Put([]byte(ycsbKey(uint64(n))), ycsbValue(r, w.recordSize()))
+	}
+	if closeErr := tw.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// ycsbZipfianConstant is YCSB's ZipfianGenerator.ZIPFIAN_CONSTANT.
+const ycsbZipfianConstant = 0.99
+
+// ycsbZipfian draws from [0, n) with YCSB's Zipfian distribution, which
+// (unlike rand.Zipf, whose exponent must be above 1) has the exponent
+// 0.99.  The constants are computed once, and shared by the goroutines
+// drawing from it with their own sources.
+type ycsbZipfian struct {
+	n                        float64
+	theta, alpha, zetan, eta float64
+}
+
+func newYCSBZipfian(n int) *ycsbZipfian {
+	z := &ycsbZipfian{n: float64(n), theta: ycsbZipfianConstant}
+	for i := 1; i <= n; i++ {
+		z.zetan += 1 / math.Pow(float64(i), z.theta)
+	}
+	zeta2 := 1 + 1/math.Pow(2, z.theta)
+	z.alpha = 1 / (1 - z.theta)
+	z.eta = (1 - math.Pow(2/z.n, 1-z.theta)) / (1 - zeta2/z.zetan)
+	return z
+}
+
+func (z *ycsbZipfian) next(r *rand.Rand) int {
+	u := r.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, z.theta) {
+		return 1
+	}
+	return min(int(z.n*math.Pow(z.eta*u-z.eta+1, z.alpha)), int(z.n)-1)
+}
+
+// ycsbScramble spreads the Zipfian distribution's popular items, the low
+// ones, across the key space, as YCSB's ScrambledZipfianGenerator does.
+func ycsbScramble(i, n int) int {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(i))
+	h := fnv.New64a()
+	_, _ = h.Write(b[:])
+	return int(h.Sum64() % uint64(n))
+}
+
+func BenchmarkYCSB(b *testing.B) {
+	var workloads []ycsbWorkload
+	for _, spec := range strings.Split(*ycsbWorkloads, ",") {
+		w, err := loadYCSBWorkload(strings.TrimSpace(spec))
+		if err != nil {
+			b.Fatal(err)
+		}
+		workloads = append(workloads, w)
+	}
+
+	for _, w := range workloads {
+		b.Run(w.name, func(b *testing.B) {
+			if w.scan > 0 {
+				b.Skipf("workload %s scans, which no backend here supports", w.name)
+			}
+			path, err := writeYCSBTestData(w)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer func() {
+				_ = os.Remove(path)
+			}()
+			zipf := newYCSBZipfian(w.recordCount)
+
+			for _, be := range sortedBackends() {
+				b.Run(be.name, func(b *testing.B) {
+					be.skipIfUnavailable(b)
+					open := be.open
+					if w.mutates() {
+						if be.openMutable == nil {
+							b.Skipf("%s is build-only, and workload %s writes", be.name, w.name)
+						}
+						open = be.openMutable
+					}
+					table := buildTable(b, be.name, open, path)
+					defer table.close()
+					// the keys aren't benchEntries', so
+					// there's no lookup pass.
+					prewarm(b)
+					benchmarkYCSB(b, be.name, w, table, zipf)
+				})
+			}
+		})
+	}
+}
+
+func benchmarkYCSB(b *testing.B, name string, w ycsbWorkload, table backendTable, zipf *ycsbZipfian) {
+	// inserted counts the records there are, or are being inserted.
+	var inserted atomic.Int64
+	inserted.Store(int64(w.recordCount))
+	total := w.read + w.update + w.insert + w.readModWrite
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	faults := startPageFaults()
+	runParallel(b, name, func(pb *testing.PB) {
+		defer pinWorker()()
+		get, releaseReader := table.reader()
+		defer releaseReader()
+		var put writeFunc
+		if table.newWriter != nil {
+			var releaseWriter func()
+			put, releaseWriter = table.newWriter()
+			defer releaseWriter()
+		}
+
+		r := rand.New(rand.NewSource(rand.Int63()))
+		value := ycsbValue(r, w.recordSize())
+		choose := func() int {
+			switch w.distribution {
+			case "zipfian":
+				return ycsbScramble(zipf.next(r), w.recordCount)
+			case "latest":
+				// the most recent inserts are the most popular.
+				return max(int(inserted.Load())-1-zipf.next(r), 0)
+			}
+			return r.Intn(w.recordCount)
+		}
+		read := func(n int) {
+			v, ok := get(ycsbKey(uint64(n)))
+			// a record being inserted concurrently may not be
+			// there yet.
+			if (!ok && n < w.recordCount) || (ok && len(v) != len(value)) {
+				panic("bad data or lookup")
+			}
+		}
+		write := func(n int) {
+			// change a field, as YCSB's updates do.
+			field := r.Intn(w.fieldCount) * w.fieldLength
+			value[field] = byte(' ' + r.Intn('~'-' '+1))
+			if err := put([]byte(ycsbKey(uint64(n))), value); err != nil {
+				panic(err)
+			}
+		}
+
+		for pb.Next() {
+			op := r.Float64() * total
+			switch {
+			case op < w.read:
+				read(choose())
+			case op < w.read+w.update:
+				write(choose())
+			case op < w.read+w.update+w.insert:
+				write(int(inserted.Add(1) - 1))
+			default:
+				n := choose()
+				read(n)
+				write(n)
+			}
+		}
+	})
+	b.StopTimer()
+	// reads and updates both move a whole record.
+	reportThroughput(b, b.N, float64(b.N)*float64(w.recordSize()))
+	faults.report(b)
+}
+
+func TestParseYCSBWorkload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workloadx")
+	props := `# a read-mostly workload
+recordcount=5000
+operationcount=1000000
+workload=site.ycsb.workloads.CoreWorkload
+fieldlength = 20
+readproportion=0.9
+updateproportion=0.1
+requestdistribution=latest
+`
+	if err := os.WriteFile(path, []byte(props), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := loadYCSBWorkload(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ycsbWorkload{name: "workloadx", recordCount: 5000, fieldCount: 10, fieldLength: 20, read: 0.9, update: 0.1, distribution: "latest"}
+	if w != want {
+		t.Errorf("got %+v; want %+v", w, want)
+	}
+
+	if w, err := loadYCSBWorkload("F"); err != nil || w.readModWrite != 0.5 || w.distribution != "zipfian" {
+		t.Errorf("core workload f: got %+v, %v", w, err)
+	}
+	if err := os.WriteFile(path, []byte("requestdistribution=hotspot\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadYCSBWorkload(path); err == nil {
+		t.Error("expected an error for an unsupported distribution")
+	}
+}
+
+func TestYCSBZipfian(t *testing.T) {
+	const n = 1000
+	z := newYCSBZipfian(n)
+	r := rand.New(rand.NewSource(1))
+	counts := make([]int, n)
+	for i := 0; i < 100000; i++ {
+		counts[z.next(r)]++
+	}
+	// with an exponent of 0.99, item 0 is drawn about 1/zetan of the time,
+	// and a little under twice as often as item 1.
+	if p, want := float64(counts[0])/100000, 1/z.zetan; math.Abs(p-want) > 0.01 {
+		t.Errorf("item 0 drawn %.3f of the time; want %.3f", p, want)
+	}
+	if counts[0] < counts[1] || counts[1] < counts[10] || counts[10] < counts[500] {
+		t.Errorf("counts aren't decreasing: %d, %d, %d, %d", counts[0], counts[1], counts[10], counts[500])
+	}
+}